@@ -0,0 +1,183 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// the admin api changes the state of individual simulated hosts while the simulator is running. Hosts are
+// identified by their port - also in outbound mode, where the port is only used to number the hosts
+//
+//	GET    /admin/v1/hosts/{port}              state of the host
+//	POST   /admin/v1/hosts/{port}/pcrs         extend measurements into pcrs - {"pcrs": [0, 17]}
+//	DELETE /admin/v1/hosts/{port}/pcrs         put the pcrs back in the state that the host booted with
+//	PUT    /admin/v1/hosts/{port}/asset-tag    provision an asset tag - {"asset_tag": "<base64 tag digest>"}
+//	DELETE /admin/v1/hosts/{port}/asset-tag    remove the asset tag
+//	PUT    /admin/v1/hosts/{port}/host-info    override bios and os strings - {"bios_name": "...", "os_version": "..."}
+//	DELETE /admin/v1/hosts/{port}/host-info    remove the overrides
+//	PUT    /admin/v1/hosts/{port}/reachability take the host off or back on the network - {"online": false}
+
+const adminApiHostsPath = "/admin/v1/hosts/"
+
+type adminPcrsRequest struct {
+	Pcrs []int `json:"pcrs"`
+	// measurement that is extended into the pcrs. A random one is used when empty
+	Measurement string `json:"measurement,omitempty"`
+}
+
+type adminAssetTagRequest struct {
+	AssetTag string `json:"asset_tag"`
+}
+
+type adminReachabilityRequest struct {
+	Online bool `json:"online"`
+}
+
+type adminHostStatus struct {
+	Port             int                 `json:"port"`
+	HardwareUUID     string              `json:"hardware_uuid"`
+	Online           bool                `json:"online"`
+	Pcrs             map[string][]string `json:"pcrs"`
+	IsTagProvisioned bool                `json:"is_tag_provisioned"`
+	AssetTag         string              `json:"asset_tag,omitempty"`
+	HostInfo         hostInfoOverrides   `json:"host_info_overrides"`
+}
+
+type adminApi struct {
+	ctrl controller
+}
+
+func newAdminApiServer(ac *AppConfig, ctrl controller) (*http.Server, error) {
+	if ac.AdminApiUserName == "" || ac.AdminApiUserPassword == "" {
+		return nil, errors.New("AdminApiUserName and AdminApiUserPassword need to be configured for the admin api")
+	}
+	mux := http.NewServeMux()
+	mux.Handle(adminApiHostsPath, adminApi{ctrl: ctrl})
+
+	log.Infof("Starting admin api on port %d", ac.AdminApiPort)
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", ac.AdminApiPort),
+		Handler: mux,
+	}, nil
+}
+
+func (api adminApi) authorized(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	return ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(api.ctrl.config.AdminApiUserName)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(password), []byte(api.ctrl.config.AdminApiUserPassword)) == 1
+}
+
+func (api adminApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !api.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ta-sim"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	pathParts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, adminApiHostsPath), "/"), "/")
+	port, err := strconv.Atoi(pathParts[0])
+	if err != nil || len(pathParts) > 2 {
+		http.Error(w, "invalid host path", http.StatusNotFound)
+		return
+	}
+	host, err := api.ctrl.host(port - api.ctrl.config.PortStart)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("no simulated host on port %d", port), http.StatusNotFound)
+		return
+	}
+	resource := ""
+	if len(pathParts) == 2 {
+		resource = pathParts[1]
+	}
+
+	switch resource + " " + r.Method {
+	case " GET":
+	case "pcrs POST":
+		var req adminPcrsRequest
+		if err = decodeAdminRequest(r, &req); err == nil && len(req.Pcrs) == 0 {
+			err = errors.New("pcrs cannot be empty in request")
+		} else if err == nil {
+			if req.Measurement == "" {
+				req.Measurement = uuid.New().String()
+			}
+			err = host.measure(driftEvents(req.Pcrs, req.Measurement))
+		}
+	case "pcrs DELETE":
+		err = host.resetPcrs()
+	case "asset-tag PUT":
+		var req adminAssetTagRequest
+		if err = decodeAdminRequest(r, &req); err == nil {
+			if _, err = base64.StdEncoding.DecodeString(req.AssetTag); err != nil || req.AssetTag == "" {
+				err = errors.New("asset_tag needs to be a base64 encoded tag digest")
+			} else {
+				err = api.ctrl.setAssetTag(port-api.ctrl.config.PortStart, req.AssetTag)
+			}
+		}
+	case "asset-tag DELETE":
+		err = api.ctrl.setAssetTag(port-api.ctrl.config.PortStart, "")
+	case "host-info PUT":
+		var req hostInfoOverrides
+		if err = decodeAdminRequest(r, &req); err == nil {
+			host.setHostInfo(req)
+		}
+	case "host-info DELETE":
+		host.setHostInfo(hostInfoOverrides{})
+	case "reachability PUT":
+		var req adminReachabilityRequest
+		if err = decodeAdminRequest(r, &req); err == nil {
+			host.setOffline(!req.Online)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method != "GET" {
+		log.Infof("admin api: %s %s", r.Method, r.URL.Path)
+	}
+
+	state := host.snapshot()
+	status := adminHostStatus{
+		Port:             port,
+		HardwareUUID:     api.ctrl.hwUuidMap[port-api.ctrl.config.PortStart],
+		Online:           !state.offline,
+		IsTagProvisioned: state.isTagProvisioned,
+		AssetTag:         state.assetTag,
+		HostInfo:         state.hostInfo,
+	}
+	status.Pcrs = make(map[string][]string)
+	for hashAlg, bank := range state.pcrBanks {
+		for _, value := range bank {
+			status.Pcrs[pcrBankName(hashAlg)] = append(status.Pcrs[pcrBankName(hashAlg)], hex.EncodeToString(value))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+func decodeAdminRequest(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return errors.Wrap(err, "could not decode request body")
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+// newTestController creates a controller for the given number of hosts from the captured test quote without
+// reading the rest of the simulator configuration from disk
+func newTestController(t *testing.T, servers int) *controller {
+	tmpl, _, banks, err := parseQuote(loadTestQuote(t))
+	if err != nil {
+		t.Fatal("failed to parse quote:", err.Error())
+	}
+	aik, err := loadHostAik("test/configuration/aik.cert.pem", "test/configuration/aik.key.pem")
+	if err != nil {
+		t.Fatal("failed to load aik:", err.Error())
+	}
+	profile := &hostProfile{
+		name:          defaultHostProfileName,
+		tpmQuote:      &tamodel.TpmQuoteResponse{},
+		quoteTemplate: tmpl,
+		pcrBanks:      banks,
+	}
+	ctrl := &controller{
+		aik: aik,
+		config: &AppConfig{
+			PortStart:            10000,
+			Servers:              servers,
+			DistinctFlavors:      1,
+			AdminApiUserName:     "admin",
+			AdminApiUserPassword: "password",
+		},
+		hosts: make([]*simulatedHost, servers),
+	}
+	ctrl.hwUuidMap, _, _ = loadHwUuidData(nil, ctrl.config.PortStart, servers)
+	for i := range ctrl.hosts {
+		if ctrl.hosts[i], err = newSimulatedHost(aik, profile, false, ""); err != nil {
+			t.Fatal("failed to create simulated host:", err.Error())
+		}
+	}
+	return ctrl
+}
+
+func adminRequest(api adminApi, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, bytes.NewBufferString(body))
+	req.SetBasicAuth("admin", "password")
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminApi(t *testing.T) {
+
+	ctrl := newTestController(t, 2)
+	api := adminApi{ctrl: *ctrl}
+
+	req := httptest.NewRequest("GET", "/admin/v1/hosts/10001", nil)
+	rec := httptest.NewRecorder()
+	api.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("request without credentials returned %d", rec.Code)
+	}
+	if rec = adminRequest(api, "GET", "/admin/v1/hosts/10002", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("request for an unknown host returned %d", rec.Code)
+	}
+
+	if rec = adminRequest(api, "POST", "/admin/v1/hosts/10001/pcrs", `{"pcrs": [0]}`); rec.Code != http.StatusOK {
+		t.Fatalf("extending pcrs returned %d: %s", rec.Code, rec.Body.String())
+	}
+	extended := ctrl.hosts[1].snapshot().pcrBanks
+	if bytes.Equal(extended[tpmAlgSha256][0], ctrl.hosts[0].profile.pcrBanks[tpmAlgSha256][0]) {
+		t.Error("pcr 0 of the host was not extended")
+	}
+	if !bytes.Equal(ctrl.hosts[0].snapshot().pcrBanks[tpmAlgSha256][0], ctrl.hosts[0].profile.pcrBanks[tpmAlgSha256][0]) {
+		t.Error("pcr 0 of another host was extended")
+	}
+	if rec = adminRequest(api, "DELETE", "/admin/v1/hosts/10001/pcrs", ""); rec.Code != http.StatusOK {
+		t.Fatalf("resetting pcrs returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if !bytes.Equal(ctrl.hosts[1].snapshot().pcrBanks[tpmAlgSha256][0], ctrl.hosts[0].profile.pcrBanks[tpmAlgSha256][0]) {
+		t.Error("pcr 0 of the host was not reset")
+	}
+
+	if rec = adminRequest(api, "PUT", "/admin/v1/hosts/10001/asset-tag", `{"asset_tag": "not base64"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid asset tag returned %d", rec.Code)
+	}
+	adminRequest(api, "PUT", "/admin/v1/hosts/10001/asset-tag", `{"asset_tag": "dGFn"}`)
+	quote, err := ctrl.getQuoteSignedWithNonce(1, &tamodel.TpmQuoteRequest{Nonce: []byte("nonce")})
+	if err != nil {
+		t.Fatal("failed to get quote:", err.Error())
+	}
+	if !quote.IsTagProvisioned || quote.AssetTag != "dGFn" {
+		t.Error("quote of the host does not include the provisioned asset tag")
+	}
+
+	adminRequest(api, "PUT", "/admin/v1/hosts/10001/host-info", `{"bios_version": "2.0"}`)
+	adminRequest(api, "PUT", "/admin/v1/hosts/10001/reachability", `{"online": false}`)
+	state := ctrl.hosts[1].snapshot()
+	if state.hostInfo.BiosVersion != "2.0" || !state.offline {
+		t.Error("host info and reachability of the host were not updated")
+	}
+	if rec = adminRequest(api, "PATCH", "/admin/v1/hosts/10001/host-info", "{}"); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("unsupported method returned %d", rec.Code)
+	}
+}
@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/lib/common/crypt"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// this file reference hvs code in pkg/hvs/controllers/certify_host_aiks_controller.go for the aik certificate
+
+const aikCertValidityYears = 5
+
+// key types of the aiks that the simulated hosts can have
+const (
+	aikKeyTypeRsa      = "RSA"
+	aikKeyTypeEccP256  = "P256"
+	aikKeyTypeEccP384  = "P384"
+	aikRsaKeyBitLength = 2048
+)
+
+var aikEccCurves = map[string]elliptic.Curve{
+	aikKeyTypeEccP256: elliptic.P256(),
+	aikKeyTypeEccP384: elliptic.P384(),
+}
+
+// hostAik is the attestation identity key of a simulated host
+type hostAik struct {
+	cert *x509.Certificate
+	// pem encoded certificate as it is returned in the quote response
+	certPem []byte
+	// either an *rsa.PrivateKey or an *ecdsa.PrivateKey
+	key crypto.Signer
+	// TPM2B_NAME of the aik that is the qualified signer of the quotes
+	name []byte
+}
+
+// aikName returns the TPM2B_NAME of the aik - the name algorithm followed by the digest of the public key
+func aikName(cert *x509.Certificate) []byte {
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return append([]byte{0x00, tpmAlgSha256}, digest[:]...)
+}
+
+// loadPrivacyCa loads the certificate and key of the Privacy CA that issues the aik and binding key certificates
+func loadPrivacyCa(pcaCertPath, pcaKeyPath string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	pcaCert, pcaPrivateKey, err := crypt.LoadX509CertAndPrivateKey(pcaCertPath, pcaKeyPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to load Privacy CA cer and key")
+	}
+	pcaKey, ok := pcaPrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("Privacy Key is not of type RSA")
+	}
+	return pcaCert, pcaKey, nil
+}
+
+// aikKeyType returns the key type of an aik key - empty when it is not a supported key
+func aikKeyType(key crypto.Signer) string {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return aikKeyTypeRsa
+	case *ecdsa.PrivateKey:
+		for keyType, curve := range aikEccCurves {
+			if k.Curve == curve {
+				return keyType
+			}
+		}
+	}
+	return ""
+}
+
+// generateAikKey creates a new aik key of the key type
+func generateAikKey(keyType string) (crypto.Signer, error) {
+	if keyType == aikKeyTypeRsa {
+		return rsa.GenerateKey(rand.Reader, aikRsaKeyBitLength)
+	}
+	curve, ok := aikEccCurves[keyType]
+	if !ok {
+		return nil, errors.Errorf("invalid aik key type %q", keyType)
+	}
+	return ecdsa.GenerateKey(curve, rand.Reader)
+}
+
+// createAikCert issues a certificate for the aik in the same way as the Privacy CA of HVS does
+func createAikCert(pcaCert *x509.Certificate, pcaKey *rsa.PrivateKey, aikPubKey crypto.PublicKey) ([]byte, error) {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate serial number")
+	}
+	// HVS sets the name of the aik as a raw subject alternative name in Extensions - which is ignored when the
+	// certificate is created. So the certificates that HVS issues have no extensions and neither do these
+	template := x509.Certificate{
+		Issuer:       pkix.Name{CommonName: pcaCert.Issuer.CommonName},
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: pcaCert.Issuer.CommonName},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().AddDate(aikCertValidityYears, 0, 0),
+	}
+	aikCert, err := x509.CreateCertificate(rand.Reader, &template, pcaCert, aikPubKey, pcaKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error while Signing and generation Aik Certificate")
+	}
+	return aikCert, nil
+}
+
+func newHostAik(certPem []byte, key crypto.Signer) (*hostAik, error) {
+	cert, err := crypt.GetCertFromPem(certPem)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse aik certificate")
+	}
+	return &hostAik{cert: cert, certPem: certPem, key: key, name: aikName(cert)}, nil
+}
+
+// loadHostAik loads an aik certificate and key that were saved in pem files
+func loadHostAik(certPath, keyPath string) (*hostAik, error) {
+	certPem, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not open aik certificate file")
+	}
+	pk, err := crypt.GetPrivateKeyFromPKCS8File(keyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get aik private key")
+	}
+	key, ok := pk.(crypto.Signer)
+	if !ok || aikKeyType(key) == "" {
+		return nil, errors.New("aik key is not an rsa or ecc key")
+	}
+	return newHostAik(certPem, key)
+}
+
+// generateHostAik creates a new aik of the key type and has it certified by the Privacy CA. The certificate and
+// key are saved to pem files
+func generateHostAik(pcaCert *x509.Certificate, pcaKey *rsa.PrivateKey, keyType, certPath, keyPath string) (*hostAik, error) {
+	key, err := generateAikKey(keyType)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate aik")
+	}
+	certDer, err := createAikCert(pcaCert, pcaKey, key.Public())
+	if err != nil {
+		return nil, err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not marshal aik")
+	}
+	if err = crypt.SavePrivateKeyAsPKCS8(keyDer, keyPath); err != nil {
+		return nil, errors.Wrap(err, "failed to create aik key file")
+	}
+	if err = crypt.SavePemCert(certDer, certPath); err != nil {
+		return nil, errors.Wrap(err, "failed to create aik certificate file")
+	}
+	return newHostAik(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), key)
+}
+
+// loadNCreateHostAiks loads the aik of every host from aikDir. keyTypes holds the key type of the aik of each
+// host - hosts with an empty key type do not get an aik of their own. Aiks that do not exist yet or have a
+// different key type are generated and certified by the Privacy CA - which is only needed when aiks are missing
+func loadNCreateHostAiks(aikDir string, hwUuids, keyTypes []string, pcaCertPath, pcaKeyPath string) ([]*hostAik, error) {
+	if err := os.MkdirAll(aikDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create aik directory")
+	}
+
+	aiks := make([]*hostAik, len(hwUuids))
+	missing := make([]int, 0)
+	for i, hwUuid := range hwUuids {
+		if keyTypes[i] == "" {
+			continue
+		}
+		certPath := filepath.Join(aikDir, hwUuid+".cert.pem")
+		keyPath := filepath.Join(aikDir, hwUuid+".key.pem")
+		if _, err := os.Stat(certPath); os.IsNotExist(err) {
+			missing = append(missing, i)
+			continue
+		}
+		var err error
+		if aiks[i], err = loadHostAik(certPath, keyPath); err != nil {
+			return nil, errors.Wrapf(err, "could not load aik of host %s", hwUuid)
+		}
+		if aikKeyType(aiks[i].key) != keyTypes[i] {
+			aiks[i] = nil
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return aiks, nil
+	}
+
+	pcaCert, pcaKey, err := loadPrivacyCa(pcaCertPath, pcaKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Generating aiks for %d hosts", len(missing))
+
+	err = runOnAllCpus(missing, func(i int) error {
+		var err error
+		certPath := filepath.Join(aikDir, hwUuids[i]+".cert.pem")
+		keyPath := filepath.Join(aikDir, hwUuids[i]+".key.pem")
+		if aiks[i], err = generateHostAik(pcaCert, pcaKey, keyTypes[i], certPath, keyPath); err != nil {
+			return errors.Wrapf(err, "could not generate aik of host %s", hwUuids[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return aiks, nil
+}
+
+// runOnAllCpus calls fn for each of the idxs - generating rsa keys is slow, so the calls are spread over all the
+// cpus. The first error is returned when all the calls are done
+func runOnAllCpus(idxs []int, fn func(i int) error) error {
+	work := make(chan int)
+	errs := make(chan error, len(idxs))
+	wg := new(sync.WaitGroup)
+	for w := 0; w < runtime.NumCPU(); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				if err := fn(i); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	for _, i := range idxs {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// hostAikKeyTypes returns the key type of the aik of every host. The first eccHostsPercentage of the hosts get
+// an ecc aik on eccCurve. The other hosts get an rsa aik when perHostAik is set and share the configured aik
+// otherwise - which is marked by an empty key type
+func hostAikKeyTypes(servers int, perHostAik bool, eccHostsPercentage int, eccCurve string) ([]string, error) {
+	keyTypes := make([]string, servers)
+	eccHosts := servers * eccHostsPercentage / 100
+	if eccHosts > 0 {
+		if _, ok := aikEccCurves[eccCurve]; !ok {
+			return nil, errors.Errorf("invalid ecc aik curve %q", eccCurve)
+		}
+	}
+	for i := range keyTypes {
+		if i < eccHosts {
+			keyTypes[i] = eccCurve
+		} else if perHostAik {
+			keyTypes[i] = aikKeyTypeRsa
+		}
+	}
+	return keyTypes, nil
+}
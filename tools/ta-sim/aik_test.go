@@ -0,0 +1,118 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/lib/common/crypt"
+)
+
+// createTestPrivacyCa saves a self signed Privacy CA to dir and returns the path of its certificate and key
+func createTestPrivacyCa(t *testing.T, dir string) (string, string) {
+	pcaKey, pcaCertPem, err := crypt.CreateSelfSignedCertAndRSAPrivKeys(2048)
+	if err != nil {
+		t.Fatal("failed to generate privacy ca:", err.Error())
+	}
+	pcaCertPath := filepath.Join(dir, "pca-cert")
+	pcaKeyPath := filepath.Join(dir, "pca-key")
+	if err = ioutil.WriteFile(pcaCertPath, []byte(pcaCertPem), 0600); err != nil {
+		t.Fatal("failed to save privacy ca certificate:", err.Error())
+	}
+	pcaKeyDer, err := x509.MarshalPKCS8PrivateKey(pcaKey)
+	if err != nil {
+		t.Fatal("failed to marshal privacy ca key:", err.Error())
+	}
+	if err = crypt.SavePrivateKeyAsPKCS8(pcaKeyDer, pcaKeyPath); err != nil {
+		t.Fatal("failed to save privacy ca key:", err.Error())
+	}
+	return pcaCertPath, pcaKeyPath
+}
+
+func TestHostAiks(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-aik")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	pcaCertPath, pcaKeyPath := createTestPrivacyCa(t, dir)
+	pcaCert, err := crypt.GetCertFromPemFile(pcaCertPath)
+	if err != nil {
+		t.Fatal("failed to load privacy ca certificate:", err.Error())
+	}
+
+	hwUuids := []string{"00000000-0000-0000-0000-000000000000", "11111111-1111-1111-1111-111111111111", "22222222-2222-2222-2222-222222222222"}
+	// the first host gets an ecc aik, the second one an rsa aik and the third one shares the configured aik
+	keyTypes := []string{aikKeyTypeEccP384, aikKeyTypeRsa, ""}
+	aikDir := filepath.Join(dir, "aiks")
+	aiks, err := loadNCreateHostAiks(aikDir, hwUuids, keyTypes, pcaCertPath, pcaKeyPath)
+	if err != nil {
+		t.Fatal("failed to create host aiks:", err.Error())
+	}
+	if aiks[2] != nil {
+		t.Error("host without a key type should not get an aik")
+	}
+	aiks = aiks[:2]
+	if bytes.Equal(aiks[0].name, aiks[1].name) {
+		t.Fatal("hosts do not have distinct aiks")
+	}
+	for i, aik := range aiks {
+		if aikKeyType(aik.key) != keyTypes[i] {
+			t.Errorf("aik of host %d is a %s key instead of a %s key", i, aikKeyType(aik.key), keyTypes[i])
+		}
+	}
+	for _, aik := range aiks {
+		if err = pcaCert.CheckSignature(aik.cert.SignatureAlgorithm, aik.cert.RawTBSCertificate, aik.cert.Signature); err != nil {
+			t.Error("aik certificate is not signed by the privacy ca:", err.Error())
+		}
+	}
+
+	// the saved aiks are loaded again - without the privacy ca
+	reloaded, err := loadNCreateHostAiks(aikDir, hwUuids, keyTypes, "", "")
+	if err != nil {
+		t.Fatal("failed to load host aiks:", err.Error())
+	}
+	for i := range aiks {
+		if !bytes.Equal(reloaded[i].cert.Raw, aiks[i].cert.Raw) || !reloaded[i].key.Public().(interface {
+			Equal(crypto.PublicKey) bool
+		}).Equal(aiks[i].key.Public()) {
+			t.Errorf("aik of host %d was not reloaded", i)
+		}
+	}
+
+	// aiks are generated again when the key type changes
+	keyTypes[1] = aikKeyTypeEccP256
+	regenerated, err := loadNCreateHostAiks(aikDir, hwUuids, keyTypes, pcaCertPath, pcaKeyPath)
+	if err != nil {
+		t.Fatal("failed to regenerate host aiks:", err.Error())
+	}
+	if !bytes.Equal(regenerated[0].cert.Raw, aiks[0].cert.Raw) || aikKeyType(regenerated[1].key) != aikKeyTypeEccP256 {
+		t.Error("only the aik with a changed key type should be regenerated")
+	}
+}
+
+func TestHostAikKeyTypes(t *testing.T) {
+
+	keyTypes, err := hostAikKeyTypes(4, false, 50, aikKeyTypeEccP256)
+	if err != nil {
+		t.Fatal("failed to get aik key types:", err.Error())
+	}
+	if keyTypes[0] != aikKeyTypeEccP256 || keyTypes[1] != aikKeyTypeEccP256 || keyTypes[2] != "" || keyTypes[3] != "" {
+		t.Errorf("unexpected aik key types %v", keyTypes)
+	}
+	if keyTypes, _ = hostAikKeyTypes(4, true, 25, aikKeyTypeEccP384); keyTypes[0] != aikKeyTypeEccP384 || keyTypes[3] != aikKeyTypeRsa {
+		t.Errorf("unexpected aik key types %v", keyTypes)
+	}
+	if _, err = hostAikKeyTypes(4, false, 50, "P521"); err == nil {
+		t.Error("unsupported curve should fail")
+	}
+}
@@ -0,0 +1,306 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/lib/flavor/constants"
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// this file simulates the application integrity measurements of the Trust Agent. A real host measures the files
+// and directories of every deployed manifest on boot, extends the cumulative hash into pcr 15 and returns the
+// measurement xmls with the quote. Refer xml_measurementlog_integrity.go in the verifier rules for the checks
+// that HVS makes.
+//
+// The simulated hosts do not have files to measure - the measurements are derived from the paths in the
+// manifest, so that every host reports the same measurements unless some of its files are tampered
+
+// pcr that the cumulative hash of the application measurements is extended into
+const applicationPcr = 15
+
+const measurementDigestAlg = "SHA384"
+
+// deployedManifest is an application manifest that was deployed to a simulated host along with its measurement
+type deployedManifest struct {
+	uuid string
+	// the manifest is saved so that the host measures it again after the simulator is restarted
+	manifest       *tamodel.Manifest
+	measurementXml string
+	// event that extends the cumulative hash of the measurement into the application pcr
+	event measurementEvent
+}
+
+// isTampered decides whether the file at path on the host is tampered. The decision is derived from the host
+// and the path so that the same files stay tampered for as long as the host exists
+func isTampered(hwUuid, path string, tamperedPercentage int) bool {
+	if tamperedPercentage <= 0 {
+		return false
+	}
+	digest := sha512.Sum384([]byte(hwUuid + path))
+	return int(binary.BigEndian.Uint32(digest[:4])%100) < tamperedPercentage
+}
+
+// measurementValue returns the simulated digest of an entry of the manifest
+func measurementValue(entryType, path, hwUuid string, tampered bool) string {
+	data := "ta-sim-application-" + entryType + path
+	if tampered {
+		data = "ta-sim-tampered-" + hwUuid + path
+	}
+	digest := sha512.Sum384([]byte(data))
+	return hex.EncodeToString(digest[:])
+}
+
+// measureManifest creates the measurement that a host with hwUuid reports for the manifest. tamperedPercentage
+// of the files of the manifest are tampered on each host
+func measureManifest(manifest *tamodel.Manifest, hwUuid string, tamperedPercentage int) (*tamodel.Measurement, error) {
+	if manifest.DigestAlg != "" && strings.ToUpper(manifest.DigestAlg) != measurementDigestAlg {
+		return nil, errors.Errorf("unsupported digest algorithm %q in manifest", manifest.DigestAlg)
+	}
+	measurement := &tamodel.Measurement{
+		Label:     manifest.Label,
+		Uuid:      manifest.Uuid,
+		DigestAlg: measurementDigestAlg,
+	}
+
+	// the cumulative hash is replayed from the measurements in the order of the xml - files, dirs, symlinks
+	values := make([]string, 0, len(manifest.File)+len(manifest.Dir)+len(manifest.Symlink))
+	for _, file := range manifest.File {
+		value := measurementValue("file", file.Path, hwUuid, isTampered(hwUuid, file.Path, tamperedPercentage))
+		measurement.File = append(measurement.File, tamodel.FileMeasurementType{Value: value, Path: file.Path, SearchType: file.SearchType})
+		values = append(values, value)
+	}
+	for _, dir := range manifest.Dir {
+		value := measurementValue("dir", dir.Path+dir.Include+dir.Exclude, hwUuid, false)
+		measurement.Dir = append(measurement.Dir, tamodel.DirectoryMeasurementType{Value: value, Path: dir.Path,
+			Include: dir.Include, Exclude: dir.Exclude, FilterType: dir.FilterType, SearchType: dir.SearchType})
+		values = append(values, value)
+	}
+	for _, symlink := range manifest.Symlink {
+		value := measurementValue("symlink", symlink.Path, hwUuid, false)
+		measurement.Symlink = append(measurement.Symlink, tamodel.SymlinkMeasurementType{Value: value, Path: symlink.Path, SearchType: symlink.SearchType})
+		values = append(values, value)
+	}
+
+	cumulativeHash := make([]byte, sha512.Size384)
+	for _, value := range values {
+		valueBytes, _ := hex.DecodeString(value)
+		hash := sha512.New384()
+		hash.Write(cumulativeHash)
+		hash.Write(valueBytes)
+		cumulativeHash = hash.Sum(nil)
+	}
+	measurement.CumulativeHash = hex.EncodeToString(cumulativeHash)
+	return measurement, nil
+}
+
+// newDeployedManifest measures the manifest on the host. The event that goes with the measurement is tagged with
+// the label and uuid of the manifest, which HVS uses to find it in the event log
+func newDeployedManifest(manifest *tamodel.Manifest, hwUuid string, tamperedPercentage int) (deployedManifest, error) {
+	measurement, err := measureManifest(manifest, hwUuid, tamperedPercentage)
+	if err != nil {
+		return deployedManifest{}, err
+	}
+	measurementXml, err := xml.Marshal(measurement)
+	if err != nil {
+		return deployedManifest{}, errors.Wrap(err, "could not marshal measurement")
+	}
+	cumulativeHash, _ := hex.DecodeString(measurement.CumulativeHash)
+	return deployedManifest{
+		uuid:           manifest.Uuid,
+		manifest:       manifest,
+		measurementXml: xml.Header + string(measurementXml),
+		event: newEvent(applicationPcr, evEventTag, "EV_EVENT_TAG", manifest.Label+"-"+manifest.Uuid,
+			string(cumulativeHash)),
+	}, nil
+}
+
+// deployManifest deploys the application manifest to the simulated host. Like the Trust Agent, manifests of the
+// default flavors are rejected since they are part of the installation
+func (ctrl controller) deployManifest(hostIdx int, manifest *tamodel.Manifest) error {
+	host, err := ctrl.host(hostIdx)
+	if err != nil {
+		return err
+	}
+	if manifest.Uuid == "" || manifest.Label == "" {
+		return errors.New("manifest needs a uuid and a label")
+	}
+	if strings.Contains(manifest.Label, constants.DefaultSoftwareFlavorPrefix) ||
+		strings.Contains(manifest.Label, constants.DefaultWorkloadFlavorPrefix) {
+		return errors.New("manifests of the default flavors are part of the installation and cannot be deployed")
+	}
+	deployed, err := newDeployedManifest(manifest, ctrl.hwUuidMap[hostIdx], ctrl.config.TamperedFilesPercentage)
+	if err != nil {
+		return err
+	}
+	if err = host.deployManifest(deployed); err != nil {
+		return err
+	}
+	if ctrl.manifests != nil {
+		if err = ctrl.manifests.save(ctrl.hwUuidMap[hostIdx], host.deployedManifests()); err != nil {
+			return err
+		}
+	}
+	log.Infof("Deployed manifest %s to host %s", manifest.Uuid, ctrl.hwUuidMap[hostIdx])
+	return nil
+}
+
+// restoreManifests measures the manifests that were deployed to the host before the simulator was restarted
+func (ctrl controller) restoreManifests(hostIdx int) error {
+	host, err := ctrl.host(hostIdx)
+	if err != nil || ctrl.manifests == nil {
+		return err
+	}
+	hwUuid := ctrl.hwUuidMap[hostIdx]
+	for _, manifest := range ctrl.manifests.manifests(hwUuid) {
+		deployed, err := newDeployedManifest(manifest, hwUuid, ctrl.config.TamperedFilesPercentage)
+		if err != nil {
+			return errors.Wrapf(err, "could not measure manifest %s of host %s", manifest.Uuid, hwUuid)
+		}
+		if err = host.deployManifest(deployed); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestStore keeps the application manifests that were deployed to the simulated hosts - like the manifest
+// files that the Trust Agent keeps, so that a host still measures them after the simulator is restarted
+type manifestStore struct {
+	lock sync.Mutex
+	// file the manifests are saved to - manifests are only kept in memory when empty
+	path string
+	// xml of the deployed manifests in the order of deployment keyed by the hardware uuid of the host
+	manifestXmls map[string][]string
+}
+
+// loadManifestStore loads the deployed manifests from path. There are no deployed manifests when the file does
+// not exist
+func loadManifestStore(path string) (*manifestStore, error) {
+	store := &manifestStore{path: path, manifestXmls: make(map[string][]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read manifest file")
+	}
+	if err = json.Unmarshal(data, &store.manifestXmls); err != nil {
+		return nil, errors.Wrap(err, "could not decode manifest file")
+	}
+	for hwUuid, manifestXmls := range store.manifestXmls {
+		for _, manifestXml := range manifestXmls {
+			if err = xml.Unmarshal([]byte(manifestXml), &tamodel.Manifest{}); err != nil {
+				return nil, errors.Wrapf(err, "could not decode manifest of host %s", hwUuid)
+			}
+		}
+	}
+	return store, nil
+}
+
+// manifests returns the manifests that were deployed to the host with the hardware uuid
+func (store *manifestStore) manifests(hwUuid string) []*tamodel.Manifest {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	manifests := make([]*tamodel.Manifest, 0, len(store.manifestXmls[hwUuid]))
+	for _, manifestXml := range store.manifestXmls[hwUuid] {
+		// the manifests were decoded when the store was loaded
+		manifest := &tamodel.Manifest{}
+		_ = xml.Unmarshal([]byte(manifestXml), manifest)
+		manifests = append(manifests, manifest)
+	}
+	return manifests
+}
+
+// save records the manifests deployed to the host with the hardware uuid and writes all the manifests to the file
+func (store *manifestStore) save(hwUuid string, manifests []*tamodel.Manifest) error {
+	manifestXmls := make([]string, 0, len(manifests))
+	for _, manifest := range manifests {
+		manifestXml, err := xml.Marshal(manifest)
+		if err != nil {
+			return errors.Wrap(err, "could not marshal manifest")
+		}
+		manifestXmls = append(manifestXmls, string(manifestXml))
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.manifestXmls[hwUuid] = manifestXmls
+	if store.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(store.manifestXmls, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal manifests")
+	}
+	if err = ioutil.WriteFile(store.path, data, 0644); err != nil {
+		return errors.Wrap(err, "could not write manifests to file")
+	}
+	return nil
+}
+
+// applicationMeasurement measures the manifest on the simulated host without deploying it
+func (ctrl controller) applicationMeasurement(hostIdx int, manifest *tamodel.Manifest) (*tamodel.Measurement, error) {
+	if _, err := ctrl.host(hostIdx); err != nil {
+		return nil, err
+	}
+	return measureManifest(manifest, ctrl.hwUuidMap[hostIdx], ctrl.config.TamperedFilesPercentage)
+}
+
+func decodeManifest(r *http.Request) (*tamodel.Manifest, error) {
+	var manifest tamodel.Manifest
+	if err := xml.NewDecoder(r.Body).Decode(&manifest); err != nil {
+		return nil, errors.Wrap(err, "Could not unmarshal xml body to manifest structure")
+	}
+	return &manifest, nil
+}
+
+func (ctrl controller) manifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	manifest, err := decodeManifest(r)
+	if err == nil {
+		err = ctrl.deployManifest(ctrl.hostIndex(r), manifest)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("could not deploy manifest: " + err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (ctrl controller) measurement(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	manifest, err := decodeManifest(r)
+	var measurement *tamodel.Measurement
+	if err == nil {
+		measurement, err = ctrl.applicationMeasurement(ctrl.hostIndex(r), manifest)
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("could not measure manifest: " + err.Error()))
+		return
+	}
+	data, _ := xml.Marshal(measurement)
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(data)
+}
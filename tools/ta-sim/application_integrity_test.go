@@ -0,0 +1,165 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/intel-secl/intel-secl/v4/pkg/lib/verifier/rules"
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+const testManifest = `<Manifest xmlns="lib:wml:manifests:1.0" Label="ta-sim-test" Uuid="7a9ac586-40f9-43b2-976b-26667431efca" DigestAlg="SHA384">
+	<Dir Exclude="" FilterType="regex" Include=".*" Path="/opt/ta-sim/bin"/>
+	<Symlink Path="/opt/ta-sim/bin/ta-sim"/>
+	<File Path="/opt/ta-sim/bin/.*" SearchType="regex"/>
+	<File Path="/opt/ta-sim/configuration/config.yml"/>
+</Manifest>`
+
+// verifyApplicationIntegrity applies the HVS rule for the integrity of the application measurements to the quote
+// of the host
+func verifyApplicationIntegrity(t *testing.T, ctrl *controller, hostIdx int, expectedCumulativeHash string) *hvs.RuleResult {
+	quote, err := ctrl.getQuoteSignedWithNonce(hostIdx, &tamodel.TpmQuoteRequest{Nonce: []byte("nonce")})
+	if err != nil {
+		t.Fatal("failed to get quote:", err.Error())
+	}
+	hostManifest := hvs.HostManifest{MeasurementXmls: quote.TcbMeasurements.TcbMeasurements}
+	var eventLogs []hvs.TpmEventLog
+	if err = json.Unmarshal([]byte(quote.EventLog), &eventLogs); err != nil {
+		t.Fatal("failed to unmarshal event log:", err.Error())
+	}
+	for _, eventLog := range eventLogs {
+		if eventLog.Pcr.Bank == "SHA256" {
+			hostManifest.PcrManifest.PcrEventLogMap.Sha256EventLogs = append(hostManifest.PcrManifest.PcrEventLogMap.Sha256EventLogs, eventLog)
+		}
+	}
+	rule, _ := rules.NewXmlMeasurementLogIntegrity(uuid.MustParse("7a9ac586-40f9-43b2-976b-26667431efca"), "ta-sim-test", expectedCumulativeHash)
+	result, err := rule.Apply(&hostManifest)
+	if err != nil {
+		t.Fatal("failed to apply the rule:", err.Error())
+	}
+	return result
+}
+
+func TestApplicationIntegrity(t *testing.T) {
+
+	ctrl := newTestController(t, 2)
+	// the hosts share the profile of the test controller
+	ctrl.hosts[0].profile.eventLog = tbootEventLog()
+	for _, host := range ctrl.hosts {
+		if err := host.resetPcrs(); err != nil {
+			t.Fatal("failed to reset pcrs:", err.Error())
+		}
+	}
+
+	// the flavor is created from the measurement of a host without tampered files
+	var manifest tamodel.Manifest
+	if err := xml.Unmarshal([]byte(testManifest), &manifest); err != nil {
+		t.Fatal("failed to unmarshal manifest:", err.Error())
+	}
+	expected, err := ctrl.applicationMeasurement(0, &manifest)
+	if err != nil {
+		t.Fatal("failed to measure manifest:", err.Error())
+	}
+	if len(expected.File) != 2 || len(expected.Dir) != 1 || len(expected.Symlink) != 1 {
+		t.Fatal("measurement does not match the manifest")
+	}
+
+	for i := range ctrl.hosts {
+		req := httptest.NewRequest("POST", fmt.Sprintf("https://localhost:%d/v2/deploy/manifest", 10000+i), bytes.NewBufferString(testManifest))
+		rec := httptest.NewRecorder()
+		ctrl.manifest(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("deploying manifest to host %d returned %d: %s", i, rec.Code, rec.Body.String())
+		}
+	}
+	if result := verifyApplicationIntegrity(t, ctrl, 0, expected.CumulativeHash); !result.Trusted || len(result.Faults) != 0 {
+		t.Errorf("application measurements of the host are not trusted: %+v", result.Faults)
+	}
+
+	// the measurements are extended into the pcrs again after a reboot
+	if err = ctrl.hosts[0].resetPcrs(); err != nil {
+		t.Fatal("failed to reset pcrs:", err.Error())
+	}
+	if result := verifyApplicationIntegrity(t, ctrl, 0, expected.CumulativeHash); len(result.Faults) != 0 {
+		t.Errorf("application measurements of the host are not trusted after a reboot: %+v", result.Faults)
+	}
+
+	// every file is tampered on the hosts that deploy the manifest from now on
+	ctrl.config.TamperedFilesPercentage = 100
+	if err = ctrl.deployManifest(1, &manifest); err != nil {
+		t.Fatal("failed to deploy manifest:", err.Error())
+	}
+	if result := verifyApplicationIntegrity(t, ctrl, 1, expected.CumulativeHash); len(result.Faults) == 0 {
+		t.Error("tampered application measurements should not be trusted")
+	}
+	if len(ctrl.hosts[1].snapshot().measurementXmls) != 1 {
+		t.Error("deploying a manifest again should replace the measurement")
+	}
+
+	manifest.Label = "ISecL_Default_Application_Flavor_v4.1"
+	if err = ctrl.deployManifest(1, &manifest); err == nil {
+		t.Error("deploying the manifest of a default flavor should fail")
+	}
+}
+
+func TestDeployedManifestsAreRestored(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-manifests")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	manifestsPath := filepath.Join(dir, "manifests.json")
+
+	// the host has no measurement profile - the event of the manifest is added to the captured event log
+	ctrl := newTestController(t, 1)
+	if ctrl.manifests, err = loadManifestStore(manifestsPath); err != nil {
+		t.Fatal("failed to load manifests:", err.Error())
+	}
+	var manifest tamodel.Manifest
+	if err = xml.Unmarshal([]byte(testManifest), &manifest); err != nil {
+		t.Fatal("failed to unmarshal manifest:", err.Error())
+	}
+	expected, err := ctrl.applicationMeasurement(0, &manifest)
+	if err != nil {
+		t.Fatal("failed to measure manifest:", err.Error())
+	}
+	if err = ctrl.deployManifest(0, &manifest); err != nil {
+		t.Fatal("failed to deploy manifest:", err.Error())
+	}
+	if result := verifyApplicationIntegrity(t, ctrl, 0, expected.CumulativeHash); len(result.Faults) != 0 {
+		t.Errorf("application measurements of a host without measurement profile are not trusted: %+v", result.Faults)
+	}
+
+	// the manifest is measured again after a restart
+	restarted := newTestController(t, 1)
+	restarted.hwUuidMap = ctrl.hwUuidMap
+	if restarted.manifests, err = loadManifestStore(manifestsPath); err != nil {
+		t.Fatal("failed to reload manifests:", err.Error())
+	}
+	if err = restarted.restoreManifests(0); err != nil {
+		t.Fatal("failed to restore manifests:", err.Error())
+	}
+	before, after := ctrl.hosts[0].snapshot(), restarted.hosts[0].snapshot()
+	if !reflect.DeepEqual(after.measurementXmls, before.measurementXmls) || !reflect.DeepEqual(after.pcrBanks, before.pcrBanks) {
+		t.Error("deployed manifest was not restored after a restart")
+	}
+	if result := verifyApplicationIntegrity(t, restarted, 0, expected.CumulativeHash); len(result.Faults) != 0 {
+		t.Errorf("application measurements are not trusted after a restart: %+v", result.Faults)
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// assetTagStore keeps the asset tags that were deployed to the simulated hosts - like the NV index of the TPM of
+// a real host, so that a deployed tag is still reported after the simulator is restarted
+type assetTagStore struct {
+	lock sync.Mutex
+	// file the tags are saved to - tags are only kept in memory when empty
+	path string
+	// base64 encoded tag digest keyed by the hardware uuid of the host
+	tags map[string]string
+}
+
+// loadAssetTagStore loads the deployed asset tags from path. There are no deployed tags when the file does not exist
+func loadAssetTagStore(path string) (*assetTagStore, error) {
+	store := &assetTagStore{path: path, tags: make(map[string]string)}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not read asset tag file")
+	}
+	if err = json.Unmarshal(data, &store.tags); err != nil {
+		return nil, errors.Wrap(err, "could not decode asset tag file")
+	}
+	return store, nil
+}
+
+// tag returns the asset tag that was deployed to the host with the hardware uuid
+func (store *assetTagStore) tag(hwUuid string) (string, bool) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	tag, ok := store.tags[hwUuid]
+	return tag, ok
+}
+
+// save records the asset tag deployed to the host with the hardware uuid and writes all the tags to the file
+func (store *assetTagStore) save(hwUuid, tag string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	store.tags[hwUuid] = tag
+	return store.write()
+}
+
+// remove forgets the asset tag of the host with the hardware uuid and writes the remaining tags to the file
+func (store *assetTagStore) remove(hwUuid string) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	delete(store.tags, hwUuid)
+	return store.write()
+}
+
+// write writes the tags to the file of the store - the lock of the store needs to be held
+func (store *assetTagStore) write() error {
+	if store.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(store.tags, "", "\t")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal asset tags")
+	}
+	if err = ioutil.WriteFile(store.path, data, 0644); err != nil {
+		return errors.Wrap(err, "could not write asset tags to file")
+	}
+	return nil
+}
+
+// deployAssetTag provisions the tag of the request on the simulated host like the Trust Agent does. The tag
+// digest is folded into the nonce of later quotes
+func (ctrl controller) deployAssetTag(hostIdx int, req *tamodel.TagWriteRequest) error {
+	if _, err := ctrl.host(hostIdx); err != nil {
+		return err
+	}
+	if len(req.Tag) == 0 {
+		return errors.New("tag cannot be empty in request")
+	}
+	hwUuid := ctrl.hwUuidMap[hostIdx]
+	if !strings.EqualFold(req.HardwareUUID, hwUuid) {
+		return errors.Errorf("hardware uuid %q in request does not match the host", req.HardwareUUID)
+	}
+
+	if err := ctrl.setAssetTag(hostIdx, base64.StdEncoding.EncodeToString(req.Tag)); err != nil {
+		return err
+	}
+	log.Infof("Deployed asset tag to host %s", hwUuid)
+	return nil
+}
+
+// setAssetTag provisions the base64 encoded tag digest on the simulated host and saves it, so that the host keeps
+// the tag across restarts. An empty tag revokes the tag of the host
+func (ctrl controller) setAssetTag(hostIdx int, tag string) error {
+	host, err := ctrl.host(hostIdx)
+	if err != nil {
+		return err
+	}
+	host.setAssetTag(tag != "", tag)
+	if ctrl.assetTags == nil {
+		return nil
+	}
+	if tag == "" {
+		return ctrl.assetTags.remove(ctrl.hwUuidMap[hostIdx])
+	}
+	return ctrl.assetTags.save(ctrl.hwUuidMap[hostIdx], tag)
+}
+
+func (ctrl controller) tag(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req tamodel.TagWriteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("Could not unmarshal json body to tag write request structure"))
+		return
+	}
+	if err := ctrl.deployAssetTag(ctrl.hostIndex(r), &req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte("could not deploy asset tag: " + err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+func TestDeployAssetTag(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-tag")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	tagsPath := filepath.Join(dir, "asset_tags.json")
+
+	ctrl := newTestController(t, 2)
+	if ctrl.assetTags, err = loadAssetTagStore(tagsPath); err != nil {
+		t.Fatal("failed to load asset tags:", err.Error())
+	}
+	tagRequest := func(port int, body string) int {
+		req := httptest.NewRequest("POST", fmt.Sprintf("https://localhost:%d/v2/tag", port), bytes.NewBufferString(body))
+		rec := httptest.NewRecorder()
+		ctrl.tag(rec, req)
+		return rec.Code
+	}
+
+	tag := []byte("0123456789012345678901234567890123456789012345678")
+	body := fmt.Sprintf(`{"tag": %q, "hardware_uuid": %q}`, base64.StdEncoding.EncodeToString(tag), ctrl.hwUuidMap[1])
+	if code := tagRequest(10000, body); code != http.StatusBadRequest {
+		t.Errorf("deploying a tag with the hardware uuid of another host returned %d", code)
+	}
+	if code := tagRequest(10001, fmt.Sprintf(`{"hardware_uuid": %q}`, ctrl.hwUuidMap[1])); code != http.StatusBadRequest {
+		t.Errorf("deploying an empty tag returned %d", code)
+	}
+	if code := tagRequest(10001, body); code != http.StatusOK {
+		t.Fatalf("deploying a tag returned %d", code)
+	}
+
+	quote, err := ctrl.getQuoteSignedWithNonce(1, &tamodel.TpmQuoteRequest{Nonce: []byte("nonce")})
+	if err != nil {
+		t.Fatal("failed to get quote:", err.Error())
+	}
+	if !quote.IsTagProvisioned || quote.AssetTag != base64.StdEncoding.EncodeToString(tag) {
+		t.Error("quote of the host does not report the deployed tag")
+	}
+	if ctrl.hosts[0].snapshot().isTagProvisioned {
+		t.Error("tag was deployed to the wrong host")
+	}
+
+	// the deployed tag is still there after a restart
+	reloaded, err := loadAssetTagStore(tagsPath)
+	if err != nil {
+		t.Fatal("failed to reload asset tags:", err.Error())
+	}
+	if saved, ok := reloaded.tag(ctrl.hwUuidMap[1]); !ok || saved != base64.StdEncoding.EncodeToString(tag) {
+		t.Error("deployed tag was not saved")
+	}
+
+	// tags that are provisioned and revoked with the admin api are saved as well
+	api := adminApi{ctrl: *ctrl}
+	if rec := adminRequest(api, "PUT", "/admin/v1/hosts/10000/asset-tag", `{"asset_tag": "dGFn"}`); rec.Code != http.StatusOK {
+		t.Fatalf("provisioning a tag returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := adminRequest(api, "DELETE", "/admin/v1/hosts/10001/asset-tag", ""); rec.Code != http.StatusOK {
+		t.Fatalf("revoking a tag returned %d: %s", rec.Code, rec.Body.String())
+	}
+	if reloaded, err = loadAssetTagStore(tagsPath); err != nil {
+		t.Fatal("failed to reload asset tags:", err.Error())
+	}
+	if saved, ok := reloaded.tag(ctrl.hwUuidMap[0]); !ok || saved != "dGFn" {
+		t.Error("tag provisioned with the admin api was not saved")
+	}
+	if _, ok := reloaded.tag(ctrl.hwUuidMap[1]); ok {
+		t.Error("tag revoked with the admin api is still saved")
+	}
+}
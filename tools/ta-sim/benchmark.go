@@ -0,0 +1,301 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// the benchmark requests trust reports for the simulated hosts from HVS at a fixed rate and measures how long it
+// takes until each report is available. HVS either creates the report right away - then the latency is the time
+// of the request - or accepts the request and creates the report in the background, in which case the reports
+// of the host are polled until one was created after the request was sent
+//
+//	ta-sim benchmark [--hosts=<n>] [--rate=<requests per second>] [--poll-interval=1s] [--timeout=5m] [--output=benchmark.json]
+
+const (
+	benchmarkStatusCompleted = "completed"
+	benchmarkStatusFailed    = "failed"
+	benchmarkStatusTimeout   = "timeout"
+)
+
+type benchmarkOptions struct {
+	hosts        int
+	rate         float64
+	pollInterval time.Duration
+	timeout      time.Duration
+	output       string
+}
+
+// benchmarkResult is the outcome of the report request for a single host
+type benchmarkResult struct {
+	Port    int     `json:"port"`
+	HwUuid  string  `json:"hw_uuid"`
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency_seconds"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// benchmarkSummary is the latency distribution of the completed report requests in seconds
+type benchmarkSummary struct {
+	Hosts     int     `json:"hosts"`
+	Completed int     `json:"completed"`
+	Failed    int     `json:"failed"`
+	TimedOut  int     `json:"timed_out"`
+	Duration  float64 `json:"duration_seconds"`
+	Rate      float64 `json:"requests_per_second"`
+	Mean      float64 `json:"mean"`
+	P50       float64 `json:"p50"`
+	P90       float64 `json:"p90"`
+	P95       float64 `json:"p95"`
+	P99       float64 `json:"p99"`
+	Max       float64 `json:"max"`
+}
+
+type benchmarkReport struct {
+	Summary benchmarkSummary  `json:"summary"`
+	Results []benchmarkResult `json:"results"`
+}
+
+// createReport requests a new report for the host. Returns true when HVS created the report right away
+func (api hvsApi) createReport(hwUuid string) (bool, error) {
+	reqBody, _ := json.Marshal(map[string]string{"hardware_uuid": hwUuid})
+	req, err := http.NewRequest("POST", api.hvsUrl+"reports", bytes.NewBuffer(reqBody))
+	if err != nil {
+		return false, errors.Wrap(err, "could not create report request")
+	}
+	req.Header.Set("Content-type", "application/json")
+	status, body, err := api.do(req)
+	if err != nil {
+		return false, errors.Wrap(err, "could not request report")
+	}
+	switch status {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		return false, nil
+	}
+	return false, errors.Errorf("report request returned %d: %s", status, string(body))
+}
+
+// reportCreatedSince returns true when HVS has a report of the host that was created after since
+func (api hvsApi) reportCreatedSince(hwUuid string, since time.Time) (bool, error) {
+	var collection hvs.ReportCollection
+	query := url.Values{"hostHardwareId": {hwUuid}, "latestPerHost": {"true"}}
+	if err := api.search("reports", query, &collection); err != nil {
+		return false, err
+	}
+	for _, report := range collection.Reports {
+		// HVS stores the creation time in seconds
+		if report != nil && !report.CreatedAt.Before(since.Truncate(time.Second)) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// benchmarkHost requests a report for the host and waits until it is available
+func benchmarkHost(api hvsApi, port int, hwUuid string, opts benchmarkOptions) benchmarkResult {
+	result := benchmarkResult{Port: port, HwUuid: hwUuid, Status: benchmarkStatusCompleted}
+	start := time.Now()
+	done, err := api.createReport(hwUuid)
+	for err == nil && !done {
+		if time.Since(start) > opts.timeout {
+			result.Status = benchmarkStatusTimeout
+			break
+		}
+		time.Sleep(opts.pollInterval)
+		done, err = api.reportCreatedSince(hwUuid, start)
+	}
+	result.Latency = time.Since(start).Seconds()
+	if err != nil {
+		result.Status, result.Error = benchmarkStatusFailed, err.Error()
+	}
+	return result
+}
+
+// runBenchmark starts the report requests for the hosts at opts.rate and returns when all of them are done
+func runBenchmark(api hvsApi, portStart int, hwUuids []string, opts benchmarkOptions) benchmarkReport {
+	results := make([]benchmarkResult, len(hwUuids))
+	wg := new(sync.WaitGroup)
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.rate))
+	defer ticker.Stop()
+
+	start := time.Now()
+	for i, hwUuid := range hwUuids {
+		if i > 0 {
+			<-ticker.C
+		}
+		wg.Add(1)
+		go func(i int, hwUuid string) {
+			defer wg.Done()
+			results[i] = benchmarkHost(api, portStart+i, hwUuid, opts)
+			if results[i].Error != "" {
+				log.Errorf("report of host %d failed: %s", portStart+i, results[i].Error)
+			}
+		}(i, hwUuid)
+	}
+	wg.Wait()
+	return benchmarkReport{Summary: summarizeBenchmark(results, time.Since(start)), Results: results}
+}
+
+// percentile returns the nearest-rank percentile of the sorted latencies
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+func summarizeBenchmark(results []benchmarkResult, duration time.Duration) benchmarkSummary {
+	summary := benchmarkSummary{Hosts: len(results), Duration: duration.Seconds()}
+	latencies := make([]float64, 0, len(results))
+	total := 0.0
+	for _, result := range results {
+		switch result.Status {
+		case benchmarkStatusCompleted:
+			summary.Completed++
+			latencies = append(latencies, result.Latency)
+			total += result.Latency
+		case benchmarkStatusTimeout:
+			summary.TimedOut++
+		default:
+			summary.Failed++
+		}
+	}
+	sort.Float64s(latencies)
+	if len(latencies) > 0 {
+		summary.Mean = total / float64(len(latencies))
+		summary.Max = latencies[len(latencies)-1]
+	}
+	summary.P50 = percentile(latencies, 50)
+	summary.P90 = percentile(latencies, 90)
+	summary.P95 = percentile(latencies, 95)
+	summary.P99 = percentile(latencies, 99)
+	if summary.Duration > 0 {
+		summary.Rate = float64(summary.Completed) / summary.Duration
+	}
+	return summary
+}
+
+// writeBenchmarkReport writes the results as csv when the file name ends with .csv and as json otherwise
+func writeBenchmarkReport(path string, report benchmarkReport) error {
+	var data []byte
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		buf := new(bytes.Buffer)
+		w := csv.NewWriter(buf)
+		_ = w.Write([]string{"port", "hw_uuid", "status", "latency_seconds", "error"})
+		for _, result := range report.Results {
+			_ = w.Write([]string{strconv.Itoa(result.Port), result.HwUuid, result.Status,
+				strconv.FormatFloat(result.Latency, 'f', 3, 64), result.Error})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return errors.Wrap(err, "could not write benchmark results")
+		}
+		data = buf.Bytes()
+	} else {
+		var err error
+		if data, err = json.MarshalIndent(report, "", "  "); err != nil {
+			return errors.Wrap(err, "could not marshal benchmark results")
+		}
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrap(err, "could not write benchmark results to file")
+	}
+	return nil
+}
+
+func parseBenchmarkOptions(ac *AppConfig, args []string) (benchmarkOptions, error) {
+	opts := benchmarkOptions{
+		hosts:        ac.Servers,
+		rate:         10,
+		pollInterval: time.Second,
+		timeout:      5 * time.Minute,
+		output:       "benchmark.json",
+	}
+	for _, arg := range args {
+		split := strings.SplitN(arg, "=", 2)
+		if len(split) < 2 {
+			return opts, errors.New("invalid cli argument: " + arg)
+		}
+		var err error
+		switch flag, val := split[0], split[1]; flag {
+		case "--hosts":
+			opts.hosts, err = strconv.Atoi(val)
+		case "--rate":
+			opts.rate, err = strconv.ParseFloat(val, 64)
+		case "--poll-interval":
+			opts.pollInterval, err = time.ParseDuration(val)
+		case "--timeout":
+			opts.timeout, err = time.ParseDuration(val)
+		case "--output":
+			opts.output = val
+		default:
+			return opts, errors.New("invalid cli argument: " + arg)
+		}
+		if err != nil {
+			return opts, errors.Wrapf(err, "invalid value for %s", split[0])
+		}
+	}
+	if opts.hosts <= 0 || opts.hosts > ac.Servers {
+		return opts, errors.Errorf("--hosts needs to be between 1 and %d", ac.Servers)
+	}
+	if opts.rate <= 0 || opts.pollInterval <= 0 || opts.timeout <= 0 {
+		return opts, errors.New("--rate, --poll-interval and --timeout need to be positive")
+	}
+	return opts, nil
+}
+
+func benchmarkMain(ac *AppConfig) error {
+	opts, err := parseBenchmarkOptions(ac, os.Args[2:])
+	if err != nil {
+		return err
+	}
+	api, err := newHvsApi(ac)
+	if err != nil {
+		return err
+	}
+	hwUuids, err := loadNSaveHwUuidFile(ac.hwUuidMapPath, ac.PortStart, ac.Servers)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Requesting reports for %d hosts at %g requests per second", opts.hosts, opts.rate)
+	report := runBenchmark(api, ac.PortStart, hwUuids[:opts.hosts], opts)
+	if err = writeBenchmarkReport(opts.output, report); err != nil {
+		return err
+	}
+
+	s := report.Summary
+	fmt.Printf("Reports: %d completed, %d failed, %d timed out in %.1fs (%.2f reports/s)\n",
+		s.Completed, s.Failed, s.TimedOut, s.Duration, s.Rate)
+	fmt.Printf("Latency (s): mean %.3f  p50 %.3f  p90 %.3f  p95 %.3f  p99 %.3f  max %.3f\n",
+		s.Mean, s.P50, s.P90, s.P95, s.P99, s.Max)
+	fmt.Printf("Results written to %s\n", opts.output)
+	return nil
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+)
+
+func TestPercentile(t *testing.T) {
+
+	latencies := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	if p := percentile(latencies, 50); p != 5 {
+		t.Errorf("p50 is %g", p)
+	}
+	if p := percentile(latencies, 95); p != 10 {
+		t.Errorf("p95 is %g", p)
+	}
+	if p := percentile(nil, 99); p != 0 {
+		t.Errorf("p99 of no latencies is %g", p)
+	}
+}
+
+func TestBenchmark(t *testing.T) {
+
+	// the "sync" host gets its report right away, the "async" host after it was polled once and the "broken"
+	// host never
+	lock := sync.Mutex{}
+	polled := make(map[string]int)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hvs/v2/reports", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "POST" {
+			var req map[string]string
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			switch req["hardware_uuid"] {
+			case "sync":
+				w.WriteHeader(http.StatusCreated)
+			case "async":
+				w.WriteHeader(http.StatusAccepted)
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		hwUuid := r.URL.Query().Get("hostHardwareId")
+		polled[hwUuid]++
+		collection := hvs.ReportCollection{Reports: []*hvs.Report{{CreatedAt: time.Now().Add(-time.Hour)}}}
+		if polled[hwUuid] > 1 {
+			collection.Reports[0].CreatedAt = time.Now()
+		}
+		_ = json.NewEncoder(w).Encode(collection)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	api := hvsApi{hvsUrl: server.URL + "/hvs/v2/", authToken: "token", client: server.Client()}
+	opts := benchmarkOptions{rate: 100, pollInterval: 10 * time.Millisecond, timeout: time.Minute}
+	report := runBenchmark(api, 10000, []string{"sync", "async", "broken"}, opts)
+
+	s := report.Summary
+	if s.Hosts != 3 || s.Completed != 2 || s.Failed != 1 || s.TimedOut != 0 {
+		t.Errorf("unexpected benchmark summary: %+v", s)
+	}
+	if report.Results[1].Latency < 0.02 || s.Max != report.Results[1].Latency {
+		t.Errorf("latency of the polled report was not measured: %+v", report.Results[1])
+	}
+	if report.Results[2].Status != benchmarkStatusFailed || report.Results[2].Port != 10002 {
+		t.Errorf("failed report request was not recorded: %+v", report.Results[2])
+	}
+
+	dir, err := ioutil.TempDir("", "ta-sim-benchmark")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err = writeBenchmarkReport(filepath.Join(dir, "results.csv"), report); err != nil {
+		t.Fatal("failed to write results:", err.Error())
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "results.csv"))
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 4 || !strings.HasPrefix(lines[1], "10000,sync,completed,") {
+		t.Errorf("unexpected csv results: %s", string(data))
+	}
+}
@@ -6,18 +6,25 @@ package main
 
 import (
 	"bytes"
-	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/asn1"
 	"encoding/binary"
 	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 
+	hvsConstants "github.com/intel-secl/intel-secl/v4/pkg/hvs/constants"
+	"github.com/intel-secl/intel-secl/v4/pkg/lib/common/crypt"
 	"github.com/intel-secl/intel-secl/v4/pkg/lib/privacyca"
 	pcaConsts "github.com/intel-secl/intel-secl/v4/pkg/lib/privacyca/constants"
 	wlaModel "github.com/intel-secl/intel-secl/v4/pkg/model/wlagent"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 )
 
 // this file reference hvs code in pkg/hvs/controllers/certify_host_keys_controller.go
@@ -25,75 +32,307 @@ import (
 // reference the file common/key_registration.go for contents in this structure
 // refer the RegisterKeyInfo struct
 
-func generateRegisterKeyInfo(aik, bindingKey *rsa.PrivateKey, aikCertByte []byte) (wlaModel.RegisterKeyInfo, error) {
+// usages of the keys that the Trust Agent has certified by the Privacy CA of HVS
+const (
+	hostKeyUsageBinding = "binding"
+	hostKeyUsageSigning = "signing"
+)
 
-	// pkg\lib\privacyca\tpm2utils\tpm2_certified_key.go: PopulateTpmCertifyKey20
+var hostKeyUsages = []string{hostKeyUsageBinding, hostKeyUsageSigning}
 
-	tpmCertifyKey := bytes.NewBuffer([]byte{})
-	binary.Write(tpmCertifyKey, binary.BigEndian, pcaConsts.Tpm2CertifiedKeyMagic)
-	binary.Write(tpmCertifyKey, binary.BigEndian, pcaConsts.Tpm2CertifiedKeyType)
-	binary.Write(tpmCertifyKey, binary.BigEndian, uint16(6))
-	// write with some random data
-	binary.Write(tpmCertifyKey, binary.BigEndian, [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06})
+// common names that HVS gives the certificates of the keys
+var hostKeyCertCommonNames = map[string]string{
+	hostKeyUsageBinding: hvsConstants.HostBindingKeyCertificateCN,
+	hostKeyUsageSigning: hvsConstants.HostSigningKeyCertificateCN,
+}
 
-	binary.Write(tpmCertifyKey, binary.BigEndian, uint16(6))
-	// write with some random data
-	binary.Write(tpmCertifyKey, binary.BigEndian, [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06})
+// TPM_ALG_ID and TPMA_OBJECT values of the TPMT_PUBLIC of the keys. Like the keys of the Trust Agent, they are rsa
+// keys that never leave the TPM - binding keys decrypt with OAEP and signing keys sign with RSASSA
+const (
+	tpmAlgRsa  = 0x0001
+	tpmAlgNull = 0x0010
+	tpmAlgOaep = 0x0017
 
-	// write with 25 0x00 (Clock 8 bytes, ResentCount 5 bytes, RestartCount 4 bytes, Safe 1 byte, FirmwareVersion 8 bytes)
-	binary.Write(tpmCertifyKey, binary.BigEndian, [25]byte{})
+	tpmaObjectFixedTpm            = 0x00000002
+	tpmaObjectFixedParent         = 0x00000010
+	tpmaObjectSensitiveDataOrigin = 0x00000020
+	tpmaObjectUserWithAuth        = 0x00000040
+	tpmaObjectDecrypt             = 0x00020000
+	tpmaObjectSign                = 0x00040000
 
-	binary.Write(tpmCertifyKey, binary.BigEndian, uint16(34))
-	binary.Write(tpmCertifyKey, binary.BigEndian, uint16(pcaConsts.TPM_ALG_ID_SHA256))
-	// random sha256 digest
-	nameDigest, _ := hex.DecodeString("e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855")
-	binary.Write(tpmCertifyKey, binary.BigEndian, nameDigest)
+	// HVS reads the last 256 bytes of the public area as the modulus of the key
+	hostKeyRsaKeyBitLength = 2048
+)
 
-	paddingHead, _ := hex.DecodeString(pcaConsts.Tpm2NameDigestPrefixPadding)
-	paddingTail, _ := hex.DecodeString(pcaConsts.Tpm2NameDigestSuffixPadding)
-	nameDigest = append(paddingHead, nameDigest...)
-	nameDigest = append(nameDigest, paddingTail...)
+// oids of the certificate extensions with the TPM2_Certify attestation and its signature
+var (
+	hostKeyCertifyInfoOid      = asn1.ObjectIdentifier{2, 5, 4, 133, 3, 2, 41}
+	hostKeyCertifySignatureOid = asn1.ObjectIdentifier{2, 5, 4, 133, 3, 2, 41, 1}
+)
 
-	binary.Write(tpmCertifyKey, binary.BigEndian, uint16(len(nameDigest)))
-	binary.Write(tpmCertifyKey, binary.BigEndian, nameDigest)
+// hostKeys are the pem encoded certificates of the keys of a host by key usage
+type hostKeys map[string][]byte
 
-	h := sha256.New()
-	h.Write(tpmCertifyKey.Bytes())
+// certifiesHostKeys tells if HVS accepts keys that are certified by the aik - it only verifies the signatures of
+// 2048 bit rsa aiks
+func certifiesHostKeys(aik *hostAik) bool {
+	key, ok := aik.key.(*rsa.PrivateKey)
+	return ok && key.N.BitLen() == aikRsaKeyBitLength
+}
+
+// marshalTpm2bPublic returns the TPM2B_PUBLIC of an rsa key of the usage as the TPM returns it when it creates the key
+func marshalTpm2bPublic(pub *rsa.PublicKey, usage string) ([]byte, error) {
+	attributes := uint32(tpmaObjectFixedTpm | tpmaObjectFixedParent | tpmaObjectSensitiveDataOrigin | tpmaObjectUserWithAuth)
+	var scheme uint16
+	switch usage {
+	case hostKeyUsageBinding:
+		attributes |= tpmaObjectDecrypt
+		scheme = tpmAlgOaep
+	case hostKeyUsageSigning:
+		attributes |= tpmaObjectSign
+		scheme = tpmAlgRsassa
+	default:
+		return nil, errors.Errorf("invalid key usage %q", usage)
+	}
+	if pub.E != 65537 {
+		return nil, errors.New("key does not have the default exponent")
+	}
+
+	size := (pub.N.BitLen() + 7) / 8
+	public := bytes.NewBuffer([]byte{})
+	binary.Write(public, binary.BigEndian, uint16(tpmAlgRsa))
+	binary.Write(public, binary.BigEndian, uint16(tpmAlgSha256))
+	binary.Write(public, binary.BigEndian, attributes)
+	// no authPolicy and no symmetric algorithm, since the key is not a storage key
+	binary.Write(public, binary.BigEndian, uint16(0))
+	binary.Write(public, binary.BigEndian, uint16(tpmAlgNull))
+	binary.Write(public, binary.BigEndian, scheme)
+	binary.Write(public, binary.BigEndian, uint16(tpmAlgSha256))
+	binary.Write(public, binary.BigEndian, uint16(pub.N.BitLen()))
+	// an exponent of 0 is the default exponent
+	binary.Write(public, binary.BigEndian, uint32(0))
+	binary.Write(public, binary.BigEndian, uint16(size))
+	public.Write(pub.N.FillBytes(make([]byte, size)))
+
+	tpm2bPublic := bytes.NewBuffer([]byte{})
+	binary.Write(tpm2bPublic, binary.BigEndian, uint16(public.Len()))
+	tpm2bPublic.Write(public.Bytes())
+	return tpm2bPublic.Bytes(), nil
+}
 
-	signature, err := rsa.SignPKCS1v15(rand.Reader, aik, crypto.SHA256, h.Sum(nil))
+// generateRegisterKeyInfo creates the request that the Trust Agent sends to HVS to have a key of the usage
+// certified - with the TPM2_Certify attestation of the key that is signed by the aik
+func generateRegisterKeyInfo(aik *hostAik, key *rsa.PublicKey, usage string) (wlaModel.RegisterKeyInfo, error) {
+	if !certifiesHostKeys(aik) {
+		return wlaModel.RegisterKeyInfo{}, errors.New("keys can only be certified by 2048 bit rsa aiks")
+	}
+	tpm2bPublic, err := marshalTpm2bPublic(key, usage)
 	if err != nil {
-		return wlaModel.RegisterKeyInfo{}, errors.Wrap(err, "failed to sign certify key with aik")
+		return wlaModel.RegisterKeyInfo{}, err
 	}
+	// the name of the key is the name algorithm followed by the digest of the TPMT_PUBLIC
+	digest := sha256.Sum256(tpm2bPublic[2:])
+	name := append([]byte{0x00, tpmAlgSha256}, digest[:]...)
 
-	err = rsa.VerifyPKCS1v15(&aik.PublicKey, crypto.SHA256, h.Sum(nil), signature)
+	// pkg\lib\privacyca\tpm2utils\tpm2_certified_key.go: PopulateTpmCertifyKey20
+	tpmCertifyKey := bytes.NewBuffer([]byte{})
+	binary.Write(tpmCertifyKey, binary.BigEndian, pcaConsts.Tpm2CertifiedKeyMagic)
+	binary.Write(tpmCertifyKey, binary.BigEndian, pcaConsts.Tpm2CertifiedKeyType)
+	binary.Write(tpmCertifyKey, binary.BigEndian, uint16(len(aik.name)))
+	tpmCertifyKey.Write(aik.name)
+	// the Trust Agent does not pass qualifying data
+	binary.Write(tpmCertifyKey, binary.BigEndian, uint16(0))
+	binary.Write(tpmCertifyKey, binary.BigEndian, tpmsClockInfo{})
+	binary.Write(tpmCertifyKey, binary.BigEndian, uint64(0))
+	// TPMS_CERTIFY_INFO - the name and the qualified name of the key. HVS does not look at the qualified name and
+	// the simulator has no parent key to qualify the name with, so it is the name as well
+	for i := 0; i < 2; i++ {
+		binary.Write(tpmCertifyKey, binary.BigEndian, uint16(len(name)))
+		tpmCertifyKey.Write(name)
+	}
+
+	attestDigest := sha256.Sum256(tpmCertifyKey.Bytes())
+	signature, err := marshalTpmtSignature(aik.key, tpmAlgRsassa, tpmAlgSha256, attestDigest[:])
 	if err != nil {
-		return wlaModel.RegisterKeyInfo{}, errors.Wrap(err, "signature can not be verified")
+		return wlaModel.RegisterKeyInfo{}, errors.Wrap(err, "failed to sign certify key with aik")
 	}
 
+	// the Trust Agent sends the TPM2B_NAME of the key as it is laid out in memory - refer ValidateNameDigest
+	paddingHead, _ := hex.DecodeString(pcaConsts.Tpm2NameDigestPrefixPadding)
+	paddingTail, _ := hex.DecodeString(pcaConsts.Tpm2NameDigestSuffixPadding)
+	nameDigest := append(paddingHead, digest[:]...)
+	nameDigest = append(nameDigest, paddingTail...)
+
 	return wlaModel.RegisterKeyInfo{
-		PublicKeyModulus:       bindingKey.PublicKey.N.Bytes(),
+		PublicKeyModulus:       tpm2bPublic,
 		TpmCertifyKey:          tpmCertifyKey.Bytes(),
-		TpmCertifyKeySignature: append([]byte{0x01, 0x02}, signature...),
+		TpmCertifyKeySignature: signature,
 		NameDigest:             nameDigest,
-		AikDerCertificate:      aikCertByte,
+		AikDerCertificate:      aik.cert.Raw,
 		TpmVersion:             "2.0",
 		OsType:                 "linux",
 	}, nil
 }
 
-func createBindingKeyCert(pcaKey crypto.PrivateKey, pcaCert *x509.Certificate, commName string, regKeyInfo wlaModel.RegisterKeyInfo) ([]byte, error) {
+// certifyHostKey issues the certificate of a key of the usage in the same way as the Privacy CA of HVS does - after
+// validating the TPM2_Certify attestation like HVS validates it
+func certifyHostKey(pcaCert *x509.Certificate, pcaKey *rsa.PrivateKey, usage string, regKeyInfo wlaModel.RegisterKeyInfo) ([]byte, error) {
 
+	aikCert, err := x509.ParseCertificate(regKeyInfo.AikDerCertificate)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get aik certificate from aik der bytes")
+	}
 	certifyKey20, err := privacyca.NewCertifyKey(regKeyInfo)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create privacy ca certify key instance")
 	}
+	if !certifyKey20.IsTpmGeneratedKey() {
+		return nil, errors.New("Not a valid tpm generated key")
+	}
+	if valid, err := certifyKey20.IsCertifiedKeySignatureValid(aikCert); err != nil {
+		return nil, errors.Wrap(err, "Signature verification failed")
+	} else if !valid {
+		return nil, errors.New("Signature verification failed")
+	}
+	if valid, err := certifyKey20.ValidatePublicKey(); err != nil || !valid {
+		return nil, errors.New("Public key digest does not match digest in the TCG certificate")
+	}
+	if err = certifyKey20.ValidateNameDigest(); err != nil {
+		return nil, errors.Wrap(err, "TPM Key Name specified does not match name digest in the TCG certificate")
+	}
 	rsaPubKey, err := certifyKey20.GetPublicKeyFromModulus()
 	if err != nil {
 		return nil, errors.Wrap(err, "Error while retrieving public key modulus")
 	}
-	certificate, err := certifyKey20.CertifyKey(pcaCert, rsaPubKey, pcaKey.(*rsa.PrivateKey), commName)
+	certificate, err := certifyKey20.CertifyKey(pcaCert, rsaPubKey, pcaKey, hostKeyCertCommonNames[usage])
 	if err != nil {
 		return nil, errors.Wrapf(err, "controllers/certify_host_keys_controller:generateCertificate() Error while Certifying key")
 	}
 	return certificate, nil
 }
+
+// isHostKeyCertifiedBy tells if the pem encoded key certificate has a TPM2_Certify attestation that is signed by
+// the aik - which is how KBS verifies binding key certificates
+func isHostKeyCertifiedBy(certPem []byte, aik *hostAik) bool {
+	cert, err := crypt.GetCertFromPem(certPem)
+	if err != nil {
+		return false
+	}
+	certifyKey20, err := privacyca.NewCertifyKey(wlaModel.RegisterKeyInfo{
+		TpmCertifyKey:          crypt.GetCertExtension(cert, hostKeyCertifyInfoOid),
+		TpmCertifyKeySignature: crypt.GetCertExtension(cert, hostKeyCertifySignatureOid),
+		TpmVersion:             "2.0",
+	})
+	if err != nil || !certifyKey20.IsTpmGeneratedKey() {
+		return false
+	}
+	valid, err := certifyKey20.IsCertifiedKeySignatureValid(aik.cert)
+	return err == nil && valid
+}
+
+// generateHostKey creates a new key of the usage that is certified by the aik and has it certified by the Privacy
+// CA. The certificate and key are saved to pem files
+func generateHostKey(pcaCert *x509.Certificate, pcaKey *rsa.PrivateKey, aik *hostAik, usage, certPath, keyPath string) ([]byte, error) {
+	key, err := rsa.GenerateKey(rand.Reader, hostKeyRsaKeyBitLength)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to generate %s key", usage)
+	}
+	rki, err := generateRegisterKeyInfo(aik, &key.PublicKey, usage)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate RegisterKeyInfo")
+	}
+	certDer, err := certifyHostKey(pcaCert, pcaKey, usage, rki)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to certify %s key", usage)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not marshal %s key", usage)
+	}
+	if err = crypt.SavePrivateKeyAsPKCS8(keyDer, keyPath); err != nil {
+		return nil, errors.Wrapf(err, "failed to create %s key file", usage)
+	}
+	if err = crypt.SavePemCert(certDer, certPath); err != nil {
+		return nil, errors.Wrapf(err, "failed to create %s key certificate file", usage)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDer}), nil
+}
+
+// hostKeyPaths returns the paths of the certificate and key of the key of the host with the usage
+func hostKeyPaths(keyDir, hwUuid, usage string) (string, string) {
+	return filepath.Join(keyDir, hwUuid+"."+usage+".cert.pem"), filepath.Join(keyDir, hwUuid+"."+usage+".key.pem")
+}
+
+// hostKeyAiks returns the aiks that certify binding and signing keys of the hosts - nil for the hosts that serve
+// the shared keys. Without perHostKeys only hosts with an aik of their own get keys, since the shared keys are not
+// certified by their aik
+func hostKeyAiks(aiks []*hostAik, sharedAik *hostAik, perHostKeys bool) []*hostAik {
+	keyAiks := make([]*hostAik, len(aiks))
+	for i, aik := range aiks {
+		if perHostKeys || aik != sharedAik {
+			keyAiks[i] = aik
+		}
+	}
+	return keyAiks
+}
+
+// loadNCreateHostKeys loads the binding and signing key certificates of every host from keyDir. Hosts without an
+// aik or with an aik that HVS does not accept key certifications from do not get keys of their own. Keys that do
+// not exist yet or were not certified by the aik of the host are generated and certified by the Privacy CA - which
+// is only needed when keys are missing
+func loadNCreateHostKeys(keyDir string, hwUuids []string, aiks []*hostAik, pcaCertPath, pcaKeyPath string) ([]hostKeys, error) {
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		return nil, errors.Wrap(err, "could not create host key directory")
+	}
+
+	keys := make([]hostKeys, len(hwUuids))
+	missing := make([]int, 0)
+	for i, hwUuid := range hwUuids {
+		if aiks[i] == nil || !certifiesHostKeys(aiks[i]) {
+			continue
+		}
+		keys[i] = hostKeys{}
+		for _, usage := range hostKeyUsages {
+			certPath, _ := hostKeyPaths(keyDir, hwUuid, usage)
+			certPem, err := ioutil.ReadFile(certPath)
+			if err != nil && !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "could not load %s key of host %s", usage, hwUuid)
+			}
+			if err == nil && isHostKeyCertifiedBy(certPem, aiks[i]) {
+				keys[i][usage] = certPem
+			}
+		}
+		if len(keys[i]) < len(hostKeyUsages) {
+			missing = append(missing, i)
+		}
+	}
+	if len(missing) == 0 {
+		return keys, nil
+	}
+
+	pcaCert, pcaKey, err := loadPrivacyCa(pcaCertPath, pcaKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Generating binding and signing keys for %d hosts", len(missing))
+
+	// every host has a map of its own, so the hosts can be filled in concurrently
+	err = runOnAllCpus(missing, func(i int) error {
+		for _, usage := range hostKeyUsages {
+			if keys[i][usage] != nil {
+				continue
+			}
+			certPath, keyPath := hostKeyPaths(keyDir, hwUuids[i], usage)
+			certPem, err := generateHostKey(pcaCert, pcaKey, aiks[i], usage, certPath, keyPath)
+			if err != nil {
+				return errors.Wrapf(err, "could not generate %s key of host %s", usage, hwUuids[i])
+			}
+			keys[i][usage] = certPem
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
@@ -5,11 +5,18 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/asn1"
 	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/intel-secl/intel-secl/v4/pkg/lib/common/crypt"
@@ -31,52 +38,163 @@ func TestBindingKey(t *testing.T) {
 	if err != nil {
 		t.Fatal("failed to generate aik:", err.Error())
 	}
-	aikCertPemBlock, _ := pem.Decode([]byte(aikCertPem))
-	if aikCertPemBlock == nil {
-		t.Fatal("failed to decode aik cert pem")
-	}
-	aikCertByte := aikCertPemBlock.Bytes
-	aikCert, err := x509.ParseCertificate(aikCertByte)
+	aik, err := newHostAik([]byte(aikCertPem), aikKey)
 	if err != nil {
 		t.Fatal("failed to parse aik certificate:", err.Error())
 	}
-	bindingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	aikCert := aik.cert
+
+	for _, usage := range hostKeyUsages {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatalf("failed to generate %s key: %s", usage, err.Error())
+		}
+		rki, err := generateRegisterKeyInfo(aik, &key.PublicKey, usage)
+		if err != nil {
+			t.Fatal("failed to create RegisterKeyInfo:", err.Error())
+		}
+		// the attestation is validated like HVS validates it before the certificate is issued
+		keyCertBytes, err := certifyHostKey(aikCert, aikKey, usage, rki)
+		if err != nil {
+			t.Fatalf("failed to create %s key cert: %s", usage, err.Error())
+		}
+		keyCert, err := x509.ParseCertificate(keyCertBytes)
+		if err != nil {
+			t.Fatalf("failed to parse %s key certificate: %s", usage, err.Error())
+		}
+		if keyCert.Subject.CommonName != hostKeyCertCommonNames[usage] {
+			t.Errorf("%s key certificate has common name %s", usage, keyCert.Subject.CommonName)
+		}
+		if !key.PublicKey.Equal(keyCert.PublicKey) {
+			t.Errorf("%s key certificate is not issued for the %s key", usage, usage)
+		}
+
+		tpm2CertifyKey := tpm2utils.Tpm2CertifiedKey{}
+		if err = tpm2CertifyKey.PopulateTpmCertifyKey20(rki.TpmCertifyKey); err != nil {
+			t.Fatal("failed to parse certify key:", err.Error())
+		}
+		if !bytes.Equal(tpm2CertifyKey.Tpm2bName.Name, aik.name) {
+			t.Errorf("%s key is not certified by the aik", usage)
+		}
+
+		pemBlock := &pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: keyCert.Raw,
+		}
+		t.Log(string(pem.EncodeToMemory(pemBlock)))
+
+		if !verifyTpmBindingKeyCertificate(keyCert, aikCert, t) {
+			t.Fatalf("failed to verify %s key cert", usage)
+		}
+	}
+
+	// keys can not be certified with an aik that HVS does not verify certifications of
+	eccAik := &hostAik{cert: aikCert, name: aik.name}
+	if eccAik.key, err = generateAikKey(aikKeyTypeEccP256); err != nil {
+		t.Fatal("failed to generate ecc aik:", err.Error())
+	}
+	if _, err = generateRegisterKeyInfo(eccAik, &aikKey.PublicKey, hostKeyUsageBinding); err == nil {
+		t.Error("key should not be certified by an ecc aik")
+	}
+}
+
+func TestHostKeys(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-keys")
 	if err != nil {
-		t.Fatal("failed to generate binding key:", err.Error())
+		t.Fatal("failed to create temp dir:", err.Error())
 	}
-	rki, err := generateRegisterKeyInfo(aikKey, bindingKey, aikCert.Raw)
+	defer os.RemoveAll(dir)
+	pcaCertPath, pcaKeyPath := createTestPrivacyCa(t, dir)
+
+	hwUuids := []string{"00000000-0000-0000-0000-000000000000", "11111111-1111-1111-1111-111111111111", "22222222-2222-2222-2222-222222222222"}
+	// the second host has an ecc aik, so it does not get keys of its own
+	keyTypes := []string{aikKeyTypeRsa, aikKeyTypeEccP256, aikKeyTypeRsa}
+	aiks, err := loadNCreateHostAiks(filepath.Join(dir, "aiks"), hwUuids, keyTypes, pcaCertPath, pcaKeyPath)
 	if err != nil {
-		t.Fatal("failed to create RegisterKeyInfo:", err.Error())
+		t.Fatal("failed to create host aiks:", err.Error())
 	}
-	bindingKeyCertBytes, err := createBindingKeyCert(aikKey, aikCert, "binding-key", rki)
+	keyDir := filepath.Join(dir, "keys")
+	keys, err := loadNCreateHostKeys(keyDir, hwUuids, aiks, pcaCertPath, pcaKeyPath)
 	if err != nil {
-		t.Fatal("failed to create binding key cert:", err.Error())
+		t.Fatal("failed to create host keys:", err.Error())
 	}
-	bindingKeyCert, err := x509.ParseCertificate(bindingKeyCertBytes)
+	if keys[1] != nil {
+		t.Error("host with an ecc aik should not get keys")
+	}
+	for _, i := range []int{0, 2} {
+		for _, usage := range hostKeyUsages {
+			if !isHostKeyCertifiedBy(keys[i][usage], aiks[i]) {
+				t.Errorf("%s key of host %d is not certified by its aik", usage, i)
+			}
+		}
+		if bytes.Equal(keys[i][hostKeyUsageBinding], keys[i][hostKeyUsageSigning]) {
+			t.Errorf("host %d has the same binding and signing key", i)
+		}
+	}
+	if bytes.Equal(keys[0][hostKeyUsageBinding], keys[2][hostKeyUsageBinding]) || isHostKeyCertifiedBy(keys[0][hostKeyUsageBinding], aiks[2]) {
+		t.Fatal("hosts do not have distinct keys")
+	}
+
+	// the saved keys are loaded again - without the privacy ca
+	reloaded, err := loadNCreateHostKeys(keyDir, hwUuids, aiks, "", "")
 	if err != nil {
-		t.Fatal("failed to parse binding key certificate:", err.Error())
+		t.Fatal("failed to load host keys:", err.Error())
+	}
+	for _, i := range []int{0, 2} {
+		for _, usage := range hostKeyUsages {
+			if !bytes.Equal(reloaded[i][usage], keys[i][usage]) {
+				t.Errorf("%s key of host %d was not reloaded", usage, i)
+			}
+		}
 	}
 
-	tpm2CertifyKey := tpm2utils.Tpm2CertifiedKey{}
-	// this function returns error in v3.3.0
-	tpm2CertifyKey.PopulateTpmCertifyKey20(rki.TpmCertifyKey)
+	// keys are generated again when the host gets a different aik
+	aiks[2] = aiks[0]
+	regenerated, err := loadNCreateHostKeys(keyDir, hwUuids, aiks, pcaCertPath, pcaKeyPath)
+	if err != nil {
+		t.Fatal("failed to regenerate host keys:", err.Error())
+	}
+	if !bytes.Equal(regenerated[0][hostKeyUsageBinding], keys[0][hostKeyUsageBinding]) ||
+		!isHostKeyCertifiedBy(regenerated[2][hostKeyUsageSigning], aiks[0]) {
+		t.Error("only the keys of the host with a different aik should be regenerated")
+	}
+}
 
-	t.Log(tpm2CertifyKey)
+func TestHostKeyAiks(t *testing.T) {
 
-	pemBlock := &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: aikCertByte,
+	shared, own := &hostAik{}, &hostAik{}
+	aiks := []*hostAik{shared, own}
+	// hosts with an aik of their own get their own keys, the shared keys are only certified by the shared aik
+	if keyAiks := hostKeyAiks(aiks, shared, false); keyAiks[0] != nil || keyAiks[1] != own {
+		t.Error("without PerHostKeys only the host with an aik of its own should get keys")
 	}
-	t.Log(string(pem.EncodeToMemory(pemBlock)))
-
-	pemBlock = &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: bindingKeyCert.Raw,
+	if keyAiks := hostKeyAiks(aiks, shared, true); keyAiks[0] != shared || keyAiks[1] != own {
+		t.Error("with PerHostKeys every host should get keys")
 	}
-	t.Log(string(pem.EncodeToMemory(pemBlock)))
+}
+
+func TestHostKeyCertificates(t *testing.T) {
+
+	ctrl := newTestController(t, 2)
+	ctrl.keys = hostKeys{hostKeyUsageBinding: []byte("shared binding key"), hostKeyUsageSigning: []byte("shared signing key")}
+	ctrl.hosts[1].keys = hostKeys{hostKeyUsageBinding: []byte("binding key"), hostKeyUsageSigning: []byte("signing key")}
 
-	if !verifyTpmBindingKeyCertificate(bindingKeyCert, aikCert, t) {
-		t.Fatal("failed to verify binding key cert")
+	for _, tc := range []struct {
+		handler http.HandlerFunc
+		port    int
+		cert    string
+	}{
+		{ctrl.bindingKey, 10000, "shared binding key"},
+		{ctrl.signingKey, 10000, "shared signing key"},
+		{ctrl.bindingKey, 10001, "binding key"},
+		{ctrl.signingKey, 10001, "signing key"},
+	} {
+		rec := httptest.NewRecorder()
+		tc.handler(rec, httptest.NewRequest("GET", fmt.Sprintf("https://localhost:%d/", tc.port), nil))
+		if rec.Body.String() != tc.cert {
+			t.Errorf("host %d returned %q instead of %q", tc.port, rec.Body.String(), tc.cert)
+		}
 	}
 }
 
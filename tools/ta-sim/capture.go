@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	client "github.com/intel-secl/intel-secl/v4/pkg/clients/ta"
+	"github.com/pkg/errors"
+)
+
+// capturePcrList is the list of pcrs that is requested in the quote of a captured host profile
+var capturePcrList = []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23}
+
+// captureNonce returns a random nonce for the quote of a captured host profile
+func captureNonce() (string, error) {
+	nonce := make([]byte, 20)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "could not generate a nonce")
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// captureHostProfile downloads the host info and a quote with all the pcrs and the event log from a Trust Agent and
+// saves them as a host profile in dir. The aik and binding key certificates of the Trust Agent are not captured -
+// the simulated hosts sign with keys of the simulator, so the certificates could not be used
+func captureHostProfile(taClient client.TAClient, dir string, pcrBanks []string) error {
+	hostInfo, err := taClient.GetHostInfo()
+	if err != nil {
+		return errors.Wrap(err, "Error getting host-info from TA")
+	}
+	nonce, err := captureNonce()
+	if err != nil {
+		return err
+	}
+	quote, err := taClient.GetTPMQuote(nonce, capturePcrList, pcrBanks)
+	if err != nil {
+		return errors.Wrap(err, "Error getting tpm-quote from TA")
+	}
+	hostInfoJson, err := json.MarshalIndent(hostInfo, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling host-info")
+	}
+	quoteXml, err := xml.Marshal(quote)
+	if err != nil {
+		return errors.Wrap(err, "Error marshalling tpm-quote")
+	}
+
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "Could not create host profile directory %s", dir)
+	}
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{hostProfileHostInfoFile, hostInfoJson},
+		{hostProfileQuoteFile, quoteXml},
+	}
+	for _, file := range files {
+		path := filepath.Join(dir, file.name)
+		if err = ioutil.WriteFile(path, file.data, 0644); err != nil {
+			return errors.Wrapf(err, "Error writing %s", path)
+		}
+	}
+	return nil
+}
+
+// captureHostProfileMain captures a host profile from a Trust Agent in http mode
+//
+//	ta-sim capture-host-profile --ta-url=https://<ta>:1443/v2 --name=<profile> [--pcr-banks=SHA1,SHA256] [--force]
+func captureHostProfileMain(ac *AppConfig) error {
+	var taUrl, name string
+	pcrBanks := []string{"SHA1", "SHA256", "SHA384"}
+	force := false
+	for _, arg := range os.Args[2:] {
+		split := strings.SplitN(arg, "=", 2)
+		switch flag := split[0]; {
+		case flag == "--force":
+			force = true
+		case len(split) < 2:
+			return errors.New("invalid cli argument: " + arg)
+		case flag == "--ta-url":
+			taUrl = split[1]
+		case flag == "--name":
+			name = split[1]
+		case flag == "--pcr-banks":
+			pcrBanks = strings.Split(split[1], ",")
+		default:
+			return errors.New("invalid cli argument: " + arg)
+		}
+	}
+	if taUrl == "" || name == "" {
+		return errors.New("--ta-url and --name are required")
+	}
+	if strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return errors.Errorf("invalid host profile name %q", name)
+	}
+	baseUrl, err := url.Parse(strings.TrimSuffix(taUrl, "/"))
+	if err != nil {
+		return errors.Wrapf(err, "invalid Trust Agent url %q", taUrl)
+	}
+
+	dir := filepath.Join(ac.hostProfilesPath, name)
+	if _, err = os.Stat(dir); err == nil && !force {
+		return errors.Errorf("host profile %s already exists - use --force to replace it", name)
+	}
+	// the Trust Agent is called with a token for the api user, its certificate is not verified like the
+	// certificates of HVS and AAS
+	taClient, err := client.NewTAClient(ac.AasApiUrl, baseUrl, ac.ApiUserName, ac.ApiUserPassword, nil)
+	if err != nil {
+		return errors.Wrap(err, "Could not create Trust Agent client")
+	}
+	if err = captureHostProfile(taClient, dir, pcrBanks); err != nil {
+		return err
+	}
+	fmt.Printf("Host profile %s saved to %s. Add it to HostProfiles in config.yml to use it:\n", name, dir)
+	fmt.Printf("HostProfiles :\n  - name : %s\n    weight : 1\n", name)
+	return nil
+}
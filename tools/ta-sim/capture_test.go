@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	client "github.com/intel-secl/intel-secl/v4/pkg/clients/ta"
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+// simulatedTaClient is a Trust Agent client that calls a simulated host directly
+type simulatedTaClient struct {
+	client.TAClient
+	ctrl    *controller
+	hostIdx int
+}
+
+func (tc simulatedTaClient) GetHostInfo() (tamodel.HostInfo, error) {
+	return tc.ctrl.getHostInfo(tc.hostIdx)
+}
+
+func (tc simulatedTaClient) GetTPMQuote(nonce string, pcrList []int, pcrBankList []string) (tamodel.TpmQuoteResponse, error) {
+	nonceBytes, err := base64.StdEncoding.DecodeString(nonce)
+	if err != nil {
+		return tamodel.TpmQuoteResponse{}, err
+	}
+	quote, err := tc.ctrl.getQuoteSignedWithNonce(tc.hostIdx, &tamodel.TpmQuoteRequest{Nonce: nonceBytes, Pcrs: pcrList, PcrBanks: pcrBankList})
+	if err != nil {
+		return tamodel.TpmQuoteResponse{}, err
+	}
+	return *quote, nil
+}
+
+func TestCaptureHostProfile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-capture")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctrl := newTestController(t, 1)
+	ctrl.hosts[0].profile.hostInfo = tamodel.HostInfo{BiosName: "bios", HostName: "host"}
+	ctrl.hosts[0].profile.eventLog = tbootEventLog()
+	if err = ctrl.hosts[0].resetPcrs(); err != nil {
+		t.Fatal("failed to reset pcrs:", err.Error())
+	}
+
+	profileDir := filepath.Join(dir, "captured")
+	if err = captureHostProfile(simulatedTaClient{ctrl: ctrl}, profileDir, []string{"SHA1", "SHA256"}); err != nil {
+		t.Fatal("failed to capture host profile:", err.Error())
+	}
+	// the captured profile only has the files that the simulator loads
+	files, err := ioutil.ReadDir(profileDir)
+	if err != nil {
+		t.Fatal("failed to read captured host profile:", err.Error())
+	}
+	for _, file := range files {
+		if file.Name() != hostProfileHostInfoFile && file.Name() != hostProfileQuoteFile {
+			t.Errorf("captured host profile has %s that the simulator does not load", file.Name())
+		}
+	}
+
+	// the simulator loads the captured profile and boots its hosts with the pcr values of the captured host
+	profile, err := loadHostProfile("captured", filepath.Join(profileDir, hostProfileHostInfoFile),
+		filepath.Join(profileDir, hostProfileQuoteFile), []string{"SHA256"}, "")
+	if err != nil {
+		t.Fatal("failed to load captured host profile:", err.Error())
+	}
+	if profile.hostInfo.BiosName != "bios-0" {
+		t.Errorf("captured host info was not loaded: %+v", profile.hostInfo)
+	}
+	captured := ctrl.hosts[0].snapshot()
+	for pcr, value := range captured.pcrBanks[tpmAlgSha256] {
+		if !bytes.Equal(profile.pcrBanks[tpmAlgSha256][pcr], value) {
+			t.Errorf("pcr %d of the captured profile does not match the host", pcr)
+		}
+	}
+	if profile.tpmQuote.EventLog != captured.eventLogJson {
+		t.Error("event log of the captured profile does not match the host")
+	}
+}
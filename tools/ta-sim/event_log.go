@@ -0,0 +1,272 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+	"github.com/pkg/errors"
+)
+
+// TCG event types used by the measurement profiles
+const (
+	evSeparator                  = 0x00000004
+	evNoAction                   = 0x00000003
+	evEventTag                   = 0x00000006
+	evSCrtmVersion               = 0x00000008
+	evPlatformConfigFlags        = 0x0000000a
+	evEfiVariableDriverConfig    = 0x80000001
+	evEfiBootServicesApplication = 0x80000003
+	evEfiBootServicesDriver      = 0x80000004
+	evEfiGptEvent                = 0x80000006
+	evEfiAction                  = 0x80000007
+	evEfiPlatformFirmwareBlob    = 0x80000008
+	evEfiHandoffTables           = 0x80000009
+	evEfiVariableAuthority       = 0x800000e0
+	evTxtHashStart               = 0x00000402
+	evTxtMleHash                 = 0x00000404
+	evTxtBiosAcRegData           = 0x0000040a
+	evTxtCpuScrtmStat            = 0x0000040b
+	evTxtLcpControlHash          = 0x0000040c
+	evTxtStmHash                 = 0x0000040e
+	evTxtOsSinitDataCapHash      = 0x0000040f
+	evTxtSinitPubkeyHash         = 0x00000410
+	evTxtLcpDetailsHash          = 0x00000412
+	evTxtLcpAuthoritiesHash      = 0x00000413
+	evTxtNvInfoHash              = 0x00000414
+	evTbootModule                = 0x00000501
+	startupLocality              = 3
+)
+
+// measurementEvent is one entry in the event log of a simulated host. The digest that is extended into a
+// pcr bank is the hash of data using the algorithm of that bank - so the same event log can be replayed
+// into every active bank
+type measurementEvent struct {
+	pcr      int
+	typeId   uint32
+	typeName string
+	tags     []string
+	data     []byte
+}
+
+func (ev measurementEvent) digest(hashAlg uint16) []byte {
+	if ev.typeId == evNoAction {
+		// EV_NO_ACTION events are not extended and carry an all zero digest
+		return make([]byte, pcrBankHash[hashAlg].Size())
+	}
+	h := pcrBankHash[hashAlg].New()
+	h.Write(ev.data)
+	return h.Sum(nil)
+}
+
+// isStartupLocality tells if the event records the locality that the TPM was started from
+func (ev measurementEvent) isStartupLocality() bool {
+	return ev.pcr == 0 && ev.typeId == evNoAction && len(ev.tags) > 0 && ev.tags[0] == hvs.StartupLocalityTag
+}
+
+func newEvent(pcr int, typeId uint32, typeName, tag string, data string) measurementEvent {
+	return measurementEvent{pcr: pcr, typeId: typeId, typeName: typeName, tags: []string{tag}, data: []byte(data)}
+}
+
+func separatorEvents(pcrs ...int) []measurementEvent {
+	events := make([]measurementEvent, 0, len(pcrs))
+	for _, pcr := range pcrs {
+		events = append(events, measurementEvent{pcr: pcr, typeId: evSeparator, typeName: "EV_SEPARATOR",
+			tags: []string{"EV_SEPARATOR"}, data: []byte{0, 0, 0, 0}})
+	}
+	return events
+}
+
+// tbootEventLog is the event log of a host that performs a measured launch of the OS with tboot and Intel TXT.
+// The events match the ones that the Trust Agent reports from the TXT heap and the tboot log
+func tbootEventLog() []measurementEvent {
+	return []measurementEvent{
+		newEvent(17, evTxtHashStart, "HASH_START", "HASH_START", "sinit-acm-1.0"),
+		newEvent(17, evTxtBiosAcRegData, "BIOSAC_REG_DATA", "BIOSAC_REG_DATA", "biosac-reg-data"),
+		newEvent(17, evTxtCpuScrtmStat, "CPU_SCRTM_STAT", "CPU_SCRTM_STAT", "cpu-scrtm-stat"),
+		newEvent(17, evTxtLcpControlHash, "LCP_CONTROL_HASH", "LCP_CONTROL_HASH", "lcp-control"),
+		newEvent(17, evTxtLcpDetailsHash, "LCP_DETAILS_HASH", "LCP_DETAILS_HASH", "lcp-details"),
+		newEvent(17, evTxtStmHash, "STM_HASH", "STM_HASH", "stm"),
+		newEvent(17, evTxtOsSinitDataCapHash, "OSSINITDATA_CAP_HASH", "OSSINITDATA_CAP_HASH", "ossinitdata-cap"),
+		newEvent(17, evTxtMleHash, "MLE_HASH", "MLE_HASH", "tboot-1.10.1"),
+		newEvent(17, evTxtNvInfoHash, "NV_INFO_HASH", "NV_INFO_HASH", "nv-info"),
+		newEvent(17, evTbootModule, "tb_policy", "tb_policy", "tb_policy"),
+		newEvent(17, evTbootModule, "vmlinuz", "vmlinuz", "vmlinuz-4.18.0"),
+		newEvent(17, evTbootModule, "initrd", "initrd", "initramfs-4.18.0"),
+		newEvent(18, evTxtSinitPubkeyHash, "SINIT_PUBKEY_HASH", "SINIT_PUBKEY_HASH", "sinit-pubkey"),
+		newEvent(18, evTxtCpuScrtmStat, "CPU_SCRTM_STAT", "CPU_SCRTM_STAT", "cpu-scrtm-stat"),
+		newEvent(18, evTxtOsSinitDataCapHash, "OSSINITDATA_CAP_HASH", "OSSINITDATA_CAP_HASH", "ossinitdata-cap"),
+		newEvent(18, evTxtLcpControlHash, "LCP_CONTROL_HASH", "LCP_CONTROL_HASH", "lcp-control"),
+		newEvent(18, evTxtLcpAuthoritiesHash, "LCP_AUTHORITIES_HASH", "LCP_AUTHORITIES_HASH", "lcp-authorities"),
+		newEvent(18, evTxtNvInfoHash, "NV_INFO_HASH", "NV_INFO_HASH", "nv-info"),
+		newEvent(18, evTbootModule, "tb_policy", "tb_policy", "tb_policy"),
+	}
+}
+
+// uefiSecureBootEventLog is the event log of a host that boots through UEFI with secure boot enabled.
+// The firmware starts the TPM from locality 3, measures itself into pcrs 0 to 7 and the boot loader
+// and kernel into pcr 4
+func uefiSecureBootEventLog() []measurementEvent {
+	events := []measurementEvent{
+		{pcr: 0, typeId: evNoAction, typeName: "EV_NO_ACTION", tags: []string{hvs.StartupLocalityTag}},
+		newEvent(0, evSCrtmVersion, "EV_S_CRTM_VERSION", "EV_S_CRTM_VERSION", "SE5C620.86B.02.01.0012"),
+		newEvent(0, evEfiPlatformFirmwareBlob, "EV_EFI_PLATFORM_FIRMWARE_BLOB", "EV_EFI_PLATFORM_FIRMWARE_BLOB", "bios-firmware-volume"),
+		newEvent(1, evPlatformConfigFlags, "EV_PLATFORM_CONFIG_FLAGS", "EV_PLATFORM_CONFIG_FLAGS", "platform-config-flags"),
+		newEvent(1, evEfiHandoffTables, "EV_EFI_HANDOFF_TABLES", "EV_EFI_HANDOFF_TABLES", "smbios-tables"),
+		newEvent(2, evEfiBootServicesDriver, "EV_EFI_BOOT_SERVICES_DRIVER", "EV_EFI_BOOT_SERVICES_DRIVER", "option-rom"),
+		newEvent(7, evEfiVariableDriverConfig, "EV_EFI_VARIABLE_DRIVER_CONFIG", "SecureBoot", "SecureBoot=1"),
+		newEvent(7, evEfiVariableDriverConfig, "EV_EFI_VARIABLE_DRIVER_CONFIG", "PK", "PK"),
+		newEvent(7, evEfiVariableDriverConfig, "EV_EFI_VARIABLE_DRIVER_CONFIG", "KEK", "KEK"),
+		newEvent(7, evEfiVariableDriverConfig, "EV_EFI_VARIABLE_DRIVER_CONFIG", "db", "db"),
+		newEvent(7, evEfiVariableDriverConfig, "EV_EFI_VARIABLE_DRIVER_CONFIG", "dbx", "dbx"),
+	}
+	events = append(events, separatorEvents(0, 1, 2, 3, 4, 5, 6, 7)...)
+	return append(events,
+		newEvent(5, evEfiGptEvent, "EV_EFI_GPT_EVENT", "EV_EFI_GPT_EVENT", "gpt-partition-table"),
+		newEvent(4, evEfiAction, "EV_EFI_ACTION", "EV_EFI_ACTION", "Calling EFI Application from Boot Option"),
+		newEvent(7, evEfiVariableAuthority, "EV_EFI_VARIABLE_AUTHORITY", "db", "db-certificate"),
+		newEvent(4, evEfiBootServicesApplication, "EV_EFI_BOOT_SERVICES_APPLICATION", "shimx64.efi", "shimx64.efi-15"),
+		newEvent(4, evEfiBootServicesApplication, "EV_EFI_BOOT_SERVICES_APPLICATION", "grubx64.efi", "grubx64.efi-2.02"),
+		newEvent(4, evEfiBootServicesApplication, "EV_EFI_BOOT_SERVICES_APPLICATION", "vmlinuz", "vmlinuz-4.18.0"),
+	)
+}
+
+// measurementProfiles are the event logs that can be selected with MeasurementProfile in the configuration
+var measurementProfiles = map[string]func() []measurementEvent{
+	"tboot":           tbootEventLog,
+	"uefi-secureboot": uefiSecureBootEventLog,
+}
+
+// replayEventLog computes the values of the pcrs in the banks that use hashAlgs by extending the events of
+// the log into freshly reset banks. Pcrs 17 to 22 that have events are reset to zero by the dynamic launch
+// and a startup locality event sets the initial value of pcr 0 to the locality the TPM was started from
+func replayEventLog(events []measurementEvent, hashAlgs []uint16) (pcrBanks, error) {
+	banks := newPcrBanks(hashAlgs...)
+	reset := make(map[int]bool)
+	for _, ev := range events {
+		if ev.pcr < 0 || ev.pcr >= pcrCount {
+			return nil, errors.Errorf("invalid pcr index %d in event %s", ev.pcr, ev.typeName)
+		}
+		if reset[ev.pcr] {
+			continue
+		}
+		reset[ev.pcr] = true
+		for _, bank := range banks {
+			bank[ev.pcr] = make([]byte, len(bank[ev.pcr]))
+			if ev.isStartupLocality() {
+				bank[ev.pcr][len(bank[ev.pcr])-1] = startupLocality
+			}
+		}
+	}
+	for _, ev := range events {
+		if ev.typeId == evNoAction {
+			continue
+		}
+		for hashAlg := range banks {
+			if err := banks.extend(hashAlg, ev.pcr, ev.digest(hashAlg)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return banks, nil
+}
+
+// appendEventLog adds the events to a json event log in the format of the Trust Agent, so that the log still
+// replays to the pcr values after the events are extended. The events are added to each of the banks
+func appendEventLog(eventLogJson string, events []measurementEvent, hashAlgs []uint16) (string, error) {
+	var eventLogs []hvs.TpmEventLog
+	if eventLogJson != "" {
+		if err := json.Unmarshal([]byte(eventLogJson), &eventLogs); err != nil {
+			return "", errors.Wrap(err, "could not decode event log")
+		}
+	}
+	for _, ev := range events {
+		for _, hashAlg := range hashAlgs {
+			event := hvs.EventLog{
+				TypeID:      fmt.Sprintf("0x%x", ev.typeId),
+				TypeName:    ev.typeName,
+				Tags:        ev.tags,
+				Measurement: hex.EncodeToString(ev.digest(hashAlg)),
+			}
+			found := false
+			for i := range eventLogs {
+				if eventLogs[i].Pcr.Index == ev.pcr && eventLogs[i].Pcr.Bank == pcrBankName(hashAlg) {
+					eventLogs[i].TpmEvent = append(eventLogs[i].TpmEvent, event)
+					found = true
+					break
+				}
+			}
+			if !found {
+				eventLogs = append(eventLogs, hvs.TpmEventLog{Pcr: hvs.Pcr{Index: ev.pcr, Bank: pcrBankName(hashAlg)},
+					TpmEvent: []hvs.EventLog{event}})
+			}
+		}
+	}
+	data, err := json.Marshal(eventLogs)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal event log")
+	}
+	return string(data), nil
+}
+
+// marshalEventLog creates the event log of the quote response in the same json format as the Trust Agent,
+// with one entry for each pcr in each of the banks that use hashAlgs
+func marshalEventLog(events []measurementEvent, hashAlgs []uint16) (string, error) {
+	pcrs := make([]int, 0)
+	for _, ev := range events {
+		if !containsPcr(pcrs, ev.pcr) {
+			pcrs = append(pcrs, ev.pcr)
+		}
+	}
+	sort.Ints(pcrs)
+
+	eventLogs := make([]hvs.TpmEventLog, 0, len(pcrs)*len(hashAlgs))
+	for _, hashAlg := range hashAlgs {
+		for _, pcr := range pcrs {
+			eventLog := hvs.TpmEventLog{Pcr: hvs.Pcr{Index: pcr, Bank: pcrBankName(hashAlg)}}
+			for _, ev := range events {
+				if ev.pcr != pcr {
+					continue
+				}
+				eventLog.TpmEvent = append(eventLog.TpmEvent, hvs.EventLog{
+					TypeID:      fmt.Sprintf("0x%x", ev.typeId),
+					TypeName:    ev.typeName,
+					Tags:        ev.tags,
+					Measurement: hex.EncodeToString(ev.digest(hashAlg)),
+				})
+			}
+			eventLogs = append(eventLogs, eventLog)
+		}
+	}
+	eventLogJson, err := json.Marshal(eventLogs)
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal event log")
+	}
+	return string(eventLogJson), nil
+}
+
+// pcrBankName returns the name of the pcr bank that uses hashAlg as it is used in quote requests and event logs
+func pcrBankName(hashAlg uint16) string {
+	for name, alg := range pcrBankNames {
+		if alg == hashAlg {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04x", hashAlg)
+}
+
+// hashAlgs returns the TPM_ALG_ID of the banks in ascending order
+func (banks pcrBanks) hashAlgs() []uint16 {
+	hashAlgs := make([]uint16, 0, len(banks))
+	for hashAlg := range banks {
+		hashAlgs = append(hashAlgs, hashAlg)
+	}
+	sort.Slice(hashAlgs, func(i, j int) bool { return hashAlgs[i] < hashAlgs[j] })
+	return hashAlgs
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+)
+
+func TestEventLogReplaysToPcrValues(t *testing.T) {
+
+	hashAlgs := []uint16{tpmAlgSha1, tpmAlgSha256, tpmAlgSha384}
+	for name, profile := range measurementProfiles {
+		events := append(profile(), driftEvents([]int{0, 17}, "00000000-0000-0000-0000-000000000000")...)
+		banks, err := replayEventLog(events, hashAlgs)
+		if err != nil {
+			t.Fatalf("failed to replay event log of profile %s: %s", name, err.Error())
+		}
+		eventLogJson, err := marshalEventLog(events, hashAlgs)
+		if err != nil {
+			t.Fatalf("failed to marshal event log of profile %s: %s", name, err.Error())
+		}
+
+		// the event log should be parsed and replayed by the verifier to the pcr values in the quote
+		var eventLogs []hvs.TpmEventLog
+		if err = json.Unmarshal([]byte(eventLogJson), &eventLogs); err != nil {
+			t.Fatalf("failed to unmarshal event log of profile %s: %s", name, err.Error())
+		}
+		if len(eventLogs) == 0 {
+			t.Errorf("event log of profile %s is empty", name)
+		}
+		for _, eventLog := range eventLogs {
+			replayed, err := eventLog.Replay()
+			if err != nil {
+				t.Fatalf("failed to replay event log of pcr %d: %s", eventLog.Pcr.Index, err.Error())
+			}
+			pcrValue := hex.EncodeToString(banks[pcrBankNames[eventLog.Pcr.Bank]][eventLog.Pcr.Index])
+			if replayed != pcrValue {
+				t.Errorf("profile %s: replayed event log of pcr %d in bank %s is %s, pcr value is %s", name,
+					eventLog.Pcr.Index, eventLog.Pcr.Bank, replayed, pcrValue)
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// a fault profile file is a yaml file that makes groups of simulated hosts misbehave, so that the handling of
+// slow and failing hosts in HVS can be tested. The hosts of a profile are selected like the hosts of a scenario
+// event and a host gets the first profile that selects it
+//
+//	seed: 1
+//	profiles:
+//	  - hosts: 10%
+//	    requests: [quote]        # requests the profile applies to - default is all requests
+//	    latency:
+//	      distribution: long-tail
+//	      mean: 200ms
+//	      stddev: 400ms
+//	    error_rate: 2            # percentage of requests that fail with 500
+//	    malformed_rate: 1        # percentage of requests that get a truncated response body
+//	    reset_rate: 1            # percentage of requests whose connection is closed without a response
+//	    stall_rate: 0.5          # percentage of requests that get no response until stall has passed
+//	    stall: 5m
+//	    bad_signature_rate: 1    # percentage of quotes with a signature that does not verify
+
+// latency distributions
+const (
+	latencyFixed    = "fixed"
+	latencyNormal   = "normal"
+	latencyLongTail = "long-tail"
+)
+
+// how long a stalled request is held when the profile does not set it - longer than the timeouts of HVS
+const defaultFaultStall = 5 * time.Minute
+
+// faultAction is what happens to a request instead of the regular response
+type faultAction int
+
+const (
+	faultNone faultAction = iota
+	faultError
+	faultMalformed
+	faultReset
+	faultStall
+)
+
+type latencyDistribution struct {
+	Distribution string        `mapstructure:"distribution"`
+	Mean         time.Duration `mapstructure:"mean"`
+	StdDev       time.Duration `mapstructure:"stddev"`
+}
+
+// sample returns a latency from the distribution. Long tail latencies are log-normal with the mean and standard
+// deviation of the distribution
+func (l latencyDistribution) sample(rnd func() float64) time.Duration {
+	var latency float64
+	mean, stdDev := float64(l.Mean), float64(l.StdDev)
+	switch l.Distribution {
+	case latencyNormal:
+		latency = mean + stdDev*normal(rnd)
+	case latencyLongTail:
+		if mean <= 0 {
+			return 0
+		}
+		sigma2 := math.Log(1 + stdDev*stdDev/(mean*mean))
+		latency = math.Exp(math.Log(mean) - sigma2/2 + math.Sqrt(sigma2)*normal(rnd))
+	default:
+		latency = mean
+	}
+	if latency < 0 {
+		return 0
+	}
+	return time.Duration(latency)
+}
+
+// normal returns a standard normal value from uniform values with the Box-Muller transform
+func normal(rnd func() float64) float64 {
+	return math.Sqrt(-2*math.Log(1-rnd())) * math.Cos(2*math.Pi*rnd())
+}
+
+type faultProfile struct {
+	Hosts            string              `mapstructure:"hosts"`
+	Requests         []string            `mapstructure:"requests"`
+	Latency          latencyDistribution `mapstructure:"latency"`
+	ErrorRate        float64             `mapstructure:"error_rate"`
+	MalformedRate    float64             `mapstructure:"malformed_rate"`
+	ResetRate        float64             `mapstructure:"reset_rate"`
+	StallRate        float64             `mapstructure:"stall_rate"`
+	Stall            time.Duration       `mapstructure:"stall"`
+	BadSignatureRate float64             `mapstructure:"bad_signature_rate"`
+}
+
+type faultProfiles struct {
+	Seed     int64          `mapstructure:"seed"`
+	Profiles []faultProfile `mapstructure:"profiles"`
+}
+
+// appliesTo returns true when the profile makes the request misbehave
+func (fp *faultProfile) appliesTo(request string) bool {
+	if fp == nil {
+		return false
+	}
+	if len(fp.Requests) == 0 {
+		return true
+	}
+	for _, r := range fp.Requests {
+		if r == request {
+			return true
+		}
+	}
+	return false
+}
+
+// draw picks the latency and the fault of a request from the profile
+func (fp *faultProfile) draw(request string, rnd func() float64) (time.Duration, faultAction) {
+	if !fp.appliesTo(request) {
+		return 0, faultNone
+	}
+	latency := fp.Latency.sample(rnd)
+	r := rnd() * 100
+	for _, fault := range []struct {
+		rate   float64
+		action faultAction
+	}{
+		{fp.ResetRate, faultReset},
+		{fp.StallRate, faultStall},
+		{fp.ErrorRate, faultError},
+		{fp.MalformedRate, faultMalformed},
+	} {
+		if r < fault.rate {
+			return latency, fault.action
+		}
+		r -= fault.rate
+	}
+	return latency, faultNone
+}
+
+// badSignature returns true when a quote should be signed with a signature that does not verify
+func (fp *faultProfile) badSignature(rnd func() float64) bool {
+	return fp.appliesTo(metricsRequestQuote) && rnd()*100 < fp.BadSignatureRate
+}
+
+// loadFaultProfiles reads the fault profiles from path and returns the profile of each host - nil for hosts
+// that behave
+func loadFaultProfiles(path string, ac *AppConfig) ([]*faultProfile, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "could not read fault profile file %s", path)
+	}
+	fps := &faultProfiles{Seed: 1}
+	if err := v.Unmarshal(fps); err != nil {
+		return nil, errors.Wrapf(err, "could not decode fault profile file %s", path)
+	}
+
+	hostFaults := make([]*faultProfile, ac.Servers)
+	rnd := rand.New(rand.NewSource(fps.Seed))
+	for i := range fps.Profiles {
+		fp := &fps.Profiles[i]
+		switch fp.Latency.Distribution {
+		case "":
+			fp.Latency.Distribution = latencyFixed
+		case latencyFixed, latencyNormal, latencyLongTail:
+		default:
+			return nil, errors.Errorf("fault profile %d: invalid latency distribution %q", i, fp.Latency.Distribution)
+		}
+		if fp.Latency.Mean < 0 || fp.Latency.StdDev < 0 {
+			return nil, errors.Errorf("fault profile %d: latency cannot be negative", i)
+		}
+		for _, rate := range []float64{fp.ErrorRate, fp.MalformedRate, fp.ResetRate, fp.StallRate, fp.BadSignatureRate} {
+			if rate < 0 || rate > 100 {
+				return nil, errors.Errorf("fault profile %d: rates need to be percentages between 0 and 100", i)
+			}
+		}
+		if fp.ErrorRate+fp.MalformedRate+fp.ResetRate+fp.StallRate > 100 {
+			return nil, errors.Errorf("fault profile %d: error, malformed, reset and stall rates add up to more than 100", i)
+		}
+		if fp.Stall == 0 {
+			fp.Stall = defaultFaultStall
+		}
+
+		hostIdxs, err := selectHosts(fp.Hosts, ac.PortStart, ac.Servers, rnd)
+		if err != nil {
+			return nil, errors.Wrapf(err, "fault profile %d", i)
+		}
+		selected := 0
+		for _, idx := range hostIdxs {
+			if hostFaults[idx] == nil {
+				hostFaults[idx] = fp
+				selected++
+			}
+		}
+		log.Infof("Fault profile %d applies to %d hosts", i, selected)
+	}
+	return hostFaults, nil
+}
+
+// hostFaultProfile returns the fault profile of the host - nil when the host behaves
+func (ctrl controller) hostFaultProfile(hostIdx int) *faultProfile {
+	if hostIdx < 0 || hostIdx >= len(ctrl.faults) {
+		return nil
+	}
+	return ctrl.faults[hostIdx]
+}
+
+// bufferedResponse keeps the response of a handler so that a malformed version of it can be sent
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bufferedResponse) Header() http.Header         { return br.header }
+func (br *bufferedResponse) Write(b []byte) (int, error) { return br.body.Write(b) }
+func (br *bufferedResponse) WriteHeader(status int)      { br.status = status }
+
+// faulty wraps the handler of a Trust Agent endpoint so that requests to the host misbehave as set by its
+// fault profile
+func (ctrl controller) faulty(request string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fp := ctrl.hostFaultProfile(ctrl.hostIndex(r))
+		if fp == nil {
+			handler(w, r)
+			return
+		}
+		latency, action := fp.draw(request, rand.Float64)
+		time.Sleep(latency)
+
+		switch action {
+		case faultError:
+			http.Error(w, "simulated internal error", http.StatusInternalServerError)
+		case faultMalformed:
+			br := &bufferedResponse{header: w.Header(), status: http.StatusOK}
+			handler(br, r)
+			w.WriteHeader(br.status)
+			_, _ = w.Write(malformed(br.body.Bytes()))
+		case faultReset, faultStall:
+			if action == faultStall {
+				time.Sleep(fp.Stall)
+			}
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			handler(w, r)
+		}
+	}
+}
+
+// malformed returns a truncated copy of the response body that cannot be decoded
+func malformed(body []byte) []byte {
+	if len(body) == 0 {
+		return []byte("<")
+	}
+	return append([]byte{}, body[:len(body)/2]...)
+}
+
+// corruptSignature flips a bit of the signature of the quote of the host when its fault profile draws a bad
+// signature. The signature follows the TPMS_ATTEST and the signature algorithm, hash algorithm and size of the
+// TPMT_SIGNATURE - for ECDSA the flipped bit is in r
+func (ctrl controller) corruptSignature(hostIdx int, quote []byte) {
+	if len(quote) < 2 || !ctrl.hostFaultProfile(hostIdx).badSignature(rand.Float64) {
+		return
+	}
+	signatureStart := 2 + int(binary.BigEndian.Uint16(quote)) + 6
+	if signatureStart >= len(quote) {
+		log.Warnf("Could not corrupt the signature of the quote of host %s - the quote has no signature", ctrl.hwUuidMap[hostIdx])
+		return
+	}
+	quote[signatureStart] ^= 1
+	log.Debugf("Corrupted the signature of the quote of host %s", ctrl.hwUuidMap[hostIdx])
+}
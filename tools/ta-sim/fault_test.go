@@ -0,0 +1,119 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+const testFaultProfiles = `
+profiles:
+  - hosts: 10000,10001
+    requests: [host-info]
+    latency:
+      distribution: normal
+      mean: 1ms
+    error_rate: 100
+  - hosts: 10001-10002
+    malformed_rate: 100
+    bad_signature_rate: 100
+`
+
+func TestFaultProfiles(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-faults")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	faultsPath := filepath.Join(dir, "faults.yml")
+	if err = ioutil.WriteFile(faultsPath, []byte(testFaultProfiles), 0644); err != nil {
+		t.Fatal("failed to write fault profiles:", err.Error())
+	}
+
+	ctrl := newTestController(t, 4)
+	if ctrl.faults, err = loadFaultProfiles(faultsPath, ctrl.config); err != nil {
+		t.Fatal("failed to load fault profiles:", err.Error())
+	}
+	// a host gets the first profile that selects it
+	if ctrl.faults[1] != ctrl.faults[0] || ctrl.faults[2] == ctrl.faults[1] || ctrl.faults[3] != nil {
+		t.Fatal("fault profiles were not assigned to the selected hosts")
+	}
+	if ctrl.faults[2].Stall != defaultFaultStall {
+		t.Error("fault profile does not default to the default stall")
+	}
+
+	info := ctrl.faulty(metricsRequestHostInfo, ctrl.info)
+	request := func(handler http.HandlerFunc, port int) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", fmt.Sprintf("https://localhost:%d/", port), nil))
+		return rec
+	}
+	if rec := request(info, 10000); rec.Code != http.StatusInternalServerError {
+		t.Errorf("host with an error rate of 100 returned %d", rec.Code)
+	}
+	if rec := request(ctrl.faulty(metricsRequestAik, ctrl.aikCert), 10000); rec.Code != http.StatusOK {
+		t.Errorf("request that the fault profile does not apply to returned %d", rec.Code)
+	}
+	well := request(info, 10003)
+	if rec := request(info, 10002); rec.Code != http.StatusOK || rec.Body.Len() == 0 || rec.Body.Len() >= well.Body.Len() {
+		t.Error("host with a malformed rate of 100 did not return a truncated response")
+	}
+
+	// the quotes of a host with a bad signature rate of 100 fail on the signature and nothing else
+	nonce := []byte("01234567890123456789")
+	for hostIdx, corrupted := range map[int]bool{0: false, 2: true} {
+		resp, err := ctrl.getQuoteSignedWithNonce(hostIdx, &tamodel.TpmQuoteRequest{Nonce: nonce, Pcrs: []int{0, 7}})
+		if err != nil {
+			t.Fatal("failed to get quote:", err.Error())
+		}
+		_, err = verifyQuoteResponse(resp, ctrl.hosts[hostIdx].aik.cert, nonce)
+		if !corrupted && err != nil {
+			t.Errorf("quote of host %d does not verify: %s", hostIdx, err.Error())
+		} else if corrupted && (err == nil || !strings.Contains(err.Error(), "signature of the quote does not verify")) {
+			t.Errorf("quote of host %d did not fail on the signature: %v", hostIdx, err)
+		}
+	}
+}
+
+func TestLatencyDistributions(t *testing.T) {
+
+	const samples = 20000
+	rnd := rand.New(rand.NewSource(1)).Float64
+	for _, l := range []latencyDistribution{
+		{Distribution: latencyFixed, Mean: 100 * time.Millisecond},
+		{Distribution: latencyNormal, Mean: 100 * time.Millisecond, StdDev: 10 * time.Millisecond},
+		{Distribution: latencyLongTail, Mean: 100 * time.Millisecond, StdDev: 200 * time.Millisecond},
+	} {
+		var sum time.Duration
+		var max time.Duration
+		for i := 0; i < samples; i++ {
+			latency := l.sample(rnd)
+			sum += latency
+			if latency > max {
+				max = latency
+			}
+		}
+		mean := sum / samples
+		if math.Abs(float64(mean-l.Mean)) > float64(l.Mean)/10 {
+			t.Errorf("mean of %s latencies is %s instead of %s", l.Distribution, mean, l.Mean)
+		}
+		if l.Distribution == latencyLongTail && max < 10*l.Mean {
+			t.Errorf("long tail latencies do not have a long tail - max is %s", max)
+		}
+	}
+}
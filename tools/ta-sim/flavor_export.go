@@ -0,0 +1,248 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/lib/common/crypt"
+	"github.com/intel-secl/intel-secl/v4/pkg/lib/flavor"
+	flavorUtil "github.com/intel-secl/intel-secl/v4/pkg/lib/flavor/util"
+	hcUtil "github.com/intel-secl/intel-secl/v4/pkg/lib/host-connector/util"
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// generate-flavors creates the flavors that create-all-flavors asks HVS to create, without HVS and without the
+// simulator running. The host manifest of every simulated host is built from its host info and a quote like the
+// host connector of HVS builds it, the flavors are created from the manifest with the flavor library of HVS and
+// signed with the flavor signing key. The flavors of all the hosts are written as a single flavor create request
+// that can be posted to the flavors endpoint of HVS. HVS imports the unsigned flavor collection and signs the flavors
+// with its own key - the signed flavor collection is only for verifying the flavors offline
+
+// simulatedHostManifest returns the host manifest that HVS gets from the simulated host
+func (ctrl controller) simulatedHostManifest(hostIdx int) (*hvs.HostManifest, error) {
+	hostInfo, err := ctrl.getHostInfo(hostIdx)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := captureNonce()
+	if err != nil {
+		return nil, err
+	}
+	nonceBytes, _ := base64.StdEncoding.DecodeString(nonce)
+	quote, err := ctrl.getQuoteSignedWithNonce(hostIdx, &tamodel.TpmQuoteRequest{Nonce: nonceBytes, Pcrs: capturePcrList})
+	if err != nil {
+		return nil, err
+	}
+
+	// the quote is verified like HVS verifies it, which also gives the pcr manifest with the event logs
+	verificationNonce, err := hcUtil.GetVerificationNonce(nonceBytes, *quote)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get the verification nonce")
+	}
+	verificationNonceBytes, _ := base64.StdEncoding.DecodeString(verificationNonce)
+	quoteBytes, err := base64.StdEncoding.DecodeString(quote.Quote)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode the quote")
+	}
+	aik := ctrl.hosts[hostIdx].aik.cert
+	pcrManifest, _, err := hcUtil.VerifyQuoteAndGetPCRManifest(quote.EventLog, verificationNonceBytes, quoteBytes, aik)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not verify the quote of the host")
+	}
+
+	manifest := &hvs.HostManifest{
+		AIKCertificate:  base64.StdEncoding.EncodeToString(aik.Raw),
+		AssetTagDigest:  quote.AssetTag,
+		HostInfo:        hostInfo,
+		PcrManifest:     pcrManifest,
+		MeasurementXmls: quote.TcbMeasurements.TcbMeasurements,
+	}
+	bindingKeyCert, err := ctrl.hostKeyCert(hostIdx, hostKeyUsageBinding)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(bindingKeyCert); block != nil {
+		manifest.BindingKeyCertificate = base64.StdEncoding.EncodeToString(block.Bytes)
+	}
+	return manifest, nil
+}
+
+// generateHostFlavors creates the flavor parts of the simulated host from the flavor templates and signs them
+func (ctrl controller) generateHostFlavors(hostIdx int, flavorParts []hvs.FlavorPartName, templates []hvs.FlavorTemplate,
+	signingKey *rsa.PrivateKey) (*hvs.FlavorCreateRequest, error) {
+	manifest, err := ctrl.simulatedHostManifest(hostIdx)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := flavor.NewPlatformFlavorProvider(manifest, nil, templates)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the platform flavor provider")
+	}
+	platformFlavor, err := provider.GetPlatformFlavor()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create the platform flavor")
+	}
+
+	req := &hvs.FlavorCreateRequest{}
+	for _, part := range flavorParts {
+		flavors, err := (*platformFlavor).GetFlavorPartRaw(part)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not create the %s flavor", part)
+		}
+		signedFlavors, err := (flavorUtil.PlatformFlavorUtil{}).GetSignedFlavorList(flavors, signingKey)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not sign the %s flavor", part)
+		}
+		for _, f := range flavors {
+			req.FlavorCollection.Flavors = append(req.FlavorCollection.Flavors, hvs.Flavors{Flavor: f})
+		}
+		req.SignedFlavorCollection.SignedFlavors = append(req.SignedFlavorCollection.SignedFlavors, signedFlavors...)
+	}
+	return req, nil
+}
+
+// loadFlavorTemplates loads the flavor templates from the json files in dir
+func loadFlavorTemplates(dir string) ([]hvs.FlavorTemplate, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not list the flavor templates in %s", dir)
+	}
+	templates := make([]hvs.FlavorTemplate, 0, len(files))
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read flavor template %s", file)
+		}
+		var template hvs.FlavorTemplate
+		if err = json.Unmarshal(data, &template); err != nil {
+			return nil, errors.Wrapf(err, "could not decode flavor template %s", file)
+		}
+		if template.FlavorParts == nil {
+			return nil, errors.Errorf("flavor template %s has no flavor parts", file)
+		}
+		templates = append(templates, template)
+	}
+	if len(templates) == 0 {
+		return nil, errors.Errorf("no flavor templates found in %s", dir)
+	}
+	return templates, nil
+}
+
+// loadFlavorSigningKey loads the PKCS8 encoded rsa key that signs the flavors
+func loadFlavorSigningKey(path string) (*rsa.PrivateKey, error) {
+	key, err := crypt.GetPrivateKeyFromPKCS8File(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not load the flavor signing key %s", path)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("flavor signing key is not of type RSA")
+	}
+	return rsaKey, nil
+}
+
+// generateFlavors writes the flavors of the trusted hosts to a single flavor create request in path. Like
+// create-all-flavors, the first DistinctFlavors hosts get all the flavors and the other trusted hosts only their
+// HOST_UNIQUE flavor. Hosts with an ecc aik are skipped - HVS does not verify their quotes, so their flavors
+// would never match
+func generateFlavors(ctrl *controller, path string, templates []hvs.FlavorTemplate, signingKey *rsa.PrivateKey) (int, error) {
+	allFlavors := []hvs.FlavorPartName{hvs.FlavorPartPlatform, hvs.FlavorPartOs, hvs.FlavorPartHostUnique}
+	hostUniqueFlavors := []hvs.FlavorPartName{hvs.FlavorPartHostUnique}
+	trustedHosts := ctrl.config.Servers * ctrl.config.TrustedHostsPercentage / 100
+
+	bundle := &hvs.FlavorCreateRequest{}
+	hosts := 0
+	for idx := 0; idx < trustedHosts; idx++ {
+		if _, ok := ctrl.hosts[idx].aik.cert.PublicKey.(*rsa.PublicKey); !ok {
+			log.Warnf("Skipping the flavors of host %d - HVS does not verify the quotes of its ecc aik", ctrl.config.PortStart+idx)
+			continue
+		}
+		flavorParts := hostUniqueFlavors
+		if idx < ctrl.config.DistinctFlavors {
+			flavorParts = allFlavors
+		}
+		req, err := ctrl.generateHostFlavors(idx, flavorParts, templates, signingKey)
+		if err != nil {
+			return 0, errors.Wrapf(err, "could not generate the flavors of host %d", ctrl.config.PortStart+idx)
+		}
+		bundle.FlavorCollection.Flavors = append(bundle.FlavorCollection.Flavors, req.FlavorCollection.Flavors...)
+		bundle.SignedFlavorCollection.SignedFlavors = append(bundle.SignedFlavorCollection.SignedFlavors,
+			req.SignedFlavorCollection.SignedFlavors...)
+		hosts++
+	}
+
+	data, err := json.Marshal(bundle)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not encode the flavors")
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, errors.Wrapf(err, "could not create the directory of %s", path)
+	}
+	if err = ioutil.WriteFile(path, data, 0644); err != nil {
+		return 0, errors.Wrapf(err, "could not write %s", path)
+	}
+	flavors := len(bundle.SignedFlavorCollection.SignedFlavors)
+	log.Infof("Generated %d flavors of %d hosts in %s", flavors, hosts, path)
+	return flavors, nil
+}
+
+// generateFlavorsMain generates the signed flavors of the simulated hosts
+//
+//	ta-sim generate-flavors --flavor-templates=<dir> --signing-key=<pkcs8_key> [--output=flavors.json]
+func generateFlavorsMain(ac *AppConfig) error {
+	var templatesDir, signingKeyPath string
+	output := "flavors.json"
+	for _, arg := range os.Args[2:] {
+		split := strings.SplitN(arg, "=", 2)
+		switch flag := split[0]; {
+		case len(split) < 2:
+			return errors.New("invalid cli argument: " + arg)
+		case flag == "--flavor-templates":
+			templatesDir = split[1]
+		case flag == "--signing-key":
+			signingKeyPath = split[1]
+		case flag == "--output":
+			output = split[1]
+		default:
+			return errors.New("invalid cli argument: " + arg)
+		}
+	}
+	if templatesDir == "" || signingKeyPath == "" {
+		return errors.New("--flavor-templates and --signing-key are required")
+	}
+	templates, err := loadFlavorTemplates(templatesDir)
+	if err != nil {
+		return err
+	}
+	signingKey, err := loadFlavorSigningKey(signingKeyPath)
+	if err != nil {
+		return err
+	}
+
+	// the quotes are created in process, there is no TPM response time to simulate
+	ac.QuoteDelayMs = 0
+	ctrl, err := NewController(ac)
+	if err != nil {
+		return err
+	}
+	flavors, err := generateFlavors(ctrl, output, templates, signingKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d flavors written to %s\n", flavors, output)
+	return nil
+}
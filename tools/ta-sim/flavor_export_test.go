@@ -0,0 +1,124 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/lib/common/crypt"
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+// testTbootFlavorTemplate has the pcr rules of the default tboot flavor template of HVS
+const testTbootFlavorTemplate = `{
+    "label": "default-linux-rhel-tpm20-tboot",
+    "condition": [],
+    "flavor_parts": {
+        "PLATFORM": {
+            "meta": {"tpm_version": "2.0", "tboot_installed": true},
+            "pcr_rules": [
+                {"pcr": {"index": 0, "bank": ["SHA256"]}, "pcr_matches": true},
+                {"pcr": {"index": 17, "bank": ["SHA256"]}, "eventlog_equals": {"excluding_tags": ["LCP_CONTROL_HASH", "initrd", "vmlinuz"]}}
+            ]
+        },
+        "OS": {
+            "meta": {"tpm_version": "2.0", "tboot_installed": true},
+            "pcr_rules": [{"pcr": {"index": 17, "bank": ["SHA256"]}, "eventlog_includes": ["vmlinuz"]}]
+        },
+        "HOST_UNIQUE": {
+            "meta": {"tpm_version": "2.0", "tboot_installed": true},
+            "pcr_rules": [{"pcr": {"index": 17, "bank": ["SHA256"]}, "eventlog_includes": ["LCP_CONTROL_HASH", "initrd"]}]
+        }
+    }
+}`
+
+func TestGenerateFlavors(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-flavors")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "tboot.json"), []byte(testTbootFlavorTemplate), 0644); err != nil {
+		t.Fatal("failed to write flavor template:", err.Error())
+	}
+	templates, err := loadFlavorTemplates(dir)
+	if err != nil {
+		t.Fatal("failed to load flavor templates:", err.Error())
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal("failed to generate flavor signing key:", err.Error())
+	}
+	keyDer, _ := x509.MarshalPKCS8PrivateKey(key)
+	if err = crypt.SavePrivateKeyAsPKCS8(keyDer, filepath.Join(dir, "flavor-signing.key")); err != nil {
+		t.Fatal("failed to save flavor signing key:", err.Error())
+	}
+	signingKey, err := loadFlavorSigningKey(filepath.Join(dir, "flavor-signing.key"))
+	if err != nil {
+		t.Fatal("failed to load flavor signing key:", err.Error())
+	}
+
+	ctrl := newTestController(t, 2)
+	ctrl.config.TrustedHostsPercentage = 100
+	// the second host has an ecc aik, which the host connector of HVS does not verify quotes of - it gets no flavors
+	pcaCertPath, pcaKeyPath := createTestPrivacyCa(t, dir)
+	eccAiks, err := loadNCreateHostAiks(filepath.Join(dir, "aiks"), []string{ctrl.hwUuidMap[1]}, []string{aikKeyTypeEccP256}, pcaCertPath, pcaKeyPath)
+	if err != nil {
+		t.Fatal("failed to create ecc aik:", err.Error())
+	}
+	ctrl.hosts[1].aik = eccAiks[0]
+	profile := ctrl.hosts[0].profile
+	profile.hostInfo = tamodel.HostInfo{OSName: "RedHatEnterprise", OSType: tamodel.OsTypeLinux, BiosName: "bios", HostName: "host", TbootInstalled: true}
+	profile.hostInfo.HardwareFeatures.TPM = &tamodel.TPM{}
+	profile.hostInfo.HardwareFeatures.TPM.Enabled = true
+	profile.hostInfo.HardwareFeatures.TPM.Meta.TPMVersion = "2.0"
+	profile.eventLog = tbootEventLog()
+	for _, host := range ctrl.hosts {
+		if err = host.resetPcrs(); err != nil {
+			t.Fatal("failed to reset pcrs:", err.Error())
+		}
+	}
+
+	output := filepath.Join(dir, "flavors.json")
+	flavors, err := generateFlavors(ctrl, output, templates, signingKey)
+	if err != nil {
+		t.Fatal("failed to generate flavors:", err.Error())
+	}
+	// the first host gets all the flavor parts, the second one is skipped
+	if flavors != 3 {
+		t.Errorf("%d flavors were generated instead of 3", flavors)
+	}
+
+	// the flavors of all the hosts are in a single flavor create request
+	data, err := ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal("flavors were not written:", err.Error())
+	}
+	var req hvs.FlavorCreateRequest
+	if err = json.Unmarshal(data, &req); err != nil {
+		t.Fatal("failed to decode flavors:", err.Error())
+	}
+	if len(req.SignedFlavorCollection.SignedFlavors) != 3 || len(req.FlavorCollection.Flavors) != 3 {
+		t.Fatalf("unexpected flavors: %s", string(data))
+	}
+	for _, signedFlavor := range req.SignedFlavorCollection.SignedFlavors {
+		if err = signedFlavor.Verify(&key.PublicKey); err != nil {
+			t.Errorf("signature of the %v flavor does not verify: %s", signedFlavor.Flavor.Meta.Description[hvs.FlavorPartDescription], err.Error())
+		}
+	}
+	hostUnique := req.SignedFlavorCollection.GetFlavors(hvs.FlavorPartHostUnique.String())
+	if len(hostUnique) != 1 || hostUnique[0].Flavor.Meta.Description[hvs.HardwareUUID] != ctrl.hwUuidMap[0] {
+		t.Error("HOST_UNIQUE flavor does not have the hardware uuid of the host")
+	}
+}
@@ -0,0 +1,242 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// a host profile is the platform that a simulated host looks like - the host info and the quote of a Trust
+// Agent on that platform. Without HostProfiles all the hosts share the profile of repository/host_info.json and
+// repository/quote.xml. With HostProfiles every profile is a directory in repository/profiles with a
+// host_info.json and an optional quote.xml, and the profiles are assigned to the hosts by weight
+//
+//	HostProfiles:
+//	  - name: txt-tboot
+//	    weight: 6
+//	    measurement_profile: tboot
+//	  - name: tpm-only
+//	    weight: 4
+//
+// The assignment is saved with the hardware uuid of the host in the hw uuid map, so a host keeps its profile
+// when the simulator is restarted or profiles are added
+
+// hostProfileConfig is a host profile in the configuration
+type hostProfileConfig struct {
+	Name   string `mapstructure:"name"`
+	Weight int    `mapstructure:"weight"`
+	// event log that the pcr values of the profile are replayed from - default is MeasurementProfile
+	MeasurementProfile string `mapstructure:"measurement_profile"`
+}
+
+// name of the profile that all the hosts share when no HostProfiles are configured
+const defaultHostProfileName = "default"
+
+const (
+	hostProfileHostInfoFile = "host_info.json"
+	hostProfileQuoteFile    = "quote.xml"
+)
+
+type hostProfile struct {
+	name     string
+	hostInfo tamodel.HostInfo
+	// quote response that the quotes of the hosts are created from - without the quote itself
+	tpmQuote      *tamodel.TpmQuoteResponse
+	quoteTemplate quoteTemplate
+	// pcr values and event log that the hosts boot with. The event log is nil when no measurement profile is
+	// configured
+	pcrBanks pcrBanks
+	eventLog []measurementEvent
+}
+
+// loadHostProfile loads the profile from the host info and the captured quote. When the quote file does not
+// exist or does not contain a quote, the hosts start out with the pcr values of a freshly reset TPM
+func loadHostProfile(name, hostInfoPath, tpmQuotePath string, activePcrBanks []string, measurementProfile string) (*hostProfile, error) {
+	profile := &hostProfile{name: name, tpmQuote: &tamodel.TpmQuoteResponse{}}
+
+	hd, err := ioutil.ReadFile(hostInfoPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read host info file")
+	}
+	if err = json.Unmarshal(hd, &profile.hostInfo); err != nil {
+		return nil, errors.Wrap(err, "Could not decode json for host info")
+	}
+
+	if quoteXml, err := ioutil.ReadFile(tpmQuotePath); err == nil {
+		if err = xml.Unmarshal(quoteXml, profile.tpmQuote); err != nil {
+			return nil, errors.Wrap(err, "Could not unmarshal xml tpm quote response file")
+		}
+	} else if !os.IsNotExist(err) || name == defaultHostProfileName {
+		return nil, errors.Wrap(err, "Could not read tpm quote file")
+	}
+	if profile.tpmQuote.Quote == "" {
+		// no captured quote - start out with the pcrs of a freshly reset TPM
+		log.Infof("tpm quote of host profile %s does not contain a quote. Using default pcr values", name)
+		profile.pcrBanks = newPcrBanks()
+	} else if origQuoteBytes, err := base64.StdEncoding.DecodeString(profile.tpmQuote.Quote); err != nil {
+		return nil, errors.Wrap(err, "could not convert quote to base64")
+	} else if profile.quoteTemplate, _, profile.pcrBanks, err = parseQuote(origQuoteBytes); err != nil {
+		return nil, errors.Wrap(err, "could not parse the tpm quote")
+	}
+	// only the configured banks are active on the simulated TPM - banks that are not part of the
+	// captured quote are derived from the captured ones
+	activeBanks := make(pcrBanks)
+	for _, bankName := range activePcrBanks {
+		hashAlg, ok := pcrBankNames[strings.ToUpper(bankName)]
+		if !ok {
+			return nil, errors.Errorf("invalid pcr bank %q in ActivePcrBanks", bankName)
+		}
+		profile.pcrBanks.addBank(hashAlg)
+		activeBanks[hashAlg] = profile.pcrBanks[hashAlg]
+	}
+	profile.pcrBanks = activeBanks
+	profile.tpmQuote.Quote = ""
+
+	// with a measurement profile the pcr values are replayed from a generated event log instead of
+	// being taken from the captured quote
+	if measurementProfile != "" {
+		generate, ok := measurementProfiles[measurementProfile]
+		if !ok {
+			return nil, errors.Errorf("invalid measurement profile %q", measurementProfile)
+		}
+		profile.eventLog = generate()
+	}
+	return profile, nil
+}
+
+// loadHostProfiles loads the configured host profiles - or the default profile when there are none
+func loadHostProfiles(ac *AppConfig) ([]*hostProfile, error) {
+	if len(ac.HostProfiles) == 0 {
+		profile, err := loadHostProfile(defaultHostProfileName, ac.hostInfoPath, ac.tpmQuotePath, ac.ActivePcrBanks, ac.MeasurementProfile)
+		if err != nil {
+			return nil, err
+		}
+		return []*hostProfile{profile}, nil
+	}
+
+	profiles := make([]*hostProfile, 0, len(ac.HostProfiles))
+	names := make(map[string]bool)
+	for _, cfg := range ac.HostProfiles {
+		if cfg.Name == "" || names[cfg.Name] || strings.ContainsAny(cfg.Name, `/\`) {
+			return nil, errors.Errorf("host profiles need unique names without path separators - invalid name %q", cfg.Name)
+		}
+		if cfg.Weight < 0 {
+			return nil, errors.Errorf("host profile %s: weight cannot be negative", cfg.Name)
+		}
+		names[cfg.Name] = true
+		measurementProfile := cfg.MeasurementProfile
+		if measurementProfile == "" {
+			measurementProfile = ac.MeasurementProfile
+		}
+		dir := filepath.Join(ac.hostProfilesPath, cfg.Name)
+		profile, err := loadHostProfile(cfg.Name, filepath.Join(dir, hostProfileHostInfoFile),
+			filepath.Join(dir, hostProfileQuoteFile), ac.ActivePcrBanks, measurementProfile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not load host profile %s", cfg.Name)
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, nil
+}
+
+// assignHostProfiles returns the name of the profile of each host. Hosts keep the profile that they were
+// assigned in the hw uuid map, the other hosts get the profile that is furthest below its share of the hosts
+// so that the hosts are spread over the profiles by weight
+func assignHostProfiles(entries []hwUuidMap, portStart, servers int, profiles []hostProfileConfig) ([]string, bool, error) {
+	total := 0
+	for _, profile := range profiles {
+		total += profile.Weight
+	}
+	if total == 0 {
+		return nil, false, errors.New("at least one host profile needs a weight")
+	}
+
+	assigned := make([]string, servers)
+	counts := make(map[string]int)
+	valid := func(name string) bool {
+		for _, profile := range profiles {
+			if profile.Name == name && profile.Weight > 0 {
+				return true
+			}
+		}
+		return false
+	}
+	for _, entry := range entries {
+		idx := entry.Port - portStart
+		if idx >= 0 && idx < servers && valid(entry.Profile) {
+			assigned[idx] = entry.Profile
+			counts[entry.Profile]++
+		}
+	}
+
+	changed := false
+	for idx := range assigned {
+		if assigned[idx] != "" {
+			continue
+		}
+		best := -1
+		for i, profile := range profiles {
+			if profile.Weight == 0 {
+				continue
+			}
+			// compare counts[i]/weight[i] without dividing
+			if best < 0 || counts[profile.Name]*profiles[best].Weight < counts[profiles[best].Name]*profile.Weight {
+				best = i
+			}
+		}
+		assigned[idx] = profiles[best].Name
+		counts[assigned[idx]]++
+		changed = true
+	}
+	return assigned, changed, nil
+}
+
+// loadNSaveHostProfileAssignment assigns the configured host profiles to the hosts and saves the assignment in
+// the hw uuid map. All the hosts get the default profile when there are no host profiles
+func loadNSaveHostProfileAssignment(hwUuidMapPath string, portStart, servers int, profiles []hostProfileConfig) ([]string, error) {
+	if len(profiles) == 0 {
+		assigned := make([]string, servers)
+		for i := range assigned {
+			assigned[i] = defaultHostProfileName
+		}
+		return assigned, nil
+	}
+
+	data, err := ioutil.ReadFile(hwUuidMapPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read hw uuid data")
+	}
+	var entries []hwUuidMap
+	if err = json.Unmarshal(data, &entries); err != nil {
+		return nil, errors.Wrap(err, "could not decode hw uuid data")
+	}
+	assigned, changed, err := assignHostProfiles(entries, portStart, servers, profiles)
+	if err != nil || !changed {
+		return assigned, err
+	}
+
+	for i := range entries {
+		if idx := entries[i].Port - portStart; idx >= 0 && idx < servers {
+			entries[i].Profile = assigned[idx]
+		}
+	}
+	if data, err = json.MarshalIndent(entries, "", "\t"); err != nil {
+		return nil, errors.Wrap(err, "could not marshal hw uuid data")
+	}
+	if err = ioutil.WriteFile(hwUuidMapPath, data, 0644); err != nil {
+		return nil, errors.Wrap(err, "could not write hw uuid data to file")
+	}
+	return assigned, nil
+}
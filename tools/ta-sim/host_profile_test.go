@@ -0,0 +1,52 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"testing"
+)
+
+func TestAssignHostProfiles(t *testing.T) {
+
+	profiles := []hostProfileConfig{{Name: "txt", Weight: 3}, {Name: "tpm-only", Weight: 1}, {Name: "disabled"}}
+	assigned, changed, err := assignHostProfiles(nil, 10000, 8, profiles)
+	if err != nil {
+		t.Fatal("failed to assign host profiles:", err.Error())
+	}
+	if !changed {
+		t.Error("assignment of new hosts was not reported as changed")
+	}
+	counts := make(map[string]int)
+	for _, name := range assigned {
+		counts[name]++
+	}
+	if counts["txt"] != 6 || counts["tpm-only"] != 2 || counts["disabled"] != 0 {
+		t.Errorf("host profiles are not assigned by weight: %v", counts)
+	}
+
+	// hosts keep their profile, hosts with an unknown profile or a profile without weight get a new one
+	entries := []hwUuidMap{
+		{Port: 10000, Profile: "tpm-only"},
+		{Port: 10001, Profile: "tpm-only"},
+		{Port: 10002, Profile: "removed"},
+		{Port: 10003, Profile: "disabled"},
+	}
+	assigned, changed, err = assignHostProfiles(entries, 10000, 4, profiles)
+	if err != nil {
+		t.Fatal("failed to assign host profiles:", err.Error())
+	}
+	if !changed || assigned[0] != "tpm-only" || assigned[1] != "tpm-only" || assigned[2] != "txt" || assigned[3] != "txt" {
+		t.Errorf("persisted host profiles were not kept: %v", assigned)
+	}
+
+	entries = []hwUuidMap{{Port: 10000, Profile: "txt"}, {Port: 10001, Profile: "tpm-only"}}
+	if _, changed, _ = assignHostProfiles(entries, 10000, 2, profiles); changed {
+		t.Error("assignment was reported as changed although all hosts have a profile")
+	}
+
+	if _, _, err = assignHostProfiles(nil, 10000, 2, []hostProfileConfig{{Name: "disabled"}}); err == nil {
+		t.Error("host profiles without weight were accepted")
+	}
+}
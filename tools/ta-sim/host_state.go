@@ -0,0 +1,264 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"sync"
+
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+	"github.com/pkg/errors"
+)
+
+// hostInfoOverrides replace the platform strings that a simulated host reports in its host info.
+// Empty fields are not overridden
+type hostInfoOverrides struct {
+	BiosName    string `json:"bios_name,omitempty" mapstructure:"bios_name"`
+	BiosVersion string `json:"bios_version,omitempty" mapstructure:"bios_version"`
+	OSName      string `json:"os_name,omitempty" mapstructure:"os_name"`
+	OSVersion   string `json:"os_version,omitempty" mapstructure:"os_version"`
+}
+
+func (o hostInfoOverrides) apply(hostInfo *tamodel.HostInfo) {
+	if o.BiosName != "" {
+		hostInfo.BiosName = o.BiosName
+	}
+	if o.BiosVersion != "" {
+		hostInfo.BiosVersion = o.BiosVersion
+	}
+	if o.OSName != "" {
+		hostInfo.OSName = o.OSName
+	}
+	if o.OSVersion != "" {
+		hostInfo.OSVersion = o.OSVersion
+	}
+}
+
+// simulatedHost is the state of a single simulated host that can change while the simulator is running.
+// Quotes are built from a snapshot of the state, so pcr banks are always replaced and never changed in place
+type simulatedHost struct {
+	lock sync.RWMutex
+	// the aik, the keys and the profile do not change while the simulator is running
+	aik *hostAik
+	// binding and signing key certificates of the host - nil when the host shares the keys of the simulator
+	keys    hostKeys
+	profile *hostProfile
+	// TPM that keeps the pcrs and signs the quotes with the software backend - nil with the template backend
+	tpm *softwareTpm
+
+	pcrBanks pcrBanks
+	// events that the pcr values were replayed from - nil when no measurement profile is configured
+	eventLog []measurementEvent
+	// json event log returned with the quote - empty when the event log of the captured quote is used unchanged
+	eventLogJson     string
+	isTagProvisioned bool
+	assetTag         string
+	hostInfo         hostInfoOverrides
+	offline          bool
+	// application manifests that were deployed to the host - in the order of deployment
+	manifests []deployedManifest
+}
+
+// hostSnapshot is a consistent copy of the state of a simulated host
+type hostSnapshot struct {
+	pcrBanks         pcrBanks
+	eventLogJson     string
+	isTagProvisioned bool
+	assetTag         string
+	hostInfo         hostInfoOverrides
+	offline          bool
+	measurementXmls  []string
+}
+
+// newSimulatedHost creates a host that reports the pcr values of its profile. When the profile has an event log,
+// the pcr values are replayed from the event log instead
+func newSimulatedHost(aik *hostAik, profile *hostProfile, isTagProvisioned bool, assetTag string) (*simulatedHost, error) {
+	host := &simulatedHost{
+		aik: aik, profile: profile,
+		pcrBanks:         profile.pcrBanks,
+		isTagProvisioned: isTagProvisioned,
+		assetTag:         assetTag,
+	}
+	if profile.eventLog != nil {
+		if err := host.replay(append([]measurementEvent{}, profile.eventLog...)); err != nil {
+			return nil, err
+		}
+	}
+	return host, nil
+}
+
+func (host *simulatedHost) replay(eventLog []measurementEvent) error {
+	hashAlgs := host.pcrBanks.hashAlgs()
+	banks, err := replayEventLog(eventLog, hashAlgs)
+	if err != nil {
+		return errors.Wrap(err, "could not replay the event log")
+	}
+	eventLogJson, err := marshalEventLog(eventLog, hashAlgs)
+	if err != nil {
+		return err
+	}
+	host.pcrBanks, host.eventLog, host.eventLogJson = banks, eventLog, eventLogJson
+	return nil
+}
+
+// measure extends the events into the pcrs of the host. When the host has an event log, the events are added
+// to the log so that it still replays to the pcr values
+func (host *simulatedHost) measure(events []measurementEvent) error {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	return host.extend(events)
+}
+
+func (host *simulatedHost) extend(events []measurementEvent) error {
+	if host.tpm != nil {
+		return host.extendTpm(events)
+	}
+	if host.eventLog != nil {
+		return host.replay(append(append([]measurementEvent{}, host.eventLog...), events...))
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	banks := host.pcrBanks.clone()
+	for _, ev := range events {
+		for hashAlg := range banks {
+			if err := banks.extend(hashAlg, ev.pcr, ev.digest(hashAlg)); err != nil {
+				return err
+			}
+		}
+	}
+	// the events are added to the captured event log, so that HVS can replay them
+	eventLogJson := host.eventLogJson
+	if eventLogJson == "" && host.profile.tpmQuote != nil {
+		eventLogJson = host.profile.tpmQuote.EventLog
+	}
+	eventLogJson, err := appendEventLog(eventLogJson, events, banks.hashAlgs())
+	if err != nil {
+		return err
+	}
+	host.pcrBanks, host.eventLogJson = banks, eventLogJson
+	return nil
+}
+
+// extendTpm extends the events into the pcrs of the software TPM of the host and adds them to the event log
+func (host *simulatedHost) extendTpm(events []measurementEvent) error {
+	eventLog := append(append([]measurementEvent{}, host.eventLog...), events...)
+	eventLogJson, err := marshalEventLog(eventLog, host.tpm.hashAlgs)
+	if err != nil {
+		return err
+	}
+	if err = host.tpm.measure(events); err != nil {
+		return errors.Wrap(err, "could not extend the pcrs of the TPM")
+	}
+	host.pcrBanks, host.eventLog, host.eventLogJson = host.tpm.pcrRead(), eventLog, eventLogJson
+	return nil
+}
+
+// powerOnTpm gives the host a software TPM and boots the host with it
+func (host *simulatedHost) powerOnTpm(tpm *softwareTpm) error {
+	host.lock.Lock()
+	host.tpm = tpm
+	host.lock.Unlock()
+	return host.resetPcrs()
+}
+
+// resetPcrs puts the pcrs and the event log of the host back in the state that the host booted with. The
+// deployed application manifests are measured again like they are on the boot of a real host
+func (host *simulatedHost) resetPcrs() error {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+
+	if host.tpm != nil {
+		// the TPM is reset and the events of the boot are measured again
+		locality := byte(0)
+		for _, ev := range host.profile.eventLog {
+			if ev.isStartupLocality() {
+				locality = startupLocality
+			}
+		}
+		host.tpm.startup(locality)
+		host.eventLog = []measurementEvent{}
+		if err := host.extendTpm(host.profile.eventLog); err != nil {
+			return err
+		}
+	} else if host.profile.eventLog != nil {
+		if err := host.replay(append([]measurementEvent{}, host.profile.eventLog...)); err != nil {
+			return err
+		}
+	} else {
+		host.pcrBanks, host.eventLog, host.eventLogJson = host.profile.pcrBanks, nil, ""
+	}
+	events := make([]measurementEvent, 0, len(host.manifests))
+	for _, manifest := range host.manifests {
+		events = append(events, manifest.event)
+	}
+	return host.extend(events)
+}
+
+// deployManifest adds the application manifest to the host - or replaces the manifest with the same uuid - and
+// extends its measurement into the pcrs
+func (host *simulatedHost) deployManifest(manifest deployedManifest) error {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+
+	manifests := make([]deployedManifest, 0, len(host.manifests)+1)
+	for _, deployed := range host.manifests {
+		if deployed.uuid != manifest.uuid {
+			manifests = append(manifests, deployed)
+		}
+	}
+	if err := host.extend([]measurementEvent{manifest.event}); err != nil {
+		return err
+	}
+	host.manifests = append(manifests, manifest)
+	return nil
+}
+
+// deployedManifests returns the application manifests that were deployed to the host in the order of deployment
+func (host *simulatedHost) deployedManifests() []*tamodel.Manifest {
+	host.lock.RLock()
+	defer host.lock.RUnlock()
+	manifests := make([]*tamodel.Manifest, 0, len(host.manifests))
+	for _, deployed := range host.manifests {
+		manifests = append(manifests, deployed.manifest)
+	}
+	return manifests
+}
+
+func (host *simulatedHost) setAssetTag(isTagProvisioned bool, assetTag string) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	host.isTagProvisioned, host.assetTag = isTagProvisioned, assetTag
+}
+
+func (host *simulatedHost) setHostInfo(overrides hostInfoOverrides) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	host.hostInfo = overrides
+}
+
+func (host *simulatedHost) setOffline(offline bool) {
+	host.lock.Lock()
+	defer host.lock.Unlock()
+	host.offline = offline
+}
+
+func (host *simulatedHost) snapshot() hostSnapshot {
+	host.lock.RLock()
+	defer host.lock.RUnlock()
+
+	var measurementXmls []string
+	for _, manifest := range host.manifests {
+		measurementXmls = append(measurementXmls, manifest.measurementXml)
+	}
+	return hostSnapshot{
+		pcrBanks:         host.pcrBanks,
+		eventLogJson:     host.eventLogJson,
+		isTagProvisioned: host.isTagProvisioned,
+		assetTag:         host.assetTag,
+		hostInfo:         host.hostInfo,
+		offline:          host.offline,
+		measurementXmls:  measurementXmls,
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// hvsApi calls the REST API of HVS with a token of the api user
+type hvsApi struct {
+	hvsUrl    string
+	authToken string
+	client    *http.Client
+}
+
+func newHvsApi(ac *AppConfig) (hvsApi, error) {
+	log.Info("Getting Authentication token to call HVS")
+	authToken, err := getAuthToken(ac.AasApiUrl, ac.ApiUserName, ac.ApiUserPassword)
+	if err != nil {
+		return hvsApi{}, err
+	}
+	log.Info("Authentication token obtained successfully")
+	return hvsApi{
+		hvsUrl:    ac.HvsApiUrl,
+		authToken: authToken,
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+		},
+	}, nil
+}
+
+// do sends the request and returns the status and body of the response
+func (api hvsApi) do(req *http.Request) (int, []byte, error) {
+	req.Header.Set("Authorization", "Bearer "+api.authToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := api.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "could not read response from hvs")
+	}
+	return resp.StatusCode, body, nil
+}
+
+// search decodes the collection of resources that match the query into result
+func (api hvsApi) search(resource string, query url.Values, result interface{}) error {
+	req, err := http.NewRequest("GET", api.hvsUrl+resource+"?"+query.Encode(), nil)
+	if err != nil {
+		return errors.Wrapf(err, "could not create %s search request", resource)
+	}
+	status, body, err := api.do(req)
+	if err != nil {
+		return errors.Wrapf(err, "could not search %s", resource)
+	}
+	if status != http.StatusOK {
+		return errors.Errorf("%s search returned %d: %s", resource, status, string(body))
+	}
+	if err = json.Unmarshal(body, result); err != nil {
+		return errors.Wrapf(err, "could not decode %s", resource)
+	}
+	return nil
+}
+
+// delete deletes the resource with the given id. Returns false when it did not exist
+func (api hvsApi) delete(resource, id string) (bool, error) {
+	req, err := http.NewRequest("DELETE", api.hvsUrl+resource+"/"+id, nil)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not create %s delete request", resource)
+	}
+	status, body, err := api.do(req)
+	if err != nil {
+		return false, errors.Wrapf(err, "could not delete %s %s", resource, id)
+	}
+	switch status {
+	case http.StatusOK, http.StatusNoContent:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+	return false, errors.Errorf("deleting %s %s returned %d: %s", resource, id, status, string(body))
+}
@@ -5,135 +5,281 @@
 package main
 
 import (
-	"crypto/tls"
-	"fmt"
+	"encoding/json"
 	taModel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
-	"reflect"
+	"math/rand"
 	"strings"
 	"time"
 )
 
-func NewHVSSubscriber(natsHostId string, cfg *AppConfig, taSimController controller) (*hvsSubscriberImpl, error) {
+// the Trust Agent has no subject for the signing key certificate - the simulated hosts serve it on this one
+const natsSkRequest = "get-signing-certificate"
 
-	if natsHostId == "" {
+// NewHVSSubscriber creates the subscriber of simulated hosts by their nats host id. A subscriber that is given a
+// shared connection subscribes once for all of the hosts, otherwise it answers for a single host on a connection
+// of its own
+func NewHVSSubscriber(name string, hosts map[string]int, cfg *AppConfig, taSimController controller, sharedConnection *natsConn) (*hvsSubscriberImpl, error) {
+
+	if _, ok := hosts[""]; ok || len(hosts) == 0 {
 		return nil, errors.New("The configuration does not have a 'nats-host-id'.")
 	}
+	if sharedConnection == nil && len(hosts) != 1 {
+		return nil, errors.New("Hosts that do not share a connection need a subscriber each")
+	}
 
 	return &hvsSubscriberImpl{
 		cfg:             cfg,
-		natsHostID:      natsHostId,
+		name:            name,
+		hosts:           hosts,
 		taSimController: taSimController,
+		natsConnection:  sharedConnection,
+		shared:          sharedConnection != nil,
 	}, nil
 
 }
 
 type hvsSubscriberImpl struct {
-	natsConnection  *nats.EncodedConn
-	cfg             *AppConfig
-	natsHostID      string
+	natsConnection *natsConn
+	cfg            *AppConfig
+	// the nats host id of the host for a connection of its own, the name of the shared connection otherwise
+	name string
+	// index of the simulated hosts by their nats host id
+	hosts           map[string]int
 	taSimController controller
+	// true when the connection is shared with other hosts
+	shared        bool
+	subscriptions []*nats.Subscription
 }
 
 func (subscriber *hvsSubscriberImpl) Start() error {
 
-	log.Infof("Starting outbound communications with nats-host-id '%s'", subscriber.natsHostID)
-
-	tlsConfig := tls.Config{
-		InsecureSkipVerify: true,
-	}
-
-	conn, err := nats.Connect(strings.Join(subscriber.cfg.NatsServers, ","),
-		nats.Name(subscriber.natsHostID),
-		nats.RetryOnFailedConnect(true),
-		nats.MaxReconnects(-1),
-		nats.ReconnectWait(5*time.Second),
-		nats.Timeout(10*time.Second),
-		nats.Secure(&tlsConfig),
-		nats.UserCredentials(subscriber.cfg.natsTaSimCredentialsPath),
-		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
-			log.Infof("NATS: Client %s disconnected: %v", subscriber.natsHostID, err)
-		}),
-		nats.ReconnectHandler(func(_ *nats.Conn) {
-			log.Infof("NATS: Client %s reconnected", subscriber.natsHostID)
-		}),
-		nats.ClosedHandler(func(_ *nats.Conn) {
-			log.Infof("NATS: Client %s closed", subscriber.natsHostID)
-		}),
-		nats.ErrorHandler(func(nc *nats.Conn, s *nats.Subscription, err error) {
-			if s != nil {
-				log.Errorf("ERROR: NATS: Could not process subscription for subject %q: %v", s.Subject, err)
-			} else {
-				log.Errorf("ERROR: NATS: %v", err)
-			}
-		}))
-
-	if err != nil {
-		return errors.Wrapf(err, "Failed to connect to url %q", subscriber.cfg.Servers)
-	}
+	log.Infof("Starting outbound communications of %d hosts with '%s'", len(subscriber.hosts), subscriber.name)
 
-	subscriber.natsConnection, err = nats.NewEncodedConn(conn, "json")
-	if err != nil {
-		log.WithError(err).Error("Error while wrapping an existing NATS connection to utilize the encoded connection")
+	var err error
+	if !subscriber.shared {
+		if subscriber.natsConnection, err = connectNats(subscriber.name, subscriber.cfg, subscriber.taSimController.metrics); err != nil {
+			return err
+		}
 	}
 
-	log.Infof("Successfully connected to %q", subscriber.cfg.NatsServers)
-
 	// subscribe to quote-request messages
-	quoteSubject := taModel.CreateSubject(subscriber.natsHostID, taModel.NatsQuoteRequest)
-	subscriber.natsConnection.Subscribe(quoteSubject, func(subject string, reply string, quoteRequest *taModel.TpmQuoteRequest) {
-		quoteResponse, err := subscriber.taSimController.getQuoteSignedWithNonce(quoteRequest.Nonce, subscriber.taSimController.tpmQuote.IsTagProvisioned, subscriber.taSimController.tpmQuote.AssetTag)
+	subscriber.subscribe(taModel.NatsQuoteRequest, func(subject string, reply string, quoteRequest *taModel.TpmQuoteRequest) {
+		hostIdx, ok := subscriber.host(subject)
+		if !ok {
+			return
+		}
+		start := time.Now()
+		quoteResponse, err := subscriber.taSimController.getQuoteSignedWithNonce(hostIdx, quoteRequest)
 		if err != nil {
 			log.WithError(err).Error("Failed to handle quote-request")
 		}
 
-		subscriber.natsConnection.Publish(reply, quoteResponse)
+		delivered := subscriber.respond(hostIdx, metricsRequestQuote, reply, quoteResponse)
+		subscriber.recordRequest(hostIdx, metricsRequestQuote, start, err != nil || !delivered)
 	})
 
 	//subscribe to host-info request messages
-	hostInfoSubject := taModel.CreateSubject(subscriber.natsHostID, taModel.NatsHostInfoRequest)
-	subscriber.natsConnection.Subscribe(hostInfoSubject, func(m *nats.Msg) {
-		hostInfo := subscriber.taSimController.hostInfo
-		if reflect.DeepEqual(hostInfo, taModel.Manifest{}) {
-			log.WithError(err).Error("Failed to handle quote-request")
+	subscriber.subscribe(taModel.NatsHostInfoRequest, func(m *nats.Msg) {
+		hostIdx, ok := subscriber.host(m.Subject)
+		if !ok {
+			return
 		}
-
-		hostInfo.HardwareUUID = subscriber.natsHostID
-		subscriber.natsConnection.Publish(m.Reply, hostInfo)
+		start := time.Now()
+		hostInfo, err := subscriber.taSimController.getHostInfo(hostIdx)
+		if err != nil {
+			log.WithError(err).Error("Failed to handle host-info-request")
+			subscriber.recordRequest(hostIdx, metricsRequestHostInfo, start, true)
+			return
+		}
+		delivered := subscriber.respond(hostIdx, metricsRequestHostInfo, m.Reply, hostInfo)
+		subscriber.recordRequest(hostIdx, metricsRequestHostInfo, start, !delivered)
 	})
 
 	// subscribe to aik request messages
-	aikSubject := taModel.CreateSubject(subscriber.natsHostID, taModel.NatsAikRequest)
-	subscriber.natsConnection.Subscribe(aikSubject, func(m *nats.Msg) {
-		aik := subscriber.taSimController.aikCert.Raw
+	subscriber.subscribe(taModel.NatsAikRequest, func(m *nats.Msg) {
+		hostIdx, ok := subscriber.host(m.Subject)
+		if !ok {
+			return
+		}
+		start := time.Now()
+		host, err := subscriber.taSimController.host(hostIdx)
+		if err != nil {
+			log.WithError(err).Error("Failed to handle aik-request")
+			subscriber.recordRequest(hostIdx, metricsRequestAik, start, true)
+			return
+		}
+		aik := host.aik.cert.Raw
 		if len(aik) == 0 {
 			log.WithError(err).Error("Failed to handle aik-request")
 		}
 
-		subscriber.natsConnection.Publish(m.Reply, aik)
+		delivered := subscriber.respond(hostIdx, metricsRequestAik, m.Reply, aik)
+		subscriber.recordRequest(hostIdx, metricsRequestAik, start, len(aik) == 0 || !delivered)
 	})
 
-	// subscribe to binding key request messages
-	bkSubject := taModel.CreateSubject(subscriber.natsHostID, taModel.NatsBkRequest)
-	subscriber.natsConnection.Subscribe(bkSubject, func(m *nats.Msg) {
-		bk := subscriber.taSimController.bindingKeyCert
-		if len(bk) == 0 {
-			log.WithError(err).Error("Failed to handle get-binding-certificate")
+	// subscribe to binding and signing key request messages
+	subscriber.subscribe(taModel.NatsBkRequest, subscriber.hostKeyHandler(hostKeyUsageBinding, taModel.NatsBkRequest, metricsRequestBindingKey))
+	subscriber.subscribe(natsSkRequest, subscriber.hostKeyHandler(hostKeyUsageSigning, natsSkRequest, metricsRequestSigningKey))
+
+	// subscribe to deploy asset tag messages
+	subscriber.subscribe(taModel.NatsDeployAssetTagRequest, func(subject string, reply string, tagWriteRequest *taModel.TagWriteRequest) {
+		hostIdx, ok := subscriber.host(subject)
+		if !ok {
+			return
+		}
+		start := time.Now()
+		if err := subscriber.taSimController.deployAssetTag(hostIdx, tagWriteRequest); err != nil {
+			log.WithError(err).Error("Failed to handle deploy-asset-tag")
+			subscriber.recordRequest(hostIdx, metricsRequestTag, start, true)
+			return
 		}
 
-		subscriber.natsConnection.Publish(m.Reply, bk)
+		delivered := subscriber.respond(hostIdx, metricsRequestTag, reply, nil)
+		subscriber.recordRequest(hostIdx, metricsRequestTag, start, !delivered)
 	})
 
-	log.Infof("Running Trust-Agent %s...", subscriber.natsHostID)
-	for {
-		time.Sleep(10 * time.Second)
-	}
+	// subscribe to deploy manifest messages
+	subscriber.subscribe(taModel.NatsDeployManifestRequest, func(subject string, reply string, manifest *taModel.Manifest) {
+		hostIdx, ok := subscriber.host(subject)
+		if !ok {
+			return
+		}
+		start := time.Now()
+		if err := subscriber.taSimController.deployManifest(hostIdx, manifest); err != nil {
+			log.WithError(err).Error("Failed to handle deploy-manifest")
+			subscriber.recordRequest(hostIdx, metricsRequestManifest, start, true)
+			return
+		}
+
+		delivered := subscriber.respond(hostIdx, metricsRequestManifest, reply, nil)
+		subscriber.recordRequest(hostIdx, metricsRequestManifest, start, !delivered)
+	})
+
+	// subscribe to application measurement request messages
+	subscriber.subscribe(taModel.NatsApplicationMeasurementRequest, func(subject string, reply string, manifest *taModel.Manifest) {
+		hostIdx, ok := subscriber.host(subject)
+		if !ok {
+			return
+		}
+		start := time.Now()
+		measurement, err := subscriber.taSimController.applicationMeasurement(hostIdx, manifest)
+		if err != nil {
+			log.WithError(err).Error("Failed to handle application-measurement-request")
+			subscriber.recordRequest(hostIdx, metricsRequestApplicationMeasurement, start, true)
+			return
+		}
+
+		delivered := subscriber.respond(hostIdx, metricsRequestApplicationMeasurement, reply, measurement)
+		subscriber.recordRequest(hostIdx, metricsRequestApplicationMeasurement, start, !delivered)
+	})
 
+	log.Infof("Running Trust-Agent %s...", subscriber.name)
 	return nil
 }
 
+// hostKeyHandler returns the handler of the messages that request the certificate of the key of the host with the usage
+func (subscriber *hvsSubscriberImpl) hostKeyHandler(usage, natsRequest, request string) func(m *nats.Msg) {
+	return func(m *nats.Msg) {
+		hostIdx, ok := subscriber.host(m.Subject)
+		if !ok {
+			return
+		}
+		start := time.Now()
+		cert, err := subscriber.taSimController.hostKeyCert(hostIdx, usage)
+		if err != nil || len(cert) == 0 {
+			log.WithError(err).Error("Failed to handle " + natsRequest)
+		}
+
+		delivered := subscriber.respond(hostIdx, request, m.Reply, cert)
+		subscriber.recordRequest(hostIdx, request, start, len(cert) == 0 || !delivered)
+	}
+}
+
+// host returns the index of the simulated host that a message was sent to. Returns false when the subscriber does
+// not answer for the host, or the host has been taken offline - requests to offline hosts are not answered so that
+// they time out in HVS
+func (subscriber *hvsSubscriberImpl) host(subject string) (int, bool) {
+	// the subjects are trust-agent.<nats host id>.<request>
+	tokens := strings.Split(subject, ".")
+	if len(tokens) != 3 {
+		return 0, false
+	}
+	hostIdx, ok := subscriber.hosts[tokens[1]]
+	if !ok {
+		return 0, false
+	}
+	host, err := subscriber.taSimController.host(hostIdx)
+	return hostIdx, err == nil && !host.snapshot().offline
+}
+
+// respond publishes the response to a request of HVS after the latency of the fault profile of the host. Returns
+// false when the fault profile made the request fail
+func (subscriber *hvsSubscriberImpl) respond(hostIdx int, request, reply string, response interface{}) bool {
+	fp := subscriber.taSimController.hostFaultProfile(hostIdx)
+	latency, action := fp.draw(request, rand.Float64)
+	time.Sleep(latency)
+
+	switch action {
+	case faultReset:
+		// there is no connection to reset - the request times out in HVS like one to an offline host
+		return false
+	case faultStall:
+		time.Sleep(fp.Stall)
+	case faultError:
+		response = nil
+	case faultMalformed:
+		if data, err := json.Marshal(response); err == nil {
+			subscriber.natsConnection.Conn.Publish(reply, malformed(data))
+			return false
+		}
+	}
+	subscriber.natsConnection.Publish(reply, response)
+	return action == faultNone
+}
+
+// recordRequest records a request to the simulated host that was received over NATS at start
+func (subscriber *hvsSubscriberImpl) recordRequest(hostIdx int, request string, start time.Time, failed bool) {
+	subscriber.taSimController.metrics.recordRequest(request, metricsTransportNats,
+		subscriber.cfg.PortStart+hostIdx, start, failed)
+}
+
+// subscribe subscribes to the request. A host with a connection of its own subscribes to its subject, a shared
+// connection subscribes to the subjects of all hosts in the queue group of the pool. The wildcard subjects receive
+// every Trust Agent request on the NATS cluster, also those to real Trust Agents and to other simulators, which are
+// dropped by host. Subscriptions that fail are logged - the hosts do not answer those requests
+func (subscriber *hvsSubscriberImpl) subscribe(request string, handler nats.Handler) {
+	var sub *nats.Subscription
+	var err error
+	subject := taModel.CreateSubject(subscriber.name, request)
+	if subscriber.shared {
+		subject = taModel.CreateSubject("*", request)
+		sub, err = subscriber.natsConnection.QueueSubscribe(subject, subscriber.natsConnection.queue, handler)
+	} else {
+		sub, err = subscriber.natsConnection.Subscribe(subject, handler)
+	}
+	if err != nil {
+		log.WithError(err).Errorf("Failed to subscribe to %s", subject)
+		return
+	}
+	subscriber.subscriptions = append(subscriber.subscriptions, sub)
+}
+
+// Stop drains the subscriptions of the subscriber - requests that have been received are answered before the
+// subscriptions are removed. A connection of its own is closed, shared connections are closed with their pool
 func (subscriber *hvsSubscriberImpl) Stop() error {
-	return fmt.Errorf("Not Implemented")
+	if subscriber.natsConnection == nil {
+		return nil
+	}
+	if !subscriber.shared {
+		return errors.Wrapf(subscriber.natsConnection.close(), "Could not close the connection of %s", subscriber.name)
+	}
+	for _, sub := range subscriber.subscriptions {
+		if err := sub.Drain(); err != nil && err != nats.ErrConnectionClosed && err != nats.ErrBadSubscription {
+			return errors.Wrapf(err, "Could not drain the subscriptions of %s", subscriber.name)
+		}
+	}
+	return nil
 }
@@ -0,0 +1,237 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	taModel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+	"github.com/nats-io/nats.go"
+)
+
+// mockNatsServer speaks enough of the NATS client protocol for the subscribers of the simulator - subscriptions
+// with wildcards and queue groups, and publishing with a reply subject
+type mockNatsServer struct {
+	listener net.Listener
+	lock     sync.Mutex
+	subs     []*mockNatsSub
+}
+
+type mockNatsSub struct {
+	client  *mockNatsClient
+	subject string
+	queue   string
+	sid     string
+}
+
+type mockNatsClient struct {
+	conn net.Conn
+	lock sync.Mutex
+}
+
+func newMockNatsServer(t *testing.T) *mockNatsServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen:", err.Error())
+	}
+	server := &mockNatsServer{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(&mockNatsClient{conn: conn})
+		}
+	}()
+	return server
+}
+
+func (server *mockNatsServer) url() string {
+	return "nats://" + server.listener.Addr().String()
+}
+
+func (server *mockNatsServer) close() {
+	server.listener.Close()
+}
+
+func (client *mockNatsClient) write(format string, args ...interface{}) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+	fmt.Fprintf(client.conn, format, args...)
+}
+
+func (server *mockNatsServer) serve(client *mockNatsClient) {
+	defer client.conn.Close()
+	client.write("INFO {\"server_id\":\"mock\",\"version\":\"2.3.4\",\"proto\":1,\"max_payload\":1048576}\r\n")
+	reader := bufio.NewReader(client.conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			server.unsubscribe(client, "")
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		switch strings.ToUpper(args[0]) {
+		case "PING":
+			client.write("PONG\r\n")
+		case "SUB":
+			sub := &mockNatsSub{client: client, subject: args[1], sid: args[len(args)-1]}
+			if len(args) == 4 {
+				sub.queue = args[2]
+			}
+			server.lock.Lock()
+			server.subs = append(server.subs, sub)
+			server.lock.Unlock()
+		case "UNSUB":
+			server.unsubscribe(client, args[1])
+		case "PUB":
+			size, _ := strconv.Atoi(args[len(args)-1])
+			payload := make([]byte, size+2)
+			if _, err = io.ReadFull(reader, payload); err != nil {
+				return
+			}
+			reply := ""
+			if len(args) == 4 {
+				reply = args[2]
+			}
+			server.publish(args[1], reply, payload[:size])
+		}
+	}
+}
+
+// unsubscribe removes the subscription of the client with the sid, or all of its subscriptions for an empty sid
+func (server *mockNatsServer) unsubscribe(client *mockNatsClient, sid string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	subs := server.subs[:0]
+	for _, sub := range server.subs {
+		if sub.client != client || (sid != "" && sub.sid != sid) {
+			subs = append(subs, sub)
+		}
+	}
+	server.subs = subs
+}
+
+// publish delivers the message to every matching subscription, and to one subscription of each queue group
+func (server *mockNatsServer) publish(subject, reply string, payload []byte) {
+	server.lock.Lock()
+	var receivers []*mockNatsSub
+	queues := make(map[string]bool)
+	for _, sub := range server.subs {
+		if !natsSubjectMatches(sub.subject, subject) || (sub.queue != "" && queues[sub.queue]) {
+			continue
+		}
+		queues[sub.queue] = sub.queue != ""
+		receivers = append(receivers, sub)
+	}
+	server.lock.Unlock()
+
+	for _, sub := range receivers {
+		if reply == "" {
+			sub.client.write("MSG %s %s %d\r\n%s\r\n", subject, sub.sid, len(payload), payload)
+		} else {
+			sub.client.write("MSG %s %s %s %d\r\n%s\r\n", subject, sub.sid, reply, len(payload), payload)
+		}
+	}
+}
+
+func natsSubjectMatches(pattern, subject string) bool {
+	patternTokens, subjectTokens := strings.Split(pattern, "."), strings.Split(subject, ".")
+	for i, token := range patternTokens {
+		if token == ">" {
+			return len(subjectTokens) > i
+		}
+		if i >= len(subjectTokens) || (token != "*" && token != subjectTokens[i]) {
+			return false
+		}
+	}
+	return len(patternTokens) == len(subjectTokens)
+}
+
+// connectMockNats connects to the mock server with an encoded connection like connectNats does
+func connectMockNats(t *testing.T, server *mockNatsServer) *natsConn {
+	closed := make(chan struct{})
+	conn, err := nats.Connect(server.url(), nats.ClosedHandler(func(_ *nats.Conn) { close(closed) }))
+	if err != nil {
+		t.Fatal("failed to connect to nats:", err.Error())
+	}
+	encodedConn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		t.Fatal("failed to create encoded connection:", err.Error())
+	}
+	return &natsConn{EncodedConn: encodedConn, closed: closed, queue: "ta-sim-test"}
+}
+
+func TestSharedConnectionSubscriber(t *testing.T) {
+
+	server := newMockNatsServer(t)
+	defer server.close()
+
+	ctrl := newTestController(t, 3)
+	hosts := make(map[string]int)
+	for i := range ctrl.hosts {
+		ctrl.hosts[i].keys = hostKeys{hostKeyUsageBinding: []byte(fmt.Sprintf("binding key %d", i))}
+		hosts[ctrl.hwUuidMap[i]] = i
+	}
+	ctrl.hosts[2].setOffline(true)
+	// a host that the controller does not simulate
+	hosts["44444444-4444-4444-4444-444444444444"] = len(ctrl.hosts)
+
+	// a single connection answers for all of the hosts
+	conn := connectMockNats(t, server)
+	subscriber, err := NewHVSSubscriber("ta-sim-shared-0", hosts, ctrl.config, *ctrl, conn)
+	if err != nil {
+		t.Fatal("failed to create subscriber:", err.Error())
+	}
+	if err = subscriber.Start(); err != nil {
+		t.Fatal("failed to start subscriber:", err.Error())
+	}
+	if len(subscriber.subscriptions) != 8 {
+		t.Errorf("shared connection has %d subscriptions for 3 hosts instead of 8", len(subscriber.subscriptions))
+	}
+	if err = conn.Flush(); err != nil {
+		t.Fatal("failed to flush subscriptions:", err.Error())
+	}
+
+	client := connectMockNats(t, server)
+	defer client.Close()
+	for i, hwUuid := range []string{ctrl.hwUuidMap[0], ctrl.hwUuidMap[1]} {
+		msg, err := client.Conn.Request(taModel.CreateSubject(hwUuid, taModel.NatsBkRequest), nil, 5*time.Second)
+		if err != nil {
+			t.Fatalf("host %d did not answer: %s", i, err.Error())
+		}
+		var cert []byte
+		if err = json.Unmarshal(msg.Data, &cert); err != nil || string(cert) != fmt.Sprintf("binding key %d", i) {
+			t.Errorf("host %d answered with %q", i, string(cert))
+		}
+	}
+
+	// offline hosts, unknown hosts and hosts of other simulators do not answer
+	for _, hwUuid := range []string{ctrl.hwUuidMap[2], "44444444-4444-4444-4444-444444444444", "33333333-3333-3333-3333-333333333333"} {
+		if _, err = client.Conn.Request(taModel.CreateSubject(hwUuid, taModel.NatsBkRequest), nil, 200*time.Millisecond); err != nats.ErrTimeout {
+			t.Errorf("request to %s was answered: %v", hwUuid, err)
+		}
+	}
+
+	if err = subscriber.Stop(); err != nil {
+		t.Error("failed to stop subscriber:", err.Error())
+	}
+	if err = conn.close(); err != nil {
+		t.Error("failed to close connection:", err.Error())
+	}
+}
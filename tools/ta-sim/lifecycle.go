@@ -0,0 +1,75 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how long in-flight requests are given to complete when the simulator is stopped
+const shutdownTimeout = 30 * time.Second
+
+// stopOnSignal returns a context that is cancelled when the simulator receives SIGTERM or SIGINT
+func stopOnSignal() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %s, stopping the simulator", sig)
+		cancel()
+		signal.Stop(signals)
+	}()
+	return ctx
+}
+
+// runServers serves the servers until ctx is cancelled and then shuts them down, waiting for in-flight requests
+// to complete. Returns when all the servers have stopped - also when they stopped because they failed to listen
+func runServers(ctx context.Context, servers []*http.Server, certPath, keyPath string) {
+	wg := new(sync.WaitGroup)
+	wg.Add(len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.ListenAndServeTLS(certPath, keyPath); err != http.ErrServerClosed {
+				log.Errorf("server on %s stopped: %s", server.Addr, err.Error())
+			}
+		}(server)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return
+	case <-ctx.Done():
+	}
+	// the listeners are closed right away, Shutdown returns once the in-flight requests are done
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	shutdowns := new(sync.WaitGroup)
+	shutdowns.Add(len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			defer shutdowns.Done()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Errorf("server on %s did not shut down cleanly: %s", server.Addr, err.Error())
+			}
+		}(server)
+	}
+	shutdowns.Wait()
+	<-stopped
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRunServersDrainsRequests(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-lifecycle")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := createTestPrivacyCa(t, dir)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to find a free port:", err.Error())
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	received := make(chan struct{})
+	server := &http.Server{
+		Addr: addr,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/slow" {
+				close(received)
+				time.Sleep(200 * time.Millisecond)
+			}
+			_, _ = w.Write([]byte("done"))
+		}),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		runServers(ctx, []*http.Server{server}, certPath, keyPath)
+		close(stopped)
+	}()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	for i := 0; ; i++ {
+		if resp, err := client.Get(fmt.Sprintf("https://%s/", addr)); err == nil {
+			resp.Body.Close()
+			break
+		} else if i == 50 {
+			t.Fatal("server did not start:", err.Error())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the simulator is stopped while a request is in flight
+	go func() {
+		<-received
+		cancel()
+	}()
+	resp, err := client.Get(fmt.Sprintf("https://%s/slow", addr))
+	if err != nil {
+		t.Fatal("in-flight request failed when the server was stopped:", err.Error())
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "done" {
+		t.Errorf("in-flight request got %q", body)
+	}
+
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		t.Fatal("servers did not stop")
+	}
+	if _, err = client.Get(fmt.Sprintf("https://%s/", addr)); err == nil {
+		t.Error("server still accepts requests after it was stopped")
+	}
+}
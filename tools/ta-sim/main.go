@@ -6,15 +6,9 @@ package main
 
 import (
 	"bytes"
-	"crypto"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/sha1"
-	"crypto/sha256"
+	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
@@ -30,7 +24,6 @@ import (
 	"github.com/google/uuid"
 
 	client "github.com/intel-secl/intel-secl/v4/pkg/clients/ta"
-	"github.com/intel-secl/intel-secl/v4/pkg/lib/common/crypt"
 	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -46,23 +39,47 @@ const (
 	communicationModeOutbound = "outbound"
 )
 
+// prefix of the names that the simulated hosts are registered with in HVS
+const hvsHostNamePrefix = "Go-TASim-"
+
 type AppConfig struct {
-	PortStart              int
-	Servers                int
-	DistinctFlavors        int
-	QuoteDelayMs           int
-	RequestVolume          int
-	RequestVolumeDelayMs   int
-	TrustedHostsPercentage int
-	ApiUserName            string
-	ApiUserPassword        string
-	HvsApiUrl              string
-	AasApiUrl              string
-	CmsApiUrl              string
-	SimulatorIP            string
-	NatsServers            []string
-	TaSimServiceMode       string
-	TaHostId               string
+	PortStart               int
+	Servers                 int
+	DistinctFlavors         int
+	QuoteDelayMs            int
+	RequestVolume           int
+	RequestVolumeDelayMs    int
+	TrustedHostsPercentage  int
+	PcrDriftHostsPercentage int
+	PcrDriftPcrs            []int
+	ActivePcrBanks          []string
+	MeasurementProfile      string
+	TpmBackend              string
+	AdminApiPort            int
+	AdminApiUserName        string
+	AdminApiUserPassword    string
+	ScenarioFile            string
+	FaultProfileFile        string
+	PerHostAik              bool
+	PerHostKeys             bool
+	EccAikHostsPercentage   int
+	EccAikCurve             string
+	TamperedFilesPercentage int
+	VirtualHostMode         string
+	VirtualHostPort         int
+	VirtualHostDomain       string
+	MetricsPort             int
+	ApiUserName             string
+	ApiUserPassword         string
+	HvsApiUrl               string
+	AasApiUrl               string
+	CmsApiUrl               string
+	SimulatorIP             string
+	NatsServers             []string
+	NatsConnections         int
+	HostProfiles            []hostProfileConfig
+	TaSimServiceMode        string
+	TaHostId                string
 
 	sslCertPath              string
 	sslKeyPath               string
@@ -70,27 +87,37 @@ type AppConfig struct {
 	hostInfoPath             string
 	aikCertPath              string
 	aikKeyPath               string
+	aikDirPath               string
+	pcaCertPath              string
+	pcaKeyPath               string
 	bindingKeyPath           string
+	signingKeyPath           string
+	hostKeysDirPath          string
 	hwUuidMapPath            string
+	hostProfilesPath         string
+	assetTagsPath            string
+	manifestsPath            string
 	natsTaSimCredentialsPath string
 	natsTaSubCredentialsPath string
 }
 
-type quoteSections struct {
-	infoPreNonceSha1  []byte
-	infoPostNonceSha1 []byte
-	afterSignature    []byte
-}
 type controller struct {
-	aikCert        *x509.Certificate
-	aikKey         *rsa.PrivateKey
-	bindingKeyCert []byte
-	tpmQuote       *tamodel.TpmQuoteResponse
-	quoteParts     quoteSections
+	// aik and binding and signing key certificates that are shared by the hosts that do not have their own
+	aik  *hostAik
+	keys hostKeys
+	// state of each simulated host - keyed by host index
+	hosts     []*simulatedHost
+	startTime time.Time
 
-	hostInfo  tamodel.HostInfo
 	config    *AppConfig
 	hwUuidMap []string
+	// asset tags and application manifests that were deployed to the hosts
+	assetTags *assetTagStore
+	manifests *manifestStore
+	// metrics of the requests served by the hosts - nothing is recorded when nil
+	metrics *simulatorMetrics
+	// fault profile of each host - nil for hosts that behave
+	faults []*faultProfile
 }
 
 func getApplicationData() (*AppConfig, error) {
@@ -129,6 +156,36 @@ func getApplicationData() (*AppConfig, error) {
 	if ac.TrustedHostsPercentage < 1 || ac.TrustedHostsPercentage > 100 {
 		ac.TrustedHostsPercentage = 100
 	}
+	if ac.PcrDriftHostsPercentage < 0 || ac.PcrDriftHostsPercentage > 100 {
+		ac.PcrDriftHostsPercentage = 0
+	}
+	if len(ac.PcrDriftPcrs) == 0 {
+		ac.PcrDriftPcrs = []int{0}
+	}
+	if len(ac.ActivePcrBanks) == 0 {
+		ac.ActivePcrBanks = []string{"SHA1", "SHA256", "SHA384"}
+	}
+	if ac.EccAikHostsPercentage < 0 || ac.EccAikHostsPercentage > 100 {
+		ac.EccAikHostsPercentage = 0
+	}
+	if ac.TamperedFilesPercentage < 0 || ac.TamperedFilesPercentage > 100 {
+		ac.TamperedFilesPercentage = 0
+	}
+	ac.VirtualHostMode = strings.ToLower(ac.VirtualHostMode)
+	if ac.VirtualHostPort == 0 {
+		ac.VirtualHostPort = ac.PortStart
+	}
+	if ac.VirtualHostDomain == "" {
+		ac.VirtualHostDomain = "ta-sim.local"
+	}
+	if ac.EccAikCurve == "" {
+		ac.EccAikCurve = aikKeyTypeEccP256
+	}
+	ac.EccAikCurve = strings.ToUpper(ac.EccAikCurve)
+	if ac.TpmBackend == "" {
+		ac.TpmBackend = tpmBackendTemplate
+	}
+	ac.TpmBackend = strings.ToLower(ac.TpmBackend)
 
 	if len(ac.NatsServers) == 0 && ac.TaHostId == "" {
 		ac.TaSimServiceMode = communicationModeHttp
@@ -138,15 +195,29 @@ func getApplicationData() (*AppConfig, error) {
 
 	ac.aikCertPath = filepath.FromSlash(homePath + "configuration/aik.cert.pem")
 	ac.aikKeyPath = filepath.FromSlash(homePath + "configuration/aik.key.pem")
+	ac.aikDirPath = filepath.FromSlash(homePath + "configuration/aiks")
+	ac.pcaCertPath = filepath.FromSlash(homePath + "configuration/pca-cert")
+	ac.pcaKeyPath = filepath.FromSlash(homePath + "configuration/pca-key")
 	ac.bindingKeyPath = filepath.FromSlash(homePath + "configuration/bk.cert")
+	ac.signingKeyPath = filepath.FromSlash(homePath + "configuration/sk.cert")
+	ac.hostKeysDirPath = filepath.FromSlash(homePath + "configuration/keys")
 	ac.hostInfoPath = filepath.FromSlash(homePath + "repository/host_info.json")
 	ac.tpmQuotePath = filepath.FromSlash(homePath + "repository/quote.xml")
+	ac.hostProfilesPath = filepath.FromSlash(homePath + "repository/profiles")
 	ac.natsTaSimCredentialsPath = filepath.FromSlash(homePath + "repository/ta-sim.creds")
 	ac.natsTaSubCredentialsPath = filepath.FromSlash(homePath + "repository/ta-sub.creds")
 	ac.sslCertPath = filepath.FromSlash(homePath + "configuration/cert.pem")
 	ac.sslKeyPath = filepath.FromSlash(homePath + "configuration/key.pem")
 	ac.sslKeyPath = filepath.FromSlash(homePath + "configuration/key.pem")
 	ac.hwUuidMapPath = filepath.FromSlash(homePath + "configuration/hw_uuid_map.json")
+	ac.assetTagsPath = filepath.FromSlash(homePath + "configuration/asset_tags.json")
+	ac.manifestsPath = filepath.FromSlash(homePath + "configuration/manifests.json")
+	if ac.ScenarioFile != "" && !filepath.IsAbs(ac.ScenarioFile) {
+		ac.ScenarioFile = filepath.Join(filepath.FromSlash(homePath+"configuration"), ac.ScenarioFile)
+	}
+	if ac.FaultProfileFile != "" && !filepath.IsAbs(ac.FaultProfileFile) {
+		ac.FaultProfileFile = filepath.Join(filepath.FromSlash(homePath+"configuration"), ac.FaultProfileFile)
+	}
 
 	return ac, nil
 }
@@ -154,6 +225,8 @@ func getApplicationData() (*AppConfig, error) {
 type hwUuidMap struct {
 	Port   int    `json:"port"`
 	HwUuid string `json:"hw_uuid"`
+	// host profile that was assigned to the host - empty when there are no HostProfiles
+	Profile string `json:"profile,omitempty"`
 }
 
 // This function takes in the contents of the file with the host uuid data
@@ -208,90 +281,134 @@ func loadNSaveHwUuidFile(hwUuidMapPath string, portStart, servers int) ([]string
 }
 
 func NewController(ac *AppConfig) (*controller, error) {
-	ctrlr := &controller{}
-	var err error
-	if quoteXml, err := ioutil.ReadFile(ac.tpmQuotePath); err != nil {
-		return nil, errors.Wrap(err, "Could not read tpm quote file")
-	} else {
-		var quoteResponse tamodel.TpmQuoteResponse
-		if err = xml.Unmarshal(quoteXml, &quoteResponse); err != nil {
-			return nil, errors.Wrap(err, "Could not unmarshal xml tpm quote response file")
+	ctrlr := &controller{startTime: time.Now(), metrics: newSimulatorMetrics()}
+	profiles, err := loadHostProfiles(ac)
+	if err != nil {
+		return nil, err
+	}
+	if ctrlr.aik, err = loadHostAik(ac.aikCertPath, ac.aikKeyPath); err != nil {
+		return nil, errors.Wrap(err, "Could not load the aik")
+	}
+	// the qualified signer of the captured quote is the name that the TPM gave to the aik
+	if profiles[0].quoteTemplate.qualifiedSigner != nil {
+		ctrlr.aik.name = profiles[0].quoteTemplate.qualifiedSigner
+	}
+	ctrlr.keys = hostKeys{}
+	for usage, path := range map[string]string{hostKeyUsageBinding: ac.bindingKeyPath, hostKeyUsageSigning: ac.signingKeyPath} {
+		if ctrlr.keys[usage], err = ioutil.ReadFile(path); err != nil {
+			log.Errorf("Could not read %s key file - skipping", usage)
 		}
-		ctrlr.tpmQuote = &quoteResponse
-		if origQuoteBytes, err := base64.StdEncoding.DecodeString(quoteResponse.Quote); err != nil {
-			return nil, errors.Wrap(err, "could not convert quote to base64")
-		} else {
-			// seperate out the quote into 3 parts. The first one is part of the quote before the
-			// sha1 of the nonce.
-			// second part is the where the sha1 of the nonce is at. We do not need to save this part
-			// We can just ignore it since we will be adding the sha1 of the new nonce
-			// Third part is the rest of the quote.
-
-			//determine the end of the quote. the first 2 bytes represent the length of the quote
-			index := 0
-			endOfQuoteIdx := int(binary.BigEndian.Uint16(origQuoteBytes[0:2])) + 2
-
-			// advance the index by 8 bytes - 2 for the quote info length
-			// and 6 more bytes that are not clear. Refer VerifyQuoteAndGetPCRManifest in
-			// intel_host_connector library.
-			index += 8
-
-			tpm2bNameSize := binary.BigEndian.Uint16(origQuoteBytes[index : index+2])
-
-			index += 2 + int(tpm2bNameSize)
-			tpm2bDataSize := binary.BigEndian.Uint16(origQuoteBytes[index : index+2])
-			ctrlr.quoteParts.infoPreNonceSha1 = origQuoteBytes[:index+2]
-
-			index += 2
-			//tpm2bData := origQuoteBytes[index : index+int(tpm2bDataSize)]
-			index += int(tpm2bDataSize)
-			// there are 6 bytes (3 x 2 byte integers) at the end of the quote that indicates
-			// Signature Algorigthm (20), signature hash algorithm(11) and size of signature(256)
-			ctrlr.quoteParts.infoPostNonceSha1 = origQuoteBytes[index : endOfQuoteIdx+6]
-
-			// make sure that the last 2 bytes of this has a value of 256 bytes... otherwise, we have a
-			// problem with the original quote. Error out
-			if binary.BigEndian.Uint16(ctrlr.quoteParts.infoPostNonceSha1[len(ctrlr.quoteParts.infoPostNonceSha1)-2:]) != 256 {
-				return nil, errors.New("original quote signature length is not 256. Incorrect quote")
+	}
+	if ctrlr.hwUuidMap, err = loadNSaveHwUuidFile(ac.hwUuidMapPath, ac.PortStart, ac.Servers); err != nil {
+		return nil, errors.Wrap(err, "could not load the hw uuids")
+	}
+	hostProfileNames, err := loadNSaveHostProfileAssignment(ac.hwUuidMapPath, ac.PortStart, ac.Servers, ac.HostProfiles)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not assign the host profiles")
+	}
+	profilesByName := make(map[string]*hostProfile)
+	for _, profile := range profiles {
+		profilesByName[profile.name] = profile
+	}
+	switch ac.TpmBackend {
+	case tpmBackendTemplate:
+	case tpmBackendSoftware:
+		// the software TPM only reaches pcr values by extending the events that lead to them
+		for _, profile := range profiles {
+			if profile.eventLog == nil {
+				return nil, errors.Errorf("host profile %s needs a measurement profile for the software TPM backend", profile.name)
 			}
-			ctrlr.quoteParts.afterSignature = origQuoteBytes[endOfQuoteIdx+6+256:]
-
 		}
-		ctrlr.tpmQuote.Quote = ""
+	default:
+		return nil, errors.Errorf("invalid TpmBackend %q, should be template or software", ac.TpmBackend)
+	}
 
+	// hosts share the configured aik unless every host gets its own. Hosts with an ecc aik always have their own
+	aiks := make([]*hostAik, ac.Servers)
+	aikKeyTypes, err := hostAikKeyTypes(ac.Servers, ac.PerHostAik, ac.EccAikHostsPercentage, ac.EccAikCurve)
+	if err != nil {
+		return nil, err
 	}
-	if aikPemBytes, err := ioutil.ReadFile(ac.aikCertPath); err != nil {
-		return nil, errors.Wrap(err, "Could not open aik certificate file")
-	} else {
-		if ctrlr.aikCert, err = crypt.GetCertFromPem(aikPemBytes); err != nil {
-			return nil, errors.Wrap(err, "could not parse certificate from pem file")
+	if ac.PerHostAik || ac.EccAikHostsPercentage > 0 {
+		if aiks, err = loadNCreateHostAiks(ac.aikDirPath, ctrlr.hwUuidMap, aikKeyTypes, ac.pcaCertPath, ac.pcaKeyPath); err != nil {
+			return nil, errors.Wrap(err, "could not load the aiks of the hosts")
 		}
-		ctrlr.tpmQuote.Aik = base64.StdEncoding.EncodeToString(aikPemBytes)
 	}
-	if ctrlr.bindingKeyCert, err = ioutil.ReadFile(ac.bindingKeyPath); err != nil {
-		log.Error("Could not read binding key file - skipping")
+	for i := range aiks {
+		if aiks[i] == nil {
+			aiks[i] = ctrlr.aik
+		}
 	}
-	if hd, err := ioutil.ReadFile(ac.hostInfoPath); err != nil {
-		return nil, errors.Wrap(err, "Could not read host info file")
-	} else {
-		if err = json.Unmarshal(hd, &ctrlr.hostInfo); err != nil {
-			return nil, errors.Wrap(err, "Could not decode json for host info")
+	// hosts share the binding and signing keys as well unless every host gets its own. The shared keys are
+	// certified by the shared aik, so hosts with an aik of their own always get their own keys
+	keys := make([]hostKeys, ac.Servers)
+	keyAiks := hostKeyAiks(aiks, ctrlr.aik, ac.PerHostKeys)
+	uncertifiedHosts, keyHosts := 0, 0
+	for _, aik := range keyAiks {
+		if aik != nil && !certifiesHostKeys(aik) {
+			uncertifiedHosts++
+		} else if aik != nil {
+			keyHosts++
 		}
 	}
-	if pk, err := crypt.GetPrivateKeyFromPKCS8File(ac.aikKeyPath); err != nil {
-		return nil, errors.Wrap(err, "Could not get private key to sign quote")
-	} else {
-		var ok bool
-		if ctrlr.aikKey, ok = pk.(*rsa.PrivateKey); !ok {
-			return nil, errors.Wrap(err, "key is not of an rsa key. Need an rsa key for this operation")
+	if uncertifiedHosts > 0 {
+		log.Warnf("%d hosts with an ecc aik serve the shared binding and signing keys, which are not certified by "+
+			"their aik - HVS and KBS do not accept those keys from them", uncertifiedHosts)
+	}
+	if keyHosts > 0 {
+		if !ac.PerHostKeys {
+			log.Infof("%d hosts have an aik of their own and get binding and signing keys of their own", keyHosts)
+		}
+		if keys, err = loadNCreateHostKeys(ac.hostKeysDirPath, ctrlr.hwUuidMap, keyAiks, ac.pcaCertPath, ac.pcaKeyPath); err != nil {
+			return nil, errors.Wrap(err, "could not load the binding and signing keys of the hosts")
 		}
 	}
 
-	if ctrlr.hwUuidMap, err = loadNSaveHwUuidFile(ac.hwUuidMapPath, ac.PortStart, ac.Servers); err != nil {
-		return nil, errors.Wrap(err, "could not load the hw uuids")
+	if ctrlr.assetTags, err = loadAssetTagStore(ac.assetTagsPath); err != nil {
+		return nil, errors.Wrap(err, "could not load the deployed asset tags")
+	}
+	if ctrlr.manifests, err = loadManifestStore(ac.manifestsPath); err != nil {
+		return nil, errors.Wrap(err, "could not load the deployed manifests")
+	}
+
+	ctrlr.hosts = make([]*simulatedHost, ac.Servers)
+	for i := range ctrlr.hosts {
+		profile := profilesByName[hostProfileNames[i]]
+		// a tag that was deployed to the host replaces the tag of the captured quote
+		isTagProvisioned, assetTag := profile.tpmQuote.IsTagProvisioned, profile.tpmQuote.AssetTag
+		if tag, ok := ctrlr.assetTags.tag(ctrlr.hwUuidMap[i]); ok {
+			isTagProvisioned, assetTag = true, tag
+		}
+		if ctrlr.hosts[i], err = newSimulatedHost(aiks[i], profile, isTagProvisioned, assetTag); err != nil {
+			return nil, errors.Wrap(err, "could not initialize the simulated hosts")
+		}
+		ctrlr.hosts[i].keys = keys[i]
+		if ac.TpmBackend == tpmBackendSoftware {
+			tpm, err := newSoftwareTpm(aiks[i], profile.pcrBanks.hashAlgs(), profile.quoteTemplate.firmwareVersion)
+			if err != nil {
+				return nil, errors.Wrap(err, "could not create the TPM of a simulated host")
+			}
+			if err = ctrlr.hosts[i].powerOnTpm(tpm); err != nil {
+				return nil, errors.Wrap(err, "could not boot the TPM of a simulated host")
+			}
+		}
+	}
+	driftedHosts := driftedHostIndexes(ac.Servers, ac.PcrDriftHostsPercentage)
+	for _, idx := range driftedHosts {
+		if err = ctrlr.hosts[idx].measure(driftEvents(ac.PcrDriftPcrs, ctrlr.hwUuidMap[idx])); err != nil {
+			return nil, errors.Wrap(err, "could not drift the pcrs of a host")
+		}
+	}
+	if len(driftedHosts) > 0 {
+		log.Infof("%d hosts will report drifted values for pcrs %v", len(driftedHosts), ac.PcrDriftPcrs)
 	}
 
 	ctrlr.config = ac
+	for i := range ctrlr.hosts {
+		if err = ctrlr.restoreManifests(i); err != nil {
+			return nil, errors.Wrap(err, "could not restore the deployed manifests")
+		}
+	}
 	return ctrlr, nil
 }
 
@@ -304,57 +421,102 @@ func (ctrl controller) hello(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func (ctrl controller) aik(w http.ResponseWriter, _ *http.Request) {
-	_, _ = w.Write(ctrl.aikCert.Raw)
+func (ctrl controller) aikCert(w http.ResponseWriter, r *http.Request) {
+	host, err := ctrl.host(ctrl.hostIndex(r))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write(host.aik.cert.Raw)
 }
 
-func (ctrl controller) bindingKey(w http.ResponseWriter, _ *http.Request) {
-	_, _ = w.Write(ctrl.bindingKeyCert)
+func (ctrl controller) bindingKey(w http.ResponseWriter, r *http.Request) {
+	ctrl.writeHostKeyCert(w, r, hostKeyUsageBinding)
 }
 
-func (ctrl controller) getQuoteSignedWithNonce(nonce []byte, tagPresent bool, assetTag string) (*tamodel.TpmQuoteResponse, error) {
-	// make a copy of the the quote so that we leave the original untouched
-	hash := sha1.New()
-	hash.Write(nonce)
-	taNonce := hash.Sum(nil)
+func (ctrl controller) signingKey(w http.ResponseWriter, r *http.Request) {
+	ctrl.writeHostKeyCert(w, r, hostKeyUsageSigning)
+}
 
-	if tagPresent && assetTag != "" {
-		tag, err := base64.StdEncoding.DecodeString(assetTag)
-		if err != nil {
-			return nil, err
-		}
+func (ctrl controller) writeHostKeyCert(w http.ResponseWriter, r *http.Request, usage string) {
+	cert, err := ctrl.hostKeyCert(ctrl.hostIndex(r), usage)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write(cert)
+}
 
-		hash := sha1.New()
-		hash.Write(taNonce)
-		hash.Write(tag)
-		taNonce = hash.Sum(nil)
+// hostKeyCert returns the pem encoded certificate of the key of the host with the usage - the shared certificate
+// when the host does not have keys of its own
+func (ctrl controller) hostKeyCert(hostIdx int, usage string) ([]byte, error) {
+	host, err := ctrl.host(hostIdx)
+	if err != nil {
+		return nil, err
+	}
+	if host.keys != nil {
+		return host.keys[usage], nil
 	}
+	return ctrl.keys[usage], nil
+}
 
-	// stitch together the quote
-	fullQuoteLen := len(ctrl.quoteParts.infoPreNonceSha1) + len(taNonce) + len(ctrl.quoteParts.infoPostNonceSha1) + 256 + len(ctrl.quoteParts.afterSignature)
-	newQuote := make([]byte, len(ctrl.quoteParts.infoPreNonceSha1), fullQuoteLen)
-	copy(newQuote, ctrl.quoteParts.infoPreNonceSha1)
-	newQuote = append(newQuote, taNonce...)
-	newQuote = append(newQuote, ctrl.quoteParts.infoPostNonceSha1...)
+// host returns the state of the simulated host with the given index
+func (ctrl controller) host(hostIdx int) (*simulatedHost, error) {
+	if hostIdx < 0 || hostIdx >= len(ctrl.hosts) {
+		return nil, errors.Errorf("no simulated host with index %d", hostIdx)
+	}
+	return ctrl.hosts[hostIdx], nil
+}
 
-	// sign it... have the ignore the first 2 bytes as well as the last 6 bytes
-	// first 2 bytes are length of the quote - last 6 bytes are signature algorigthm,
-	// signature hash algorithm and signature size...
+func (ctrl controller) getQuoteSignedWithNonce(hostIdx int, req *tamodel.TpmQuoteRequest) (*tamodel.TpmQuoteResponse, error) {
+	host, err := ctrl.host(hostIdx)
+	if err != nil {
+		return nil, err
+	}
+	state := host.snapshot()
+	banks := state.pcrBanks
+	selection, selectedBanks, err := pcrSelectionForRequest(req.Pcrs, req.PcrBanks, banks)
+	if err != nil {
+		return nil, err
+	}
 
-	signHash := sha256.Sum256(newQuote[2 : len(newQuote)-6])
-	signature, err := rsa.SignPKCS1v15(rand.Reader, ctrl.aikKey, crypto.SHA256, signHash[:])
+	assetTag := ""
+	if state.isTagProvisioned {
+		assetTag = state.assetTag
+	}
+	taNonce, err := quoteNonce(req.Nonce, assetTag)
 	if err != nil {
-		return nil, errors.Wrap(err, "Could not sign the file")
+		return nil, err
 	}
-	// append the signature
-	newQuote = append(newQuote, signature...)
 
-	// append the rest of the original quote after the signature
-	newQuote = append(newQuote, ctrl.quoteParts.afterSignature...)
+	var newQuote []byte
+	signingStart := time.Now()
+	if host.tpm != nil {
+		newQuote, err = host.tpm.quote(selection, taNonce)
+	} else {
+		// the clock of the simulated TPM keeps running from the clock in the captured quote
+		tmpl := host.profile.quoteTemplate
+		tmpl.qualifiedSigner = host.aik.name
+		tmpl.clockInfo.Clock += uint64(time.Since(ctrl.startTime) / time.Millisecond)
+		newQuote, err = buildQuote(tmpl, selection, banks, taNonce, host.aik.key)
+	}
+	ctrl.metrics.recordSigning(aikKeyType(host.aik.key), time.Since(signingStart))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not build the quote")
+	}
+	ctrl.corruptSignature(hostIdx, newQuote)
 
 	// create a full quote from the saved contents... we do not want to overwrite the current on
-	fullQuote := *ctrl.tpmQuote
+	fullQuote := *host.profile.tpmQuote
 	fullQuote.Quote = base64.StdEncoding.EncodeToString(newQuote)
+	fullQuote.Aik = base64.StdEncoding.EncodeToString(host.aik.certPem)
+	fullQuote.SelectedPcrBanks.SelectedPcrBanks = selectedBanks
+	fullQuote.IsTagProvisioned = state.isTagProvisioned
+	fullQuote.AssetTag = state.assetTag
+	if state.eventLogJson != "" {
+		fullQuote.EventLog = state.eventLogJson
+	}
+	fullQuote.TcbMeasurements.TcbMeasurements = state.measurementXmls
 
 	// adding delay to simulate the TPM response time delay from an actual host
 	time.Sleep(time.Duration(ctrl.config.QuoteDelayMs) * time.Millisecond)
@@ -377,7 +539,7 @@ func (ctrl controller) quote(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
-	if qt, err := ctrl.getQuoteSignedWithNonce(req.Nonce, ctrl.tpmQuote.IsTagProvisioned, ctrl.tpmQuote.AssetTag); err != nil {
+	if qt, err := ctrl.getQuoteSignedWithNonce(ctrl.hostIndex(r), &req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		_, _ = w.Write([]byte("could not creating quote response error: " + err.Error()))
 	} else {
@@ -386,8 +548,12 @@ func (ctrl controller) quote(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (ctrl controller) info(w http.ResponseWriter, r *http.Request) {
-	hostData := ctrl.hostInfo
+// hostPort returns the port that the request was received on - or the port of the virtual host that the request
+// was routed to. The port identifies the simulated host
+func hostPort(r *http.Request) int {
+	if port, ok := r.Context().Value(virtualPortKey{}).(int); ok {
+		return port
+	}
 	hostParts := strings.Split(r.Host, ":")
 
 	port := 0
@@ -396,81 +562,214 @@ func (ctrl controller) info(w http.ResponseWriter, r *http.Request) {
 			port = res
 		}
 	}
-	hostData.BiosName = fmt.Sprintf("%s-%d", hostData.BiosName, port%ctrl.config.DistinctFlavors)
-	hostData.BiosVersion = fmt.Sprintf("%s-%d", hostData.BiosVersion, port%ctrl.config.DistinctFlavors)
-	hostData.OSVersion = fmt.Sprintf("%s-%d", hostData.OSVersion, port%ctrl.config.DistinctFlavors)
-	hostData.VMMName = fmt.Sprintf("%s-%d", hostData.VMMName, port%ctrl.config.DistinctFlavors)
-	hostData.VMMVersion = fmt.Sprintf("%s-%d", hostData.VMMVersion, port%ctrl.config.DistinctFlavors)
+	return port
+}
+
+func (ctrl controller) hostIndex(r *http.Request) int {
+	return hostPort(r) - ctrl.config.PortStart
+}
+
+// reachable wraps the handler of a Trust Agent endpoint so that requests to simulated hosts that have been
+// taken offline get their connection dropped without a response - as if the host was not on the network
+func (ctrl controller) reachable(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if host, err := ctrl.host(ctrl.hostIndex(r)); err == nil && host.snapshot().offline {
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					_ = conn.Close()
+					return
+				}
+			}
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// getHostInfo returns the host info that the simulated host reports over both HTTP and NATS. The platform
+// strings are suffixed so that the hosts of a profile are spread over DistinctFlavors flavors
+func (ctrl controller) getHostInfo(hostIdx int) (tamodel.HostInfo, error) {
+	host, err := ctrl.host(hostIdx)
+	if err != nil {
+		return tamodel.HostInfo{}, err
+	}
+	hostData := simulatedHostInfo(host.profile.hostInfo, ctrl.config.PortStart+hostIdx, ctrl.config.DistinctFlavors, ctrl.hwUuidMap[hostIdx])
+	host.snapshot().hostInfo.apply(&hostData)
+	return hostData, nil
+}
+
+// simulatedHostInfo returns the host info of the host on port before it is changed with the admin API
+func simulatedHostInfo(hostData tamodel.HostInfo, port, distinctFlavors int, hwUuid string) tamodel.HostInfo {
+	hostData.BiosName = fmt.Sprintf("%s-%d", hostData.BiosName, port%distinctFlavors)
+	hostData.BiosVersion = fmt.Sprintf("%s-%d", hostData.BiosVersion, port%distinctFlavors)
+	hostData.OSVersion = fmt.Sprintf("%s-%d", hostData.OSVersion, port%distinctFlavors)
+	hostData.VMMName = fmt.Sprintf("%s-%d", hostData.VMMName, port%distinctFlavors)
+	hostData.VMMVersion = fmt.Sprintf("%s-%d", hostData.VMMVersion, port%distinctFlavors)
 	hostData.HostName = fmt.Sprintf("%s-%d", hostData.HostName, port)
-	hostData.HardwareUUID = ctrl.hwUuidMap[port-ctrl.config.PortStart]
+	hostData.HardwareUUID = hwUuid
+	return hostData
+}
 
+func (ctrl controller) info(w http.ResponseWriter, r *http.Request) {
+	hostData, err := ctrl.getHostInfo(ctrl.hostIndex(r))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	jsonData, _ := json.Marshal(hostData)
 	_, _ = w.Write(jsonData)
 }
 
-func startServers(ac *AppConfig) (err error) {
+// trustAgentMux creates the handler of the Trust Agent endpoints of the simulated hosts - the host of a request
+// is found by the port it was sent to
+func (ctrl controller) trustAgentMux() *http.ServeMux {
+	// create `ServerMux`
+	mux := http.NewServeMux()
+	// create a default route handler
+	mux.HandleFunc("/", ctrl.reachable(ctrl.hello))
+	// requests that fail because of the fault profile of the host are recorded as errors
+	handle := func(pattern, request string, handler http.HandlerFunc) {
+		mux.HandleFunc(pattern, ctrl.reachable(ctrl.instrumented(request, ctrl.faulty(request, handler))))
+	}
+	handle("/v2/aik", metricsRequestAik, ctrl.aikCert)
+	handle("/v2/binding-key-certificate", metricsRequestBindingKey, ctrl.bindingKey)
+	handle("/v2/signing-key-certificate", metricsRequestSigningKey, ctrl.signingKey)
+	handle("/v2/tpm/quote", metricsRequestQuote, ctrl.quote)
+	handle("/v2/host", metricsRequestHostInfo, ctrl.info)
+	handle("/v2/tag", metricsRequestTag, ctrl.tag)
+	handle("/v2/deploy/manifest", metricsRequestManifest, ctrl.manifest)
+	handle("/v2/host/application-measurement", metricsRequestApplicationMeasurement, ctrl.measurement)
+	return mux
+}
+
+// startServers runs the simulated hosts until ctx is cancelled. In-flight requests are completed and NATS
+// connections are drained before it returns
+func startServers(ctx context.Context, ac *AppConfig) (err error) {
 
 	var ctrl *controller
 	if ctrl, err = NewController(ac); err != nil {
 		return errors.Wrap(err, "Could not initialize controller")
 	}
+	if ac.FaultProfileFile != "" {
+		if ctrl.faults, err = loadFaultProfiles(ac.FaultProfileFile, ac); err != nil {
+			return errors.Wrap(err, "Could not load fault profiles")
+		}
+	}
+	var servers []*http.Server
+	if ac.AdminApiPort != 0 {
+		server, err := newAdminApiServer(ac, *ctrl)
+		if err != nil {
+			return err
+		}
+		servers = append(servers, server)
+	}
+	if ac.MetricsPort != 0 {
+		servers = append(servers, newMetricsServer(ac, ctrl.metrics))
+	}
+	if ac.ScenarioFile != "" {
+		sc, err := loadScenario(ac.ScenarioFile, ac)
+		if err != nil {
+			return errors.Wrap(err, "Could not load scenario")
+		}
+		go ctrl.runScenario(ctx, sc, ctrl.startTime)
+	}
 
 	if ac.TaSimServiceMode == communicationModeHttp {
 		log.Info("Starting TA simulators in HTTP mode")
-		// create `ServerMux`
-		mux := http.NewServeMux()
-		// create a default route handler
-		mux.HandleFunc("/", ctrl.hello)
-		mux.HandleFunc("/v2/aik", ctrl.aik)
-		mux.HandleFunc("/v2/binding-key-certificate", ctrl.bindingKey)
-		mux.HandleFunc("/v2/tpm/quote", ctrl.quote)
-		mux.HandleFunc("/v2/host", ctrl.info)
+		mux := ctrl.trustAgentMux()
 
-		wg := new(sync.WaitGroup)
-		// add number of Servers to `wg` WaitGroup
-		wg.Add(ac.Servers)
-		for i := ac.PortStart; i < ac.PortStart+ac.Servers; i++ {
-			go func(port int) {
-				// create new server
-				server := http.Server{
+		if ac.VirtualHostMode != "" {
+			server, err := newVirtualHostServer(ac, mux)
+			if err != nil {
+				return err
+			}
+			servers = append(servers, server)
+		} else {
+			for port := ac.PortStart; port < ac.PortStart+ac.Servers; port++ {
+				server := &http.Server{
 					Addr:    fmt.Sprintf(":%v", port), // :{Port}
 					Handler: mux,
 				}
 				server.SetKeepAlivesEnabled(false)
-				log.Info(server.ListenAndServeTLS(ac.sslCertPath, ac.sslKeyPath))
-				wg.Done()
-			}(i)
+				servers = append(servers, server)
+			}
 		}
-		wg.Wait()
+		log.Infof("Started %d servers", ac.Servers)
+		runServers(ctx, servers, ac.sslCertPath, ac.sslKeyPath)
 	} else if ac.TaSimServiceMode == communicationModeOutbound {
 		log.Info("Starting TA simulators in outbound mode")
 		hwUuids, err := loadNSaveHwUuidFile(ac.hwUuidMapPath, ac.PortStart, ac.Servers)
 		if err != nil {
 			return err
 		}
-		wg := new(sync.WaitGroup)
-		// add number of Servers to `wg` WaitGroup
-		wg.Add(100)
+		pool, err := newNatsPool(ac, ctrl.metrics)
+		if err != nil {
+			return err
+		}
+		// hosts with a connection of their own have a subscriber each, shared connections answer for all hosts
+		subscribers := make([]*hvsSubscriberImpl, ac.Servers)
+		if len(pool) > 0 {
+			subscribers = make([]*hvsSubscriberImpl, len(pool))
+		}
+		hosts := make(map[string]int, ac.Servers)
 		for i := 0; i < ac.Servers; i++ {
+			hosts[hwUuids[i]] = i
+		}
+		wg := new(sync.WaitGroup)
+		wg.Add(len(subscribers))
+		for i := range subscribers {
 			go func(i int) {
-				// create new server
-				hvsSubscriber, err := NewHVSSubscriber(hwUuids[i], ac, *ctrl)
+				defer wg.Done()
+				var hvsSubscriber *hvsSubscriberImpl
+				var err error
+				if len(pool) > 0 {
+					hvsSubscriber, err = NewHVSSubscriber(fmt.Sprintf("ta-sim-shared-%d", i), hosts, ac, *ctrl, pool[i])
+				} else {
+					hvsSubscriber, err = NewHVSSubscriber(hwUuids[i], map[string]int{hwUuids[i]: i}, ac, *ctrl, nil)
+				}
 				if err != nil {
 					log.Errorf("Error getting a new HVS Subscriber: %s", err.Error())
+					return
 				}
-				err = hvsSubscriber.Start()
-				if err != nil {
+				if err = hvsSubscriber.Start(); err != nil {
 					log.Errorf("HVS subcriber Error : %s", err.Error())
+					return
 				}
-				wg.Done()
+				subscribers[i] = hvsSubscriber
 			}(i)
 		}
 		wg.Wait()
+		log.Infof("Started %d servers", ac.Servers)
+
+		// the admin api and metrics are served until the simulator is stopped, also when there are none
+		serversStopped := make(chan struct{})
+		go func() {
+			runServers(ctx, servers, ac.sslCertPath, ac.sslKeyPath)
+			close(serversStopped)
+		}()
+		<-ctx.Done()
+
+		wg.Add(len(subscribers))
+		for _, hvsSubscriber := range subscribers {
+			go func(hvsSubscriber *hvsSubscriberImpl) {
+				defer wg.Done()
+				if hvsSubscriber == nil {
+					return
+				}
+				if err := hvsSubscriber.Stop(); err != nil {
+					log.Errorf("Could not stop HVS subscriber %s: %s", hvsSubscriber.name, err.Error())
+				}
+			}(hvsSubscriber)
+		}
+		wg.Wait()
+		pool.close()
+		<-serversStopped
 	} else {
 		return errors.New("Invalid TA simulator service mode, should be either http or outboud")
 	}
 
-	log.Infof("Started %d servers", ac.Servers)
+	log.Infof("Stopped %d servers", ac.Servers)
 	return nil
 }
 
@@ -486,10 +785,14 @@ func getAuthToken(aasUrl, apiUser, apiPass string) (string, error) {
 		"username": apiUser,
 		"password": apiPass,
 	})
+	if err != nil {
+		return "", errors.Wrap(err, "could not marshal token request")
+	}
 	req, err := http.NewRequest("POST", aasUrl+"token", bytes.NewBuffer(reqBody))
 	if err != nil {
 		return "", errors.Wrap(err, "could not create token request")
 	}
+	req.Header.Set("Content-type", "application/json")
 	resp, err := client.Do(req)
 	if err != nil {
 		return "", errors.Wrap(err, "could not obtain token from aas")
@@ -499,59 +802,46 @@ func getAuthToken(aasUrl, apiUser, apiPass string) (string, error) {
 	if err != nil {
 		return "", errors.Wrap(err, "could not read token from aas")
 	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("aas returned %s for the token request of %s", resp.Status, apiUser)
+	}
 	return string(body), nil
 
 }
 
-func sendCreateHostRequest(hvsUrl, authtoken, ip, hw_uuid string, port int, client *http.Client, wg *sync.WaitGroup, serviceMode string) {
-	defer wg.Done()
-
-	connection_str := fmt.Sprintf("https://%s:%d", ip, port)
-	if serviceMode == communicationModeOutbound {
-		connection_str = fmt.Sprintf("intel:nats://%s", hw_uuid)
-	}
+func sendCreateHostRequest(hvsUrl, authtoken, connection_str, hw_uuid string, client *http.Client) error {
 
 	reqBody, err := json.Marshal(map[string]string{
-		"host_name":         "Go-TASim-" + hw_uuid,
+		"host_name":         hvsHostNamePrefix + hw_uuid,
 		"connection_string": connection_str,
 	})
 
 	req, err := http.NewRequest("POST", hvsUrl+"hosts", bytes.NewBuffer(reqBody))
 	if err != nil {
-		log.Error("could not create new request for creating host error : ", err)
-		return
+		return errors.Wrap(err, "could not create new request for creating host")
 	}
 	req.Header.Set("Authorization", "Bearer "+authtoken)
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-type", "application/json")
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Error("could not create new host"+fmt.Sprintf("https://%s:%d", ip, port), "error: ", err)
-		return
+		return errors.Wrap(err, "could not create new host "+connection_str)
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Error("could not response from from hvs create host"+fmt.Sprintf("https://%s:%d", ip, port), "error:", err)
-		return
+		return errors.Wrap(err, "could not read response from hvs create host "+connection_str)
 	}
 	if resp.StatusCode != 201 {
-		log.Error("Host not created. Request : ", string(reqBody), "Response Code: ", resp.Status, " Response Data: ", string(body))
-		return
+		return errors.Errorf("Host not created. Request : %s Response Code: %s Response Data: %s", string(reqBody), resp.Status, string(body))
 	}
 	log.Info("host created successfully. Response :" + string(body))
-
+	return nil
 }
 
-func sendCreateFlavorRequest(flavorParts []string, hvsUrl, authtoken, ip string, port int, client *http.Client, wg *sync.WaitGroup, hw_uuid, serviceMode string) {
-	defer wg.Done()
+func sendCreateFlavorRequest(flavorParts []string, hvsUrl, authtoken, connection_str string, client *http.Client) error {
 	log.Info("Preparing request to create flavors ")
 
-	connection_str := fmt.Sprintf("https://%s:%d", ip, port)
-	if serviceMode == communicationModeOutbound {
-		connection_str = fmt.Sprintf("intel:nats://%s", hw_uuid)
-	}
-
 	reqBody, err := json.Marshal(map[string]interface{}{
 		"connection_string":    connection_str,
 		"partial_flavor_types": flavorParts,
@@ -559,29 +849,62 @@ func sendCreateFlavorRequest(flavorParts []string, hvsUrl, authtoken, ip string,
 
 	req, err := http.NewRequest("POST", hvsUrl+"flavors", bytes.NewBuffer(reqBody))
 	if err != nil {
-		log.Error("could not create new request for creating flavors - error : ", err)
-		return
+		return errors.Wrap(err, "could not create new request for creating flavors")
 	}
 	req.Header.Set("Authorization", "Bearer "+authtoken)
 	req.Header.Set("Accept", "application/json")
 	req.Header.Set("Content-type", "application/json")
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Error("could not create new flavor", string(reqBody), "error: ", err)
-		return
+		return errors.Wrap(err, "could not create new flavor "+string(reqBody))
 	}
 	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Error("could not read response from from hvs create flavor ", reqBody, "error:", err)
-		return
+		return errors.Wrap(err, "could not read response from hvs create flavor "+string(reqBody))
 	}
 	if resp.StatusCode != 201 {
-		log.Error("flavor not created. Response Code: ", resp.Status, "Response Data: ", string(body))
-		return
+		return errors.Errorf("flavor not created. Response Code: %s Response Data: %s", resp.Status, string(body))
 	}
 	log.Info("flavor created successfully. Response :" + string(body))
+	return nil
+}
+
+// batchSleep waits between the batches of runBatched, tests replace it to see the batches
+var batchSleep = time.Sleep
 
+// runBatched sends a request for each of the first count simulated hosts. The requests are sent RequestVolume at a
+// time, and the next batch is started RequestVolumeDelayMs after the previous one and once it has completed.
+// Returns the number of requests that failed
+func runBatched(ac *AppConfig, count int, request func(idx int) error) int {
+	wg := new(sync.WaitGroup)
+	lock := sync.Mutex{}
+	failed := 0
+
+	batchStart := time.Now()
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(idx int) {
+			defer wg.Done()
+			if err := request(idx); err != nil {
+				log.Error(err)
+				lock.Lock()
+				failed++
+				lock.Unlock()
+			}
+		}(i)
+		if ac.RequestVolume > 0 && (i+1)%ac.RequestVolume == 0 && i+1 < count {
+			wg.Wait()
+			delay := time.Duration(ac.RequestVolumeDelayMs)*time.Millisecond - time.Since(batchStart)
+			if delay < 0 {
+				delay = 0
+			}
+			batchSleep(delay)
+			batchStart = time.Now()
+		}
+	}
+	wg.Wait()
+	return failed
 }
 
 func registerHosts(ac *AppConfig) error {
@@ -597,7 +920,6 @@ func registerHosts(ac *AppConfig) error {
 		return err
 	}
 
-	wg := new(sync.WaitGroup)
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
@@ -606,15 +928,12 @@ func registerHosts(ac *AppConfig) error {
 		Transport: tr,
 	}
 
-	for i := ac.PortStart; i < ac.PortStart+ac.Servers; i++ {
-		wg.Add(1)
-		go sendCreateHostRequest(ac.HvsApiUrl, authToken, ac.SimulatorIP, hwUuids[i-ac.PortStart], i, &client, wg, ac.TaSimServiceMode)
-		if (i+1)%ac.RequestVolume == 0 {
-			time.Sleep(time.Duration(ac.RequestVolumeDelayMs) * time.Millisecond)
-			wg.Wait()
-		}
+	failed := runBatched(ac, ac.Servers, func(idx int) error {
+		return sendCreateHostRequest(ac.HvsApiUrl, authToken, ac.connectionString(ac.PortStart+idx, hwUuids[idx]), hwUuids[idx], &client)
+	})
+	if failed > 0 {
+		return errors.Errorf("%d of %d hosts could not be created", failed, ac.Servers)
 	}
-	wg.Wait()
 	log.Info("Create Hosts completed")
 	return nil
 }
@@ -627,7 +946,6 @@ func createFlavors(ac *AppConfig) error {
 	}
 	log.Info("Authentication token obtained successfully")
 
-	wg := new(sync.WaitGroup)
 	trustedHosts := ac.Servers * ac.TrustedHostsPercentage / 100
 
 	allFlavors := []string{"PLATFORM", "OS", "HOST_UNIQUE"}
@@ -637,8 +955,6 @@ func createFlavors(ac *AppConfig) error {
 		return err
 	}
 
-	i := ac.PortStart
-
 	tr := &http.Transport{
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
@@ -647,24 +963,17 @@ func createFlavors(ac *AppConfig) error {
 		Transport: tr,
 	}
 
-	for ; i < ac.PortStart+trustedHosts && i < ac.PortStart+ac.DistinctFlavors; i++ {
-		wg.Add(1)
-		go sendCreateFlavorRequest(allFlavors, ac.HvsApiUrl, authToken, ac.SimulatorIP, i, &client, wg, hwUuids[i-ac.PortStart], ac.TaSimServiceMode)
-		if (i+1)%ac.RequestVolume == 0 {
-			time.Sleep(time.Duration(ac.RequestVolumeDelayMs) * time.Millisecond)
-			wg.Wait()
-		}
-	}
-
-	for ; i < ac.PortStart+trustedHosts; i++ {
-		wg.Add(1)
-		go sendCreateFlavorRequest(hostUniqueFlavors, ac.HvsApiUrl, authToken, ac.SimulatorIP, i, &client, wg, hwUuids[i-ac.PortStart], ac.TaSimServiceMode)
-		if (i+1)%ac.RequestVolume == 0 {
-			time.Sleep(time.Duration(ac.RequestVolumeDelayMs) * time.Millisecond)
-			wg.Wait()
+	// the first DistinctFlavors hosts get all the flavors, the other trusted hosts share their PLATFORM and OS flavors
+	failed := runBatched(ac, trustedHosts, func(idx int) error {
+		flavorParts := hostUniqueFlavors
+		if idx < ac.DistinctFlavors {
+			flavorParts = allFlavors
 		}
+		return sendCreateFlavorRequest(flavorParts, ac.HvsApiUrl, authToken, ac.connectionString(ac.PortStart+idx, hwUuids[idx]), &client)
+	})
+	if failed > 0 {
+		return errors.Errorf("flavors of %d of %d hosts could not be created", failed, trustedHosts)
 	}
-	wg.Wait()
 	log.Info("Create Flavors completed")
 	return nil
 
@@ -672,68 +981,34 @@ func createFlavors(ac *AppConfig) error {
 
 func createBindingKeyCertMain(ac *AppConfig) error {
 
-	if len(os.Args) < 4 {
-		return errors.New("can't parse cli flags")
-	}
-	configDir := filepath.Dir(ac.aikCertPath)
-	pcaKeyPath := filepath.Join(configDir, "pca-key")
-	pcaCertPath := filepath.Join(configDir, "pca-cert")
+	pcaKeyPath := ac.pcaKeyPath
+	pcaCertPath := ac.pcaCertPath
 	for _, arg := range os.Args[2:] {
-		split := strings.Split(arg, "=")
-		if len(split) < 2 {
+		split := strings.SplitN(arg, "=", 2)
+		switch flag := split[0]; {
+		case len(split) < 2:
+			return errors.New("invalid cli argument: " + arg)
+		case flag == "--pca-key":
+			pcaKeyPath = split[1]
+		case flag == "--pca-cert":
+			pcaCertPath = split[1]
+		default:
 			return errors.New("invalid cli argument: " + arg)
 		}
-		switch flag, val := split[0], split[1]; flag {
-		case "--pca-key":
-			pcaKeyPath = val
-		case "--pca-cert":
-			pcaCertPath = val
-		}
-	}
-	// load aik key
-	aikCert, aikPrivateKey, err := crypt.LoadX509CertAndPrivateKey(ac.aikCertPath, ac.aikKeyPath)
-	if err != nil {
-		return errors.Wrap(err, "failed to parse aik cert and key")
-	}
-
-	aikRSAKey, ok := aikPrivateKey.(*rsa.PrivateKey)
-	if !ok {
-		return errors.Wrap(err, "aik Private Key is not an expected RSA key ")
-	}
-
-	pcaCert, pcaPrivateKey, err := crypt.LoadX509CertAndPrivateKey(pcaCertPath, pcaKeyPath)
-	if err != nil {
-		return errors.Wrap(err, "failed to load Privacy CA cer and key")
-	}
-
-	if _, ok := pcaPrivateKey.(*rsa.PrivateKey); !ok {
-		return errors.Wrap(err, "Privacy Key is not of type RSA")
-	}
-
-	// generate binding key and cert
-	bindingKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return errors.Wrap(err, "failed to generate binding key:")
-	}
-
-	rki, err := generateRegisterKeyInfo(aikRSAKey, bindingKey, aikCert.Raw)
-	if err != nil {
-		return errors.Wrap(err, "failed to generate RegisterKeyInfo:")
 	}
-	bindingKeyCertBytes, err := createBindingKeyCert(pcaPrivateKey, pcaCert, "binding-key", rki)
+	// the binding and signing keys are certified by the aik that the hosts share
+	aik, err := loadHostAik(ac.aikCertPath, ac.aikKeyPath)
 	if err != nil {
-		return errors.Wrap(err, "failed to create BindingKeyCert:")
+		return errors.Wrap(err, "failed to load aik cert and key")
 	}
-	// save binding key and cert to file
-
-	bindingKeyByte, err := x509.MarshalPKCS8PrivateKey(bindingKey)
-	err = crypt.SavePrivateKeyAsPKCS8(bindingKeyByte, ac.bindingKeyPath+".key")
+	pcaCert, pcaPrivateKey, err := loadPrivacyCa(pcaCertPath, pcaKeyPath)
 	if err != nil {
-		return errors.Wrap(err, "failed to create binding key file")
+		return err
 	}
-	err = crypt.SavePemCert(bindingKeyCertBytes, ac.bindingKeyPath)
-	if err != nil {
-		return errors.Wrap(err, "failed to create binding key file")
+	for usage, certPath := range map[string]string{hostKeyUsageBinding: ac.bindingKeyPath, hostKeyUsageSigning: ac.signingKeyPath} {
+		if _, err = generateHostKey(pcaCert, pcaPrivateKey, aik, usage, certPath, certPath+".key"); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -759,7 +1034,7 @@ func main() {
 	switch action {
 
 	case "start":
-		if err := startServers(ac); err != nil {
+		if err := startServers(stopOnSignal(), ac); err != nil {
 			log.Error(err)
 			os.Exit(1)
 		}
@@ -777,7 +1052,7 @@ func main() {
 
 	case "create-binding-key-cert":
 		if err := createBindingKeyCertMain(ac); err != nil {
-			log.Error("could not create binding key cert : ", err)
+			log.Error("could not create binding and signing key certs : ", err)
 			os.Exit(1)
 		}
 
@@ -788,12 +1063,57 @@ func main() {
 			os.Exit(1)
 		}
 
+	case "capture-host-profile":
+		if err := captureHostProfileMain(ac); err != nil {
+			log.Error("could not capture host profile from TA : ", err)
+			os.Exit(1)
+		}
+
+	case "benchmark":
+		if err := benchmarkMain(ac); err != nil {
+			log.Error("could not run benchmark : ", err)
+			os.Exit(1)
+		}
+
+	case "delete-all-hosts":
+		if err := deleteHosts(ac); err != nil {
+			log.Error("could not delete hosts - Error : ", err)
+			os.Exit(1)
+		}
+
+	case "delete-all-flavors":
+		if err := deleteFlavors(ac); err != nil {
+			log.Error("could not delete flavors - Error : ", err)
+			os.Exit(1)
+		}
+
+	case "generate-flavors":
+		if err := generateFlavorsMain(ac); err != nil {
+			log.Error("could not generate flavors - Error : ", err)
+			os.Exit(1)
+		}
+
+	case "verify-quote":
+		if err := verifyQuoteMain(ac); err != nil {
+			log.Error("could not verify quote : ", err)
+			os.Exit(1)
+		}
+
 	case "help", "--help", "-h":
 		fmt.Printf("Go Trust Agent Simulator %s-%s\tBuilt %s", Version, GitHash, BuildDate)
 		fmt.Println("Usage")
-		fmt.Printf("\n\t %s start | create-all-flavors | create-all-hosts | create-binding-key-cert ", os.Args[0])
+		fmt.Printf("\n\t %s start | create-all-flavors | create-all-hosts | delete-all-hosts | delete-all-flavors | create-binding-key-cert | capture-host-profile | benchmark | verify-quote | generate-flavors ", os.Args[0])
 		fmt.Printf("\n\n\t create-binding-key-cert Usage")
-		fmt.Printf("\n\t %s create-binding-key-cert --pca-cert=<path_to_privacy_ca_cert> --pca-key=<path_to_privacy_ca_key>", os.Args[0])
+		fmt.Printf("\n\t %s create-binding-key-cert [--pca-cert=configuration/pca-cert] [--pca-key=configuration/pca-key]", os.Args[0])
+		fmt.Printf("\n\n\t capture-host-profile Usage")
+		fmt.Printf("\n\t %s capture-host-profile --ta-url=https://<ta_ip>:1443/v2 --name=<profile_name> [--pcr-banks=SHA1,SHA256,SHA384] [--force]", os.Args[0])
+		fmt.Printf("\n\t saves host_info.json and quote.xml with its event log - the aik and binding key of the Trust Agent are not captured, the hosts use the keys of the simulator")
+		fmt.Printf("\n\n\t benchmark Usage")
+		fmt.Printf("\n\t %s benchmark [--hosts=<n>] [--rate=<requests_per_second>] [--poll-interval=1s] [--timeout=5m] [--output=benchmark.json|benchmark.csv]", os.Args[0])
+		fmt.Printf("\n\n\t verify-quote Usage")
+		fmt.Printf("\n\t %s verify-quote --port=<simulated_host_port> [--pcrs=0,1,2] [--pcr-banks=SHA1,SHA256,SHA384]", os.Args[0])
+		fmt.Printf("\n\n\t generate-flavors Usage")
+		fmt.Printf("\n\t %s generate-flavors --flavor-templates=<flavor_template_dir> --signing-key=<flavor_signing_key> [--output=flavors.json]", os.Args[0])
 		fmt.Println("\n create-all-flavors and create-all-host require that start is called and process is running in background ")
 	}
 }
@@ -820,11 +1140,13 @@ func getHostData(ac *AppConfig) error {
 		return errors.Wrapf(err, "Error writing host-info to file %s", ac.hostInfoPath)
 	}
 
-	nonce := "+c4ZEmco4aj1G5dTXQvjIMGFd44="
-	pcrList := []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23}
+	nonce, err := captureNonce()
+	if err != nil {
+		return err
+	}
 	pcrbanks := []string{"SHA1", "SHA256", "SHA384"}
 
-	quote, err := taClient.GetTPMQuote(nonce, pcrList, pcrbanks)
+	quote, err := taClient.GetTPMQuote(nonce, capturePcrList, pcrbanks)
 	if err != nil {
 		return errors.Wrapf(err, "Error getting host-info from TA with HostId %s", ac.TaHostId)
 	}
@@ -5,27 +5,209 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
 )
 
-func TestTASimulator(t *testing.T) {
-	ac := AppConfig{
+// newClientTestConfig returns the configuration of a simulator whose client commands talk to the mock services
+func newClientTestConfig(t *testing.T, mock *mockServices, servers int) *AppConfig {
+	dir, err := ioutil.TempDir("", "ta-sim-client")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	ac := &AppConfig{
 		PortStart:              10000,
-		Servers:                3,
-		DistinctFlavors:        2,
-		QuoteDelayMs:           500,
+		Servers:                servers,
+		DistinctFlavors:        1,
 		RequestVolume:          50,
-		RequestVolumeDelayMs:   100,
-		TrustedHostsPercentage: 99,
-		sslCertPath:            "test/configuration/cert.pem",
-		sslKeyPath:             "test/configuration/key.pem",
-		tpmQuotePath:           "test/repository/quote.xml",
-		hostInfoPath:           "test/repository/host_info.json",
-		aikCertPath:            "test/configuration/aik.cert.pem",
-		aikKeyPath:             "test/configuration/aik.key.pem",
-		bindingKeyPath:         "test/repository/bk.cert",
-		hwUuidMapPath:          "test/configuration/hw_uuid_map.json",
-	}
-
-	startServers(&ac)
+		TrustedHostsPercentage: 100,
+		SimulatorIP:            "1.2.3.4",
+		TaSimServiceMode:       communicationModeHttp,
+		hwUuidMapPath:          filepath.Join(dir, "hw_uuid_map.json"),
+	}
+	mock.configure(ac)
+	return ac
+}
+
+func TestGetAuthToken(t *testing.T) {
+
+	mock := newMockServices(t)
+	ac := newClientTestConfig(t, mock, 1)
+	token, err := getAuthToken(ac.AasApiUrl, ac.ApiUserName, ac.ApiUserPassword)
+	if err != nil || token != mockToken {
+		t.Errorf("unexpected token %q: %v", token, err)
+	}
+	if _, err = getAuthToken(ac.AasApiUrl, ac.ApiUserName, "wrong"); err == nil {
+		t.Error("token request with wrong credentials did not fail")
+	}
+}
+
+func TestRegisterHosts(t *testing.T) {
+
+	mock := newMockServices(t)
+	ac := newClientTestConfig(t, mock, 5)
+	ac.RequestVolume, ac.RequestVolumeDelayMs = 2, 50
+	// the batches do not depend on the ports of the hosts
+	ac.PortStart = 10001
+	// the number of hosts that were registered when the delay between two batches starts
+	var batches []int
+	batchSleep = func(d time.Duration) {
+		if d > time.Duration(ac.RequestVolumeDelayMs)*time.Millisecond {
+			t.Errorf("batches were delayed for %s", d)
+		}
+		batches = append(batches, len(mock.recorded("POST", "hosts")))
+	}
+	defer func() { batchSleep = time.Sleep }()
+	if err := registerHosts(ac); err != nil {
+		t.Fatal("failed to register hosts:", err.Error())
+	}
+
+	hwUuids, err := loadNSaveHwUuidFile(ac.hwUuidMapPath, ac.PortStart, ac.Servers)
+	if err != nil {
+		t.Fatal("failed to load hw uuids:", err.Error())
+	}
+	requests := mock.recorded("POST", "hosts")
+	if len(requests) != ac.Servers {
+		t.Fatalf("%d create host requests were sent for %d hosts", len(requests), ac.Servers)
+	}
+	connectionStrings := make(map[string]string)
+	for _, req := range requests {
+		if req.Status != http.StatusCreated {
+			t.Errorf("create host request was rejected: %s", req.Invalid)
+		}
+		connectionStrings[req.Body["host_name"].(string)] = req.Body["connection_string"].(string)
+	}
+	for i, hwUuid := range hwUuids {
+		if cs := connectionStrings[hvsHostNamePrefix+hwUuid]; cs != fmt.Sprintf("https://1.2.3.4:%d", ac.PortStart+i) {
+			t.Errorf("host %d was registered with connection string %q", i, cs)
+		}
+	}
+
+	// the hosts are batched by RequestVolume - 0-1, 2-3 and 4 - and each batch has completed before the delay to the
+	// next one
+	if fmt.Sprint(batches) != "[2 4]" {
+		t.Errorf("hosts were registered in batches that end at %v instead of [2 4]", batches)
+	}
+
+	// hosts that are registered already are rejected by HVS and fail the command
+	if err = registerHosts(ac); err == nil || !strings.Contains(err.Error(), "5 of 5 hosts") {
+		t.Errorf("failed registrations were not reported: %v", err)
+	}
+}
+
+func TestCreateFlavors(t *testing.T) {
+
+	mock := newMockServices(t)
+	ac := newClientTestConfig(t, mock, 4)
+	ac.DistinctFlavors, ac.TrustedHostsPercentage = 2, 75
+	if err := createFlavors(ac); err != nil {
+		t.Fatal("failed to create flavors:", err.Error())
+	}
+
+	requests := mock.recorded("POST", "flavors")
+	if len(requests) != 3 {
+		t.Fatalf("%d create flavor requests were sent for 3 trusted hosts", len(requests))
+	}
+	parts := make(map[string]int)
+	for _, req := range requests {
+		if req.Status != http.StatusCreated {
+			t.Errorf("create flavor request was rejected: %s", req.Invalid)
+		}
+		parts[fmt.Sprint(req.Body["partial_flavor_types"])]++
+	}
+	if parts["[PLATFORM OS HOST_UNIQUE]"] != 2 || parts["[HOST_UNIQUE]"] != 1 {
+		t.Errorf("unexpected flavor parts: %v", parts)
+	}
+
+	// a failed token request stops the command before any flavor is created
+	mock.status = func(req *mockRequest) int {
+		if req.Path == "token" {
+			return http.StatusInternalServerError
+		}
+		return 0
+	}
+	if err := createFlavors(ac); err == nil || len(mock.recorded("POST", "flavors")) != 3 {
+		t.Error("flavors were created without a token")
+	}
+}
+
+func TestHostInfoIsTheSameOverHttpAndNats(t *testing.T) {
+	ctrl := newTestController(t, 4)
+	ctrl.config.DistinctFlavors = 2
+	ctrl.hosts[0].profile.hostInfo = tamodel.HostInfo{BiosName: "bios", BiosVersion: "1.0", OSVersion: "8.2", HostName: "host"}
+	ctrl.hosts[3].setHostInfo(hostInfoOverrides{BiosVersion: "2.0"})
+
+	// the same hosts answer over https and through the nats subscriber of a shared connection
+	server := httptest.NewTLSServer(ctrl.trustAgentMux())
+	defer server.Close()
+	natsServer := newMockNatsServer(t)
+	defer natsServer.close()
+	hosts := make(map[string]int)
+	for idx := range ctrl.hosts {
+		hosts[ctrl.hwUuidMap[idx]] = idx
+	}
+	conn := connectMockNats(t, natsServer)
+	defer conn.close()
+	subscriber, err := NewHVSSubscriber("ta-sim-shared-0", hosts, ctrl.config, *ctrl, conn)
+	if err != nil {
+		t.Fatal("failed to create subscriber:", err.Error())
+	}
+	if err = subscriber.Start(); err != nil {
+		t.Fatal("failed to start subscriber:", err.Error())
+	}
+	defer subscriber.Stop()
+	if err = conn.Flush(); err != nil {
+		t.Fatal("failed to flush subscriptions:", err.Error())
+	}
+	client := connectMockNats(t, natsServer)
+	defer client.Close()
+
+	for idx := range ctrl.hosts {
+		// the https handler finds the host by the port of the request, the nats subscriber by its hardware uuid
+		req, _ := http.NewRequest("GET", server.URL+"/v2/host", nil)
+		req.Host = fmt.Sprintf("localhost:%d", ctrl.config.PortStart+idx)
+		resp, err := server.Client().Do(req)
+		if err != nil {
+			t.Fatalf("host %d did not answer over https: %s", idx, err.Error())
+		}
+		var httpInfo tamodel.HostInfo
+		err = json.NewDecoder(resp.Body).Decode(&httpInfo)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal("failed to decode host info:", err.Error())
+		}
+
+		msg, err := client.Conn.Request(tamodel.CreateSubject(ctrl.hwUuidMap[idx], tamodel.NatsHostInfoRequest), nil, 5*time.Second)
+		if err != nil {
+			t.Fatalf("host %d did not answer over nats: %s", idx, err.Error())
+		}
+		var natsInfo tamodel.HostInfo
+		if err = json.Unmarshal(msg.Data, &natsInfo); err != nil {
+			t.Fatal("failed to decode host info:", err.Error())
+		}
+		if !reflect.DeepEqual(httpInfo, natsInfo) {
+			t.Errorf("host %d reports different host info over http and nats", idx)
+		}
+
+		expectedBiosVersion := fmt.Sprintf("1.0-%d", idx%2)
+		if idx == 3 {
+			expectedBiosVersion = "2.0"
+		}
+		if natsInfo.BiosName != fmt.Sprintf("bios-%d", idx%2) || natsInfo.BiosVersion != expectedBiosVersion ||
+			natsInfo.HostName != fmt.Sprintf("host-%d", 10000+idx) || natsInfo.HardwareUUID != ctrl.hwUuidMap[idx] {
+			t.Errorf("host info of host %d is not specific to the host: %+v", idx, natsInfo)
+		}
+	}
 }
@@ -0,0 +1,281 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// the simulator exposes metrics about the requests that it serves in the Prometheus text format on /metrics of
+// MetricsPort. The metrics are
+//
+//	ta_sim_requests_total                  counter   requests served - by request, transport and host
+//	ta_sim_request_errors_total            counter   requests that failed - by request, transport and host
+//	ta_sim_request_duration_seconds        histogram time to serve a request including QuoteDelayMs - by request and transport
+//	ta_sim_quote_signing_duration_seconds  histogram time to build and sign a quote - by aik key type
+//	ta_sim_nats_connections                gauge     NATS connections that are connected
+
+// requests and transports that metrics are recorded for
+const (
+	metricsRequestQuote                  = "quote"
+	metricsRequestHostInfo               = "host-info"
+	metricsRequestAik                    = "aik"
+	metricsRequestBindingKey             = "binding-key"
+	metricsRequestSigningKey             = "signing-key"
+	metricsRequestTag                    = "deploy-asset-tag"
+	metricsRequestManifest               = "deploy-manifest"
+	metricsRequestApplicationMeasurement = "application-measurement"
+
+	metricsTransportHttp = "http"
+	metricsTransportNats = "nats"
+)
+
+// upper bounds of the buckets of the histograms in seconds
+var metricsDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestMetricKey struct {
+	request   string
+	transport string
+	port      int
+}
+
+type histogram struct {
+	// count of observations per bucket - not cumulative
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	if h.buckets == nil {
+		h.buckets = make([]uint64, len(metricsDurationBuckets))
+	}
+	for i, bound := range metricsDurationBuckets {
+		if seconds <= bound {
+			h.buckets[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// simulatorMetrics collects the metrics of the simulator. A nil *simulatorMetrics does not record anything
+type simulatorMetrics struct {
+	lock             sync.Mutex
+	requests         map[requestMetricKey]uint64
+	errors           map[requestMetricKey]uint64
+	requestDurations map[requestMetricKey]*histogram
+	signingDurations map[string]*histogram
+	natsConnections  int64
+}
+
+func newSimulatorMetrics() *simulatorMetrics {
+	return &simulatorMetrics{
+		requests:         make(map[requestMetricKey]uint64),
+		errors:           make(map[requestMetricKey]uint64),
+		requestDurations: make(map[requestMetricKey]*histogram),
+		signingDurations: make(map[string]*histogram),
+	}
+}
+
+// recordRequest records a request to the host on port that was received at start
+func (m *simulatorMetrics) recordRequest(request, transport string, port int, start time.Time, failed bool) {
+	if m == nil {
+		return
+	}
+	elapsed := time.Since(start).Seconds()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	key := requestMetricKey{request: request, transport: transport, port: port}
+	m.requests[key]++
+	if failed {
+		m.errors[key]++
+	}
+	// durations are not kept per host - that would make the histograms too large for big fleets
+	key.port = 0
+	h, ok := m.requestDurations[key]
+	if !ok {
+		h = &histogram{}
+		m.requestDurations[key] = h
+	}
+	h.observe(elapsed)
+}
+
+// recordSigning records the time it took to build and sign a quote with an aik of the key type
+func (m *simulatorMetrics) recordSigning(keyType string, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	h, ok := m.signingDurations[keyType]
+	if !ok {
+		h = &histogram{}
+		m.signingDurations[keyType] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+func (m *simulatorMetrics) natsConnected() {
+	if m != nil {
+		atomic.AddInt64(&m.natsConnections, 1)
+	}
+}
+
+func (m *simulatorMetrics) natsDisconnected() {
+	if m != nil {
+		atomic.AddInt64(&m.natsConnections, -1)
+	}
+}
+
+func formatLabels(names []string, values ...string) string {
+	labels := make([]string, len(names))
+	for i, name := range names {
+		labels[i] = fmt.Sprintf("%s=%q", name, values[i])
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	// labels of the buckets are the labels of the histogram followed by the upper bound of the bucket
+	bucketLabels := strings.TrimSuffix(labels, "}")
+	if bucketLabels != "{" {
+		bucketLabels += ","
+	}
+	var cumulative uint64
+	for i, bound := range metricsDurationBuckets {
+		cumulative += h.buckets[i]
+		fmt.Fprintf(w, "%s_bucket%sle=\"%s\"} %d\n", name, bucketLabels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket%sle=\"+Inf\"} %d\n", name, bucketLabels, h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+}
+
+func sortedRequestKeys(m map[requestMetricKey]uint64) []requestMetricKey {
+	keys := make([]requestMetricKey, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].request != keys[j].request {
+			return keys[i].request < keys[j].request
+		}
+		if keys[i].transport != keys[j].transport {
+			return keys[i].transport < keys[j].transport
+		}
+		return keys[i].port < keys[j].port
+	})
+	return keys
+}
+
+// write writes the metrics in the Prometheus text exposition format
+func (m *simulatorMetrics) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	requestLabels := []string{"request", "transport", "host"}
+	for _, counter := range []struct {
+		name, help string
+		values     map[requestMetricKey]uint64
+	}{
+		{"ta_sim_requests_total", "Requests served by the simulated hosts.", m.requests},
+		{"ta_sim_request_errors_total", "Requests to the simulated hosts that failed.", m.errors},
+	} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", counter.name, counter.help, counter.name)
+		for _, key := range sortedRequestKeys(counter.values) {
+			fmt.Fprintf(w, "%s%s %d\n", counter.name, formatLabels(requestLabels, key.request, key.transport, strconv.Itoa(key.port)), counter.values[key])
+		}
+	}
+
+	name := "ta_sim_request_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time to serve a request including the simulated TPM delay.\n# TYPE %s histogram\n", name, name)
+	durationKeys := make(map[requestMetricKey]uint64)
+	for key := range m.requestDurations {
+		durationKeys[key] = 0
+	}
+	for _, key := range sortedRequestKeys(durationKeys) {
+		writeHistogram(w, name, formatLabels(requestLabels[:2], key.request, key.transport), m.requestDurations[key])
+	}
+
+	name = "ta_sim_quote_signing_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Time to build and sign a quote.\n# TYPE %s histogram\n", name, name)
+	keyTypes := make([]string, 0, len(m.signingDurations))
+	for keyType := range m.signingDurations {
+		keyTypes = append(keyTypes, keyType)
+	}
+	sort.Strings(keyTypes)
+	for _, keyType := range keyTypes {
+		writeHistogram(w, name, formatLabels([]string{"aik"}, keyType), m.signingDurations[keyType])
+	}
+
+	name = "ta_sim_nats_connections"
+	fmt.Fprintf(w, "# HELP %s NATS connections that are connected.\n# TYPE %s gauge\n", name, name)
+	fmt.Fprintf(w, "%s %d\n", name, atomic.LoadInt64(&m.natsConnections))
+}
+
+func (m *simulatorMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.write(w)
+}
+
+// statusRecorder keeps the status code that a handler responds with. Connections that are taken over by the
+// handler never get a response, so they count as failed
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	hijacked bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	rec.hijacked = true
+	return hj.Hijack()
+}
+
+// instrumented records the requests that the handler serves as the given request over http
+func (ctrl controller) instrumented(request string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+		ctrl.metrics.recordRequest(request, metricsTransportHttp, hostPort(r), start,
+			rec.hijacked || rec.status >= http.StatusBadRequest)
+	}
+}
+
+func newMetricsServer(ac *AppConfig, metrics *simulatorMetrics) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	log.Infof("Serving metrics on port %d", ac.MetricsPort)
+	return &http.Server{
+		Addr:    fmt.Sprintf(":%d", ac.MetricsPort),
+		Handler: mux,
+	}
+}
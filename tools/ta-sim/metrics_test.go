@@ -0,0 +1,60 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+func TestMetrics(t *testing.T) {
+
+	ctrl := newTestController(t, 2)
+	ctrl.metrics = newSimulatorMetrics()
+
+	info := ctrl.instrumented(metricsRequestHostInfo, ctrl.info)
+	tag := ctrl.instrumented(metricsRequestTag, ctrl.tag)
+	request := func(handler http.HandlerFunc, port int, body string) {
+		req := httptest.NewRequest("POST", fmt.Sprintf("https://localhost:%d/", port), bytes.NewBufferString(body))
+		handler(httptest.NewRecorder(), req)
+	}
+	request(info, 10000, "")
+	request(info, 10000, "")
+	request(info, 10001, "")
+	request(tag, 10001, "not json")
+	if _, err := ctrl.getQuoteSignedWithNonce(0, &tamodel.TpmQuoteRequest{Nonce: []byte("nonce")}); err != nil {
+		t.Fatal("failed to get quote:", err.Error())
+	}
+	ctrl.metrics.natsConnected()
+	ctrl.metrics.natsConnected()
+	ctrl.metrics.natsDisconnected()
+
+	rec := httptest.NewRecorder()
+	ctrl.metrics.ServeHTTP(rec, httptest.NewRequest("GET", "https://localhost:9998/metrics", nil))
+	exposition := rec.Body.String()
+	for _, line := range []string{
+		`ta_sim_requests_total{request="host-info",transport="http",host="10000"} 2`,
+		`ta_sim_requests_total{request="host-info",transport="http",host="10001"} 1`,
+		`ta_sim_requests_total{request="deploy-asset-tag",transport="http",host="10001"} 1`,
+		`ta_sim_request_errors_total{request="deploy-asset-tag",transport="http",host="10001"} 1`,
+		`ta_sim_request_duration_seconds_bucket{request="host-info",transport="http",le="+Inf"} 3`,
+		`ta_sim_request_duration_seconds_count{request="host-info",transport="http"} 3`,
+		`ta_sim_quote_signing_duration_seconds_count{aik="RSA"} 1`,
+		`ta_sim_nats_connections 1`,
+	} {
+		if !strings.Contains(exposition, line+"\n") {
+			t.Errorf("metrics do not contain %q", line)
+		}
+	}
+	if strings.Contains(exposition, `ta_sim_request_errors_total{request="host-info"`) {
+		t.Error("successful requests were counted as errors")
+	}
+}
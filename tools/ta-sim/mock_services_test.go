@@ -0,0 +1,230 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+)
+
+// mockServices stands in for the parts of AAS and HVS that the client commands of the simulator use: the AAS
+// token endpoint and the HVS hosts and flavors endpoints. Requests are recorded and their payloads validated, and
+// status can override the response to any request
+type mockServices struct {
+	server *httptest.Server
+
+	lock     sync.Mutex
+	requests []*mockRequest
+	// status returns the status code for the request - 0 for the default response
+	status func(req *mockRequest) int
+	// hosts by name and flavors by "<description key>=<value>"
+	hosts   map[string]uuid.UUID
+	flavors map[string][]uuid.UUID
+	deleted map[string]bool
+}
+
+type mockRequest struct {
+	Method string
+	// path relative to the api url of the service, e.g. "token" or "hosts/<id>"
+	Path  string
+	Query url.Values
+	Body  map[string]interface{}
+	Time  time.Time
+	// status that was returned and the reason when the payload was rejected
+	Status  int
+	Invalid string
+}
+
+const (
+	mockApiUser     = "admin"
+	mockApiPassword = "password"
+	mockToken       = "mock-token"
+	mockAasPrefix   = "/aas/v1/"
+	mockHvsPrefix   = "/hvs/v2/"
+)
+
+func newMockServices(t *testing.T) *mockServices {
+	mock := &mockServices{
+		hosts:   make(map[string]uuid.UUID),
+		flavors: make(map[string][]uuid.UUID),
+		deleted: make(map[string]bool),
+	}
+	mock.server = httptest.NewTLSServer(mock)
+	t.Cleanup(mock.server.Close)
+	return mock
+}
+
+// configure points the api urls and the credentials of the configuration to the mock services
+func (mock *mockServices) configure(ac *AppConfig) {
+	ac.AasApiUrl = mock.server.URL + mockAasPrefix
+	ac.HvsApiUrl = mock.server.URL + mockHvsPrefix
+	ac.ApiUserName = mockApiUser
+	ac.ApiUserPassword = mockApiPassword
+}
+
+func (mock *mockServices) api() hvsApi {
+	return hvsApi{hvsUrl: mock.server.URL + mockHvsPrefix, authToken: mockToken, client: mock.server.Client()}
+}
+
+// recorded returns the recorded requests with the method to the path
+func (mock *mockServices) recorded(method, path string) []*mockRequest {
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	requests := make([]*mockRequest, 0)
+	for _, req := range mock.requests {
+		if req.Method == method && req.Path == path {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+func (mock *mockServices) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := &mockRequest{Method: r.Method, Query: r.URL.Query(), Time: time.Now()}
+	if body, _ := ioutil.ReadAll(r.Body); len(body) > 0 {
+		if err := json.Unmarshal(body, &req.Body); err != nil {
+			req.Invalid = "body is not a json object"
+		}
+	}
+
+	mock.lock.Lock()
+	defer mock.lock.Unlock()
+	mock.requests = append(mock.requests, req)
+
+	var response interface{}
+	switch {
+	case strings.HasPrefix(r.URL.Path, mockAasPrefix):
+		req.Path = strings.TrimPrefix(r.URL.Path, mockAasPrefix)
+		response = mock.aas(req)
+	case strings.HasPrefix(r.URL.Path, mockHvsPrefix):
+		req.Path = strings.TrimPrefix(r.URL.Path, mockHvsPrefix)
+		if r.Header.Get("Authorization") != "Bearer "+mockToken {
+			req.Status = http.StatusUnauthorized
+		} else {
+			response = mock.hvs(req)
+		}
+	default:
+		req.Path, req.Status = r.URL.Path, http.StatusNotFound
+	}
+	if req.Invalid != "" {
+		req.Status = http.StatusBadRequest
+	}
+	if mock.status != nil {
+		if status := mock.status(req); status != 0 {
+			req.Status, response = status, nil
+		}
+	}
+
+	w.WriteHeader(req.Status)
+	switch response := response.(type) {
+	case nil:
+	case string:
+		_, _ = w.Write([]byte(response))
+	default:
+		_ = json.NewEncoder(w).Encode(response)
+	}
+}
+
+// field returns the string field of the request body and marks the request as invalid when it is missing
+func (req *mockRequest) field(name string) string {
+	value, _ := req.Body[name].(string)
+	if value == "" && req.Invalid == "" {
+		req.Invalid = name + " is required"
+	}
+	return value
+}
+
+func (mock *mockServices) aas(req *mockRequest) interface{} {
+	if req.Method != "POST" || req.Path != "token" {
+		req.Status = http.StatusNotFound
+		return nil
+	}
+	if req.field("username") != mockApiUser || req.field("password") != mockApiPassword {
+		req.Status = http.StatusUnauthorized
+		return nil
+	}
+	req.Status = http.StatusOK
+	return mockToken
+}
+
+func (mock *mockServices) hvs(req *mockRequest) interface{} {
+	resource, id := req.Path, ""
+	if i := strings.Index(req.Path, "/"); i >= 0 {
+		resource, id = req.Path[:i], req.Path[i+1:]
+	}
+	if resource != "hosts" && resource != "flavors" {
+		req.Status = http.StatusNotFound
+		return nil
+	}
+
+	switch {
+	case req.Method == "DELETE" && id != "":
+		if mock.deleted[id] {
+			req.Status = http.StatusNotFound
+		} else {
+			mock.deleted[id], req.Status = true, http.StatusNoContent
+		}
+		return nil
+
+	case req.Method == "POST" && resource == "hosts":
+		name, connectionString := req.field("host_name"), req.field("connection_string")
+		if _, ok := mock.hosts[name]; ok && req.Invalid == "" {
+			req.Invalid = "host with the same name already exists"
+		}
+		if req.Invalid != "" {
+			return nil
+		}
+		mock.hosts[name], req.Status = uuid.New(), http.StatusCreated
+		return hvs.Host{Id: mock.hosts[name], HostName: name, ConnectionString: connectionString}
+
+	case req.Method == "POST" && resource == "flavors":
+		req.field("connection_string")
+		parts, _ := req.Body["partial_flavor_types"].([]interface{})
+		if len(parts) == 0 && req.Invalid == "" {
+			req.Invalid = "partial_flavor_types is required"
+		}
+		for _, part := range parts {
+			var name hvs.FlavorPartName
+			if part, _ := part.(string); name.Parse(part) != nil && req.Invalid == "" {
+				req.Invalid = "invalid flavor part"
+			}
+		}
+		if req.Invalid != "" {
+			return nil
+		}
+		req.Status = http.StatusCreated
+		return hvs.SignedFlavorCollection{SignedFlavors: []hvs.SignedFlavor{}}
+
+	case req.Method == "GET" && resource == "hosts" && id == "":
+		hosts := hvs.HostCollection{Hosts: []*hvs.Host{}}
+		if id, ok := mock.hosts[req.Query.Get("nameEqualTo")]; ok && !mock.deleted[id.String()] {
+			hosts.Hosts = append(hosts.Hosts, &hvs.Host{Id: id})
+		}
+		req.Status = http.StatusOK
+		return hosts
+
+	case req.Method == "GET" && resource == "flavors" && id == "":
+		flavors := hvs.SignedFlavorCollection{SignedFlavors: []hvs.SignedFlavor{}}
+		for _, id := range mock.flavors[req.Query.Get("key")+"="+req.Query.Get("value")] {
+			if !mock.deleted[id.String()] {
+				flavors.SignedFlavors = append(flavors.SignedFlavors, hvs.SignedFlavor{Flavor: hvs.Flavor{Meta: hvs.Meta{ID: id}}})
+			}
+		}
+		req.Status = http.StatusOK
+		return flavors
+	}
+	req.Status = http.StatusMethodNotAllowed
+	return nil
+}
@@ -0,0 +1,133 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// natsConn is a connection to the NATS servers of HVS. It is used by a single simulated host or shared by many
+// of them when NatsConnections is set
+type natsConn struct {
+	*nats.EncodedConn
+	// closed when the connection is closed for good
+	closed chan struct{}
+	// queue group that the hosts on the shared connections of the simulator subscribe in, so that a request is
+	// received by one of the connections
+	queue string
+}
+
+// connectNats connects to the NATS servers with the credentials of the simulator. The connection keeps
+// reconnecting until it is closed
+func connectNats(name string, cfg *AppConfig, metrics *simulatorMetrics) (*natsConn, error) {
+	tlsConfig := tls.Config{
+		InsecureSkipVerify: true,
+	}
+	closed := make(chan struct{})
+
+	conn, err := nats.Connect(strings.Join(cfg.NatsServers, ","),
+		nats.Name(name),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+		nats.ReconnectWait(5*time.Second),
+		nats.Timeout(10*time.Second),
+		nats.Secure(&tlsConfig),
+		nats.UserCredentials(cfg.natsTaSimCredentialsPath),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			metrics.natsDisconnected()
+			log.Infof("NATS: Client %s disconnected: %v", name, err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			// also called on the first connect when the servers could not be reached by nats.Connect
+			metrics.natsConnected()
+			log.Infof("NATS: Client %s reconnected", name)
+		}),
+		nats.ClosedHandler(func(_ *nats.Conn) {
+			log.Infof("NATS: Client %s closed", name)
+			close(closed)
+		}),
+		nats.ErrorHandler(func(nc *nats.Conn, s *nats.Subscription, err error) {
+			if s != nil {
+				log.Errorf("ERROR: NATS: Could not process subscription for subject %q: %v", s.Subject, err)
+			} else {
+				log.Errorf("ERROR: NATS: %v", err)
+			}
+		}))
+
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to connect to url %q", cfg.NatsServers)
+	}
+	if conn.IsConnected() {
+		metrics.natsConnected()
+	}
+
+	encodedConn, err := nats.NewEncodedConn(conn, "json")
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrap(err, "Error while wrapping an existing NATS connection to utilize the encoded connection")
+	}
+	log.Infof("Successfully connected to %q", cfg.NatsServers)
+	return &natsConn{EncodedConn: encodedConn, closed: closed}, nil
+}
+
+// close drains the connection - requests that have been received are answered before the connection is
+// closed. Returns when the connection is closed
+func (conn *natsConn) close() error {
+	// a connection that is reconnecting cannot be drained and is closed right away
+	if err := conn.Drain(); err != nil && err != nats.ErrConnectionReconnecting && err != nats.ErrConnectionClosed {
+		conn.Close()
+		<-conn.closed
+		return errors.Wrap(err, "Could not drain the connection")
+	}
+	<-conn.closed
+	return nil
+}
+
+// natsPool is the connections that the simulated hosts share. Each connection subscribes for all of the hosts and
+// a request is answered by one of them. An empty pool means that every host has its own connection
+type natsPool []*natsConn
+
+func newNatsPool(cfg *AppConfig, metrics *simulatorMetrics) (natsPool, error) {
+	if cfg.NatsConnections <= 0 {
+		return nil, nil
+	}
+	log.Infof("Sharing %d NATS connections between %d hosts", cfg.NatsConnections, cfg.Servers)
+	pool := make(natsPool, cfg.NatsConnections)
+	// simulators that share the NATS servers each receive the requests to their hosts
+	queue := "ta-sim-" + uuid.New().String()
+	for i := range pool {
+		conn, err := connectNats(fmt.Sprintf("ta-sim-shared-%d", i), cfg, metrics)
+		if err != nil {
+			pool[:i].close()
+			return nil, err
+		}
+		conn.queue = queue
+		pool[i] = conn
+	}
+	return pool, nil
+}
+
+func (pool natsPool) close() {
+	wg := new(sync.WaitGroup)
+	wg.Add(len(pool))
+	for i, conn := range pool {
+		go func(i int, conn *natsConn) {
+			defer wg.Done()
+			if err := conn.close(); err != nil {
+				log.Errorf("Could not close shared NATS connection %d: %s", i, err.Error())
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,40 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"fmt"
+)
+
+// driftEvents returns the events that make the given pcrs of a host drift. The measurements are derived
+// from seed so that every drifted host reports different pcr values
+func driftEvents(pcrs []int, seed string) []measurementEvent {
+	events := make([]measurementEvent, 0, len(pcrs))
+	for _, pcr := range pcrs {
+		events = append(events, newEvent(pcr, evEventTag, "EV_EVENT_TAG", "ta-sim-drift",
+			fmt.Sprintf("ta-sim-drift-%s-%d", seed, pcr)))
+	}
+	return events
+}
+
+func containsPcr(pcrs []int, pcr int) bool {
+	for _, p := range pcrs {
+		if p == pcr {
+			return true
+		}
+	}
+	return false
+}
+
+// driftedHostIndexes returns the index of the hosts that report drifted pcr values. These are taken from the
+// end of the port range so that they do not overlap with the hosts that flavors are created from
+func driftedHostIndexes(servers, driftPercentage int) []int {
+	drifted := servers * driftPercentage / 100
+	indexes := make([]int, 0, drifted)
+	for i := servers - drifted; i < servers; i++ {
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func driftHost(t *testing.T, banks pcrBanks, seed string) pcrBanks {
+	host, err := newSimulatedHost(nil, &hostProfile{pcrBanks: banks}, false, "")
+	if err != nil {
+		t.Fatal("failed to create simulated host:", err.Error())
+	}
+	if err = host.measure(driftEvents([]int{0}, seed)); err != nil {
+		t.Fatal("failed to drift pcrs:", err.Error())
+	}
+	return host.snapshot().pcrBanks
+}
+
+func TestDriftPcrs(t *testing.T) {
+
+	_, _, banks, err := parseQuote(loadTestQuote(t))
+	if err != nil {
+		t.Fatal("failed to parse quote:", err.Error())
+	}
+	drifted := driftHost(t, banks, "00000000-0000-0000-0000-000000000000")
+
+	for hashAlg, bank := range banks {
+		if bytes.Equal(drifted[hashAlg][0], bank[0]) {
+			t.Errorf("pcr 0 of bank 0x%04x was not drifted", hashAlg)
+		}
+		for pcr := 1; pcr < pcrCount; pcr++ {
+			if !bytes.Equal(drifted[hashAlg][pcr], bank[pcr]) {
+				t.Errorf("pcr %d of bank 0x%04x was changed", pcr, hashAlg)
+			}
+		}
+	}
+
+	other := driftHost(t, banks, "11111111-1111-1111-1111-111111111111")
+	if bytes.Equal(drifted[tpmAlgSha256][0], other[tpmAlgSha256][0]) {
+		t.Error("hosts with different seeds drifted to the same pcr value")
+	}
+}
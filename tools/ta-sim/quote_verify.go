@@ -0,0 +1,368 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	client "github.com/intel-secl/intel-secl/v4/pkg/clients/ta"
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+	"github.com/pkg/errors"
+)
+
+// verify-quote requests a quote from a running simulated host and checks it the way HVS does, but strictly: every
+// size field has to match the bytes that follow it, so a quote that was spliced at the wrong offset fails with the
+// field that does not line up instead of a signature or pcr mismatch further down in HVS. The quote is requested
+// over NATS when the simulator runs in outbound mode and over https otherwise
+
+// verifiedQuote is the content of a quote that was verified with verifyQuote
+type verifiedQuote struct {
+	quoteTemplate
+	extraData  []byte
+	selection  []pcrBankSelection
+	pcrDigest  []byte
+	sigAlg     uint16
+	sigHashAlg uint16
+	pcrValues  pcrBanks
+}
+
+// readTpm2bField reads a TPM2B and names the field when it does not fit into the rest of the quote
+func readTpm2bField(r *bytes.Reader, field string) ([]byte, error) {
+	buf, err := readTpm2b(r)
+	if err != nil {
+		return nil, errors.Errorf("%s does not fit into the quote - %d bytes left", field, r.Len())
+	}
+	return buf, nil
+}
+
+// verifyQuote parses the quote, checks its signature with the aik and checks that the quote was created for
+// extraData. The pcr digest of the quote has to match the pcr values that follow the signature
+func verifyQuote(quote []byte, aik crypto.PublicKey, extraData []byte) (*verifiedQuote, error) {
+	verified := &verifiedQuote{pcrValues: make(pcrBanks)}
+	r := bytes.NewReader(quote)
+
+	attest, err := readTpm2bField(r, "TPMS_ATTEST")
+	if err != nil {
+		return nil, err
+	}
+	ar := bytes.NewReader(attest)
+	var magic uint32
+	var attestType uint16
+	if binary.Read(ar, binary.BigEndian, &magic) != nil || binary.Read(ar, binary.BigEndian, &attestType) != nil {
+		return nil, errors.New("TPMS_ATTEST is too short")
+	}
+	if magic != tpmGeneratedValue {
+		return nil, errors.Errorf("magic of TPMS_ATTEST is 0x%08x instead of TPM_GENERATED_VALUE", magic)
+	}
+	if attestType != tpmStAttestQuote {
+		return nil, errors.Errorf("type of TPMS_ATTEST is 0x%04x instead of TPM_ST_ATTEST_QUOTE", attestType)
+	}
+	if verified.qualifiedSigner, err = readTpm2bField(ar, "qualifiedSigner"); err != nil {
+		return nil, err
+	}
+	if verified.extraData, err = readTpm2bField(ar, "extraData"); err != nil {
+		return nil, err
+	}
+	if binary.Read(ar, binary.BigEndian, &verified.clockInfo) != nil {
+		return nil, errors.New("clockInfo does not fit into TPMS_ATTEST")
+	}
+	if binary.Read(ar, binary.BigEndian, &verified.firmwareVersion) != nil {
+		return nil, errors.New("firmwareVersion does not fit into TPMS_ATTEST")
+	}
+	var count uint32
+	if binary.Read(ar, binary.BigEndian, &count) != nil {
+		return nil, errors.New("TPML_PCR_SELECTION does not fit into TPMS_ATTEST")
+	}
+	if count > uint32(len(pcrBankHash)) {
+		return nil, errors.Errorf("TPML_PCR_SELECTION has %d banks", count)
+	}
+	for i := uint32(0); i < count; i++ {
+		var sel pcrBankSelection
+		var size byte
+		if binary.Read(ar, binary.BigEndian, &sel.hashAlg) != nil || binary.Read(ar, binary.BigEndian, &size) != nil {
+			return nil, errors.Errorf("TPMS_PCR_SELECTION %d does not fit into TPMS_ATTEST", i)
+		}
+		sel.pcrSelected = make([]byte, size)
+		if n, _ := ar.Read(sel.pcrSelected); n != int(size) {
+			return nil, errors.Errorf("pcrSelect of TPMS_PCR_SELECTION %d does not fit into TPMS_ATTEST", i)
+		}
+		if _, ok := pcrBankHash[sel.hashAlg]; !ok {
+			return nil, errors.Errorf("pcr bank with algorithm id 0x%04x is not supported", sel.hashAlg)
+		}
+		verified.selection = append(verified.selection, sel)
+	}
+	if verified.pcrDigest, err = readTpm2bField(ar, "pcrDigest"); err != nil {
+		return nil, err
+	}
+	if ar.Len() != 0 {
+		return nil, errors.Errorf("TPMS_ATTEST has %d bytes after the pcr digest", ar.Len())
+	}
+
+	// TPMT_SIGNATURE
+	if binary.Read(r, binary.BigEndian, &verified.sigAlg) != nil || binary.Read(r, binary.BigEndian, &verified.sigHashAlg) != nil {
+		return nil, errors.New("TPMT_SIGNATURE does not fit into the quote")
+	}
+	signHash, ok := pcrBankHash[verified.sigHashAlg]
+	if !ok {
+		return nil, errors.Errorf("signature hash algorithm 0x%04x is not supported", verified.sigHashAlg)
+	}
+	h := signHash.New()
+	h.Write(attest)
+	digest := h.Sum(nil)
+	switch verified.sigAlg {
+	case tpmAlgRsassa:
+		signature, err := readTpm2bField(r, "signature")
+		if err != nil {
+			return nil, err
+		}
+		key, ok := aik.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("quote has an RSASSA signature but the aik is not an rsa key")
+		}
+		if err = rsa.VerifyPKCS1v15(key, signHash, digest, signature); err != nil {
+			return nil, errors.Wrap(err, "signature of the quote does not verify with the aik")
+		}
+	case tpmAlgEcdsa:
+		sigR, err := readTpm2bField(r, "signatureR")
+		if err != nil {
+			return nil, err
+		}
+		sigS, err := readTpm2bField(r, "signatureS")
+		if err != nil {
+			return nil, err
+		}
+		key, ok := aik.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("quote has an ECDSA signature but the aik is not an ecc key")
+		}
+		if !ecdsa.Verify(key, digest, new(big.Int).SetBytes(sigR), new(big.Int).SetBytes(sigS)) {
+			return nil, errors.New("signature of the quote does not verify with the aik")
+		}
+	default:
+		return nil, errors.Errorf("signature algorithm 0x%04x is not supported", verified.sigAlg)
+	}
+
+	// the values of the selected pcrs fill the rest of the quote
+	pcrValues := quote[len(quote)-r.Len():]
+	expected := 0
+	for _, sel := range verified.selection {
+		for pcr := 0; pcr < 8*len(sel.pcrSelected); pcr++ {
+			if sel.isSelected(pcr) {
+				expected += pcrBankHash[sel.hashAlg].Size()
+			}
+		}
+	}
+	if len(pcrValues) != expected {
+		return nil, errors.Errorf("pcr selection needs %d bytes of pcr values, the quote has %d", expected, len(pcrValues))
+	}
+	h = signHash.New()
+	h.Write(pcrValues)
+	if !bytes.Equal(h.Sum(nil), verified.pcrDigest) {
+		return nil, errors.New("pcr digest of the quote does not match the pcr values")
+	}
+	for _, sel := range verified.selection {
+		size := pcrBankHash[sel.hashAlg].Size()
+		verified.pcrValues[sel.hashAlg] = make([][]byte, 8*len(sel.pcrSelected))
+		for pcr := range verified.pcrValues[sel.hashAlg] {
+			if sel.isSelected(pcr) {
+				verified.pcrValues[sel.hashAlg][pcr], pcrValues = pcrValues[:size], pcrValues[size:]
+			}
+		}
+	}
+
+	if !bytes.Equal(verified.extraData, extraData) {
+		return nil, errors.Errorf("extraData of the quote is %x instead of %x", verified.extraData, extraData)
+	}
+	return verified, nil
+}
+
+// verifyQuoteResponse verifies the quote of a quote response for the nonce of the request. The quote has to be
+// signed by the aik that the host reports, and the aik of the response has to be that aik
+func verifyQuoteResponse(resp *tamodel.TpmQuoteResponse, aikCert *x509.Certificate, nonce []byte) (*verifiedQuote, error) {
+	if aikPem, err := base64.StdEncoding.DecodeString(resp.Aik); err != nil {
+		return nil, errors.Wrap(err, "aik of the quote response is not base64 encoded")
+	} else if block, _ := pem.Decode(aikPem); block == nil || !bytes.Equal(block.Bytes, aikCert.Raw) {
+		return nil, errors.New("aik of the quote response is not the aik of the host")
+	}
+	quote, err := base64.StdEncoding.DecodeString(resp.Quote)
+	if err != nil {
+		return nil, errors.Wrap(err, "quote is not base64 encoded")
+	}
+	assetTag := ""
+	if resp.IsTagProvisioned {
+		assetTag = resp.AssetTag
+	}
+	extraData, err := quoteNonce(nonce, assetTag)
+	if err != nil {
+		return nil, err
+	}
+	return verifyQuote(quote, aikCert.PublicKey, extraData)
+}
+
+// print writes the content of the verified quote
+func (verified *verifiedQuote) print() {
+	fmt.Printf("qualified signer : %x\n", verified.qualifiedSigner)
+	fmt.Printf("extra data       : %x\n", verified.extraData)
+	fmt.Printf("clock            : %d (reset %d, restart %d, safe %d)\n", verified.clockInfo.Clock,
+		verified.clockInfo.ResetCount, verified.clockInfo.RestartCount, verified.clockInfo.Safe)
+	fmt.Printf("firmware version : %016x\n", verified.firmwareVersion)
+	fmt.Printf("signature        : %s with %s\n", map[uint16]string{tpmAlgRsassa: "RSASSA", tpmAlgEcdsa: "ECDSA"}[verified.sigAlg],
+		pcrBankName(verified.sigHashAlg))
+	for _, sel := range verified.selection {
+		pcrs := make([]string, 0)
+		for pcr := 0; pcr < 8*len(sel.pcrSelected); pcr++ {
+			if sel.isSelected(pcr) {
+				pcrs = append(pcrs, strconv.Itoa(pcr))
+			}
+		}
+		fmt.Printf("pcr selection    : %s [%s]\n", pcrBankName(sel.hashAlg), strings.Join(pcrs, ","))
+	}
+	fmt.Printf("pcr digest       : %x\n", verified.pcrDigest)
+}
+
+// requestQuoteOverHttps requests the quote and the aik of the simulated host on port like HVS does over https
+func requestQuoteOverHttps(ac *AppConfig, port int, hwUuid string, req tamodel.TpmQuoteRequest) (*tamodel.TpmQuoteResponse, []byte, error) {
+	httpClient := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	baseUrl := ac.connectionString(port, hwUuid)
+	if ac.SimulatorIP == "" && ac.VirtualHostMode == "" {
+		baseUrl = fmt.Sprintf("https://localhost:%d", port)
+	}
+	get := func(method, path string, body []byte) ([]byte, error) {
+		httpReq, err := http.NewRequest(method, baseUrl+path, bytes.NewBuffer(body))
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create request")
+		}
+		resp, err := httpClient.Do(httpReq)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not request %s", path)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not read response of %s", path)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("%s returned %s: %s", path, resp.Status, string(data))
+		}
+		return data, nil
+	}
+
+	reqBody, _ := json.Marshal(req)
+	data, err := get("POST", "/v2/tpm/quote", reqBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	var quote tamodel.TpmQuoteResponse
+	if err = xml.Unmarshal(data, &quote); err != nil {
+		return nil, nil, errors.Wrap(err, "could not decode quote response")
+	}
+	aik, err := get("GET", "/v2/aik", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &quote, aik, nil
+}
+
+// requestQuoteOverNats requests the quote and the aik of the simulated host like HVS does over NATS
+func requestQuoteOverNats(ac *AppConfig, hwUuid string, req tamodel.TpmQuoteRequest) (*tamodel.TpmQuoteResponse, []byte, error) {
+	taClient, err := client.NewNatsTAClient(ac.NatsServers, hwUuid, &tls.Config{InsecureSkipVerify: true}, ac.natsTaSubCredentialsPath)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Could not create Nats Trust Agent client")
+	}
+	quote, err := taClient.GetTPMQuote(base64.StdEncoding.EncodeToString(req.Nonce), req.Pcrs, req.PcrBanks)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Error getting tpm-quote from host %s", hwUuid)
+	}
+	aik, err := taClient.GetAIK()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "Error getting aik from host %s", hwUuid)
+	}
+	return &quote, aik, nil
+}
+
+func verifyQuoteMain(ac *AppConfig) error {
+	port := 0
+	req := tamodel.TpmQuoteRequest{Nonce: make([]byte, 20)}
+	for _, arg := range os.Args[2:] {
+		split := strings.SplitN(arg, "=", 2)
+		var err error
+		switch flag := split[0]; {
+		case len(split) < 2:
+			return errors.New("invalid cli argument: " + arg)
+		case flag == "--port":
+			port, err = strconv.Atoi(split[1])
+		case flag == "--pcrs":
+			for _, pcr := range strings.Split(split[1], ",") {
+				var idx int
+				if idx, err = strconv.Atoi(pcr); err != nil {
+					break
+				}
+				req.Pcrs = append(req.Pcrs, idx)
+			}
+		case flag == "--pcr-banks":
+			req.PcrBanks = strings.Split(split[1], ",")
+		default:
+			return errors.New("invalid cli argument: " + arg)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "invalid value for %s", split[0])
+		}
+	}
+	if port < ac.PortStart || port >= ac.PortStart+ac.Servers {
+		return errors.Errorf("--port needs to be the port of a simulated host between %d and %d", ac.PortStart, ac.PortStart+ac.Servers-1)
+	}
+	hwUuids, err := loadNSaveHwUuidFile(ac.hwUuidMapPath, ac.PortStart, ac.Servers)
+	if err != nil {
+		return err
+	}
+	hwUuid := hwUuids[port-ac.PortStart]
+	if _, err = rand.Read(req.Nonce); err != nil {
+		return errors.Wrap(err, "could not generate a nonce")
+	}
+
+	var quote *tamodel.TpmQuoteResponse
+	var aik []byte
+	if ac.TaSimServiceMode == communicationModeOutbound {
+		quote, aik, err = requestQuoteOverNats(ac, hwUuid, req)
+	} else {
+		quote, aik, err = requestQuoteOverHttps(ac, port, hwUuid, req)
+	}
+	if err != nil {
+		return err
+	}
+	aikCert, err := x509.ParseCertificate(aik)
+	if err != nil {
+		return errors.Wrap(err, "could not parse the aik certificate of the host")
+	}
+	verified, err := verifyQuoteResponse(quote, aikCert, req.Nonce)
+	if err != nil {
+		return errors.Wrapf(err, "quote of host %d is not valid", port)
+	}
+	fmt.Printf("quote of host %d (%s) is valid\n", port, hwUuid)
+	verified.print()
+	return nil
+}
@@ -0,0 +1,71 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+func TestVerifyQuote(t *testing.T) {
+
+	ctrl := newTestController(t, 1)
+	nonce := []byte("01234567890123456789")
+	resp, err := ctrl.getQuoteSignedWithNonce(0, &tamodel.TpmQuoteRequest{Nonce: nonce, Pcrs: []int{0, 7}})
+	if err != nil {
+		t.Fatal("failed to get quote:", err.Error())
+	}
+	block, _ := pem.Decode(ctrl.hosts[0].aik.certPem)
+	aikCert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal("failed to parse aik certificate:", err.Error())
+	}
+
+	verified, err := verifyQuoteResponse(resp, aikCert, nonce)
+	if err != nil {
+		t.Fatal("quote of the simulated host does not verify:", err.Error())
+	}
+	for _, sel := range verified.selection {
+		if !sel.isSelected(0) || !sel.isSelected(7) || sel.isSelected(1) {
+			t.Errorf("unexpected pcr selection for bank %s", pcrBankName(sel.hashAlg))
+		}
+	}
+
+	// a quote for another nonce or for a tag that the host does not have is not accepted
+	if _, err = verifyQuoteResponse(resp, aikCert, []byte("another nonce")); err == nil {
+		t.Error("quote verified for another nonce")
+	}
+	tagged := *resp
+	tagged.IsTagProvisioned, tagged.AssetTag = true, base64.StdEncoding.EncodeToString([]byte("tag"))
+	if _, err = verifyQuoteResponse(&tagged, aikCert, nonce); err == nil {
+		t.Error("quote verified for an asset tag that was not quoted")
+	}
+
+	quote, _ := base64.StdEncoding.DecodeString(resp.Quote)
+	extraData, _ := quoteNonce(nonce, "")
+	pcrValuesSize := 0
+	for _, values := range verified.pcrValues {
+		for _, value := range values {
+			pcrValuesSize += len(value)
+		}
+	}
+	tampered := map[string]func([]byte) []byte{
+		"flipped signature byte": func(q []byte) []byte { q[len(q)-pcrValuesSize-1] ^= 1; return q },
+		"appended byte":          func(q []byte) []byte { return append(q, 0) },
+		"truncated pcr value":    func(q []byte) []byte { return q[:len(q)-1] },
+		"spliced attest size":    func(q []byte) []byte { q[1]++; return q },
+		"flipped pcr value":      func(q []byte) []byte { q[len(q)-1] ^= 1; return q },
+	}
+	for name, tamper := range tampered {
+		q := tamper(append([]byte{}, quote...))
+		if _, err = verifyQuote(q, aikCert.PublicKey, extraData); err == nil {
+			t.Errorf("quote with %s verified", name)
+		}
+	}
+}
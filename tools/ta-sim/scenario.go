@@ -0,0 +1,245 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// a scenario is a yaml file with events that are applied to the simulated hosts at a time relative to the start
+// of the simulator. Hosts are selected with one of
+//
+//	all           every host
+//	5%            a percentage of the hosts
+//	20            a number of hosts
+//	10010-10019   a range of ports
+//	10001,10005   a list of ports
+//
+// Percentages and numbers of hosts are picked at random using the seed of the scenario - so a scenario selects
+// the same hosts every time it is run against the same configuration
+//
+//	seed: 1
+//	events:
+//	  - at: 2m
+//	    action: reboot
+//	    hosts: 5%
+//	    pcrs: [0, 17]
+//	  - at: 10m
+//	    action: revoke-asset-tag
+//	    hosts: 10010-10019
+//	  - at: 15m
+//	    action: offline
+//	    hosts: 20
+
+// scenario actions
+const (
+	scenarioReboot        = "reboot"
+	scenarioResetPcrs     = "reset-pcrs"
+	scenarioProvisionTag  = "provision-asset-tag"
+	scenarioRevokeTag     = "revoke-asset-tag"
+	scenarioSetHostInfo   = "set-host-info"
+	scenarioResetHostInfo = "reset-host-info"
+	scenarioOffline       = "offline"
+	scenarioOnline        = "online"
+)
+
+// pcr that gets a new value on a reboot when the event does not list any pcrs
+const scenarioDefaultRebootPcr = 0
+
+type scenarioEvent struct {
+	At     time.Duration `mapstructure:"at"`
+	Action string        `mapstructure:"action"`
+	Hosts  string        `mapstructure:"hosts"`
+	// pcrs that get new values on a reboot
+	Pcrs []int `mapstructure:"pcrs"`
+	// base64 encoded tag digest for provision-asset-tag
+	AssetTag string            `mapstructure:"asset_tag"`
+	HostInfo hostInfoOverrides `mapstructure:"host_info"`
+
+	// index of the selected hosts - set when the scenario is loaded
+	hostIdxs []int
+}
+
+type scenario struct {
+	Seed   int64           `mapstructure:"seed"`
+	Events []scenarioEvent `mapstructure:"events"`
+}
+
+// loadScenario reads the scenario from path and selects the hosts of each event out of the configured servers
+func loadScenario(path string, ac *AppConfig) (*scenario, error) {
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.SetConfigType("yml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "could not read scenario file %s", path)
+	}
+	sc := &scenario{Seed: 1}
+	if err := v.Unmarshal(sc); err != nil {
+		return nil, errors.Wrapf(err, "could not decode scenario file %s", path)
+	}
+
+	// events are applied in the order of their time - events at the same time in the order of the file
+	sort.SliceStable(sc.Events, func(i, j int) bool { return sc.Events[i].At < sc.Events[j].At })
+
+	rnd := rand.New(rand.NewSource(sc.Seed))
+	for i := range sc.Events {
+		ev := &sc.Events[i]
+		switch ev.Action {
+		case scenarioReboot:
+			if len(ev.Pcrs) == 0 {
+				ev.Pcrs = []int{scenarioDefaultRebootPcr}
+			}
+			for _, pcr := range ev.Pcrs {
+				if pcr < 0 || pcr >= pcrCount {
+					return nil, errors.Errorf("scenario event %d: invalid pcr index %d", i, pcr)
+				}
+			}
+		case scenarioProvisionTag:
+			if _, err := base64.StdEncoding.DecodeString(ev.AssetTag); err != nil || ev.AssetTag == "" {
+				return nil, errors.Errorf("scenario event %d: asset_tag needs to be a base64 encoded tag digest", i)
+			}
+		case scenarioResetPcrs, scenarioRevokeTag, scenarioSetHostInfo, scenarioResetHostInfo, scenarioOffline, scenarioOnline:
+		default:
+			return nil, errors.Errorf("scenario event %d: invalid action %q", i, ev.Action)
+		}
+		var err error
+		if ev.hostIdxs, err = selectHosts(ev.Hosts, ac.PortStart, ac.Servers, rnd); err != nil {
+			return nil, errors.Wrapf(err, "scenario event %d", i)
+		}
+	}
+	return sc, nil
+}
+
+// selectHosts returns the index of the hosts that are selected by sel
+func selectHosts(sel string, portStart, servers int, rnd *rand.Rand) ([]int, error) {
+	sel = strings.TrimSpace(sel)
+	hostIdx := func(portStr string) (int, error) {
+		port, err := strconv.Atoi(strings.TrimSpace(portStr))
+		if err != nil || port < portStart || port >= portStart+servers {
+			return 0, errors.Errorf("invalid host port %q", portStr)
+		}
+		return port - portStart, nil
+	}
+	randomHosts := func(count int) []int {
+		idxs := rnd.Perm(servers)[:count]
+		sort.Ints(idxs)
+		return idxs
+	}
+
+	switch {
+	case sel == "all":
+		idxs := make([]int, servers)
+		for i := range idxs {
+			idxs[i] = i
+		}
+		return idxs, nil
+
+	case strings.HasSuffix(sel, "%"):
+		pct, err := strconv.Atoi(strings.TrimSuffix(sel, "%"))
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, errors.Errorf("invalid percentage of hosts %q", sel)
+		}
+		return randomHosts(servers * pct / 100), nil
+
+	case strings.Contains(sel, "-"):
+		bounds := strings.SplitN(sel, "-", 2)
+		first, err := hostIdx(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		last, err := hostIdx(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		idxs := make([]int, 0, last-first+1)
+		for i := first; i <= last; i++ {
+			idxs = append(idxs, i)
+		}
+		return idxs, nil
+
+	case strings.Contains(sel, ","):
+		idxs := make([]int, 0)
+		for _, port := range strings.Split(sel, ",") {
+			idx, err := hostIdx(port)
+			if err != nil {
+				return nil, err
+			}
+			idxs = append(idxs, idx)
+		}
+		return idxs, nil
+	}
+
+	count, err := strconv.Atoi(sel)
+	if err != nil || count < 0 || count > servers {
+		return nil, errors.Errorf("invalid host selection %q", sel)
+	}
+	return randomHosts(count), nil
+}
+
+// runScenario applies the events of the scenario to the simulated hosts at their time relative to start. Events
+// that are not due when ctx is cancelled are not applied
+func (ctrl controller) runScenario(ctx context.Context, sc *scenario, start time.Time) {
+	log.Infof("Running scenario with %d events", len(sc.Events))
+	for i, ev := range sc.Events {
+		select {
+		case <-time.After(time.Until(start.Add(ev.At))):
+		case <-ctx.Done():
+			log.Infof("Scenario stopped before event %d", i)
+			return
+		}
+		if err := ctrl.applyScenarioEvent(i, ev); err != nil {
+			log.Errorf("scenario: failed to apply event %d (%s at %s): %s", i, ev.Action, ev.At, err.Error())
+			continue
+		}
+		log.Infof("scenario: applied %s to %d hosts at %s", ev.Action, len(ev.hostIdxs), ev.At)
+	}
+	log.Info("Scenario completed")
+}
+
+func (ctrl controller) applyScenarioEvent(eventIdx int, ev scenarioEvent) error {
+	for _, idx := range ev.hostIdxs {
+		host, err := ctrl.host(idx)
+		if err != nil {
+			return err
+		}
+		switch ev.Action {
+		case scenarioReboot:
+			// the pcrs are measured from their reset values like on a real boot. The measurements depend on the
+			// host and the event so that a scenario always results in the same pcr values when it is run again
+			if err = host.resetPcrs(); err == nil {
+				err = host.measure(driftEvents(ev.Pcrs, fmt.Sprintf("%s-scenario-%d", ctrl.hwUuidMap[idx], eventIdx)))
+			}
+		case scenarioResetPcrs:
+			err = host.resetPcrs()
+		case scenarioProvisionTag:
+			err = ctrl.setAssetTag(idx, ev.AssetTag)
+		case scenarioRevokeTag:
+			err = ctrl.setAssetTag(idx, "")
+		case scenarioSetHostInfo:
+			host.setHostInfo(ev.HostInfo)
+		case scenarioResetHostInfo:
+			host.setHostInfo(hostInfoOverrides{})
+		case scenarioOffline:
+			host.setOffline(true)
+		case scenarioOnline:
+			host.setOffline(false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
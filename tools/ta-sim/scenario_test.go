@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testScenario = `
+seed: 7
+events:
+  - at: 20ms
+    action: offline
+    hosts: 10003,10005
+  - at: 0s
+    action: reboot
+    hosts: 50%
+    pcrs: [0, 17]
+  - at: 10ms
+    action: provision-asset-tag
+    hosts: 10000-10002
+    asset_tag: dGFn
+  - at: 10ms
+    action: set-host-info
+    hosts: all
+    host_info:
+      bios_version: "2.0"
+`
+
+func TestScenario(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-scenario")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	scenarioPath := filepath.Join(dir, "scenario.yml")
+	if err = ioutil.WriteFile(scenarioPath, []byte(testScenario), 0644); err != nil {
+		t.Fatal("failed to write scenario:", err.Error())
+	}
+
+	ctrl := newTestController(t, 6)
+	sc, err := loadScenario(scenarioPath, ctrl.config)
+	if err != nil {
+		t.Fatal("failed to load scenario:", err.Error())
+	}
+	if len(sc.Events) != 4 || sc.Events[0].Action != scenarioReboot || sc.Events[3].Action != scenarioOffline {
+		t.Fatal("scenario events are not ordered by time")
+	}
+	if len(sc.Events[0].hostIdxs) != 3 {
+		t.Errorf("50%% of 6 hosts selected %d hosts", len(sc.Events[0].hostIdxs))
+	}
+	again, _ := loadScenario(scenarioPath, ctrl.config)
+	if !reflect.DeepEqual(sc.Events[0].hostIdxs, again.Events[0].hostIdxs) {
+		t.Error("scenario does not select the same hosts when it is loaded again")
+	}
+
+	ctrl.runScenario(context.Background(), sc, time.Now())
+
+	rebooted := make(map[int]bool)
+	for _, idx := range sc.Events[0].hostIdxs {
+		rebooted[idx] = true
+	}
+	for idx, host := range ctrl.hosts {
+		state := host.snapshot()
+		if bytes.Equal(state.pcrBanks[tpmAlgSha256][17], ctrl.hosts[0].profile.pcrBanks[tpmAlgSha256][17]) == rebooted[idx] {
+			t.Errorf("pcr 17 of host %d does not match the reboot events", idx)
+		}
+		if state.isTagProvisioned != (idx <= 2) {
+			t.Errorf("asset tag of host %d does not match the provision event", idx)
+		}
+		if state.offline != (idx == 3 || idx == 5) {
+			t.Errorf("reachability of host %d does not match the offline event", idx)
+		}
+		if state.hostInfo.BiosVersion != "2.0" {
+			t.Errorf("host info of host %d was not updated", idx)
+		}
+	}
+
+	// a reboot measures from the reset pcrs, so rebooting again with the same event gives the same pcrs
+	rebootedIdx := sc.Events[0].hostIdxs[0]
+	pcrs := ctrl.hosts[rebootedIdx].snapshot().pcrBanks
+	if err = ctrl.applyScenarioEvent(0, sc.Events[0]); err != nil {
+		t.Fatal("failed to reboot hosts again:", err.Error())
+	}
+	if !reflect.DeepEqual(ctrl.hosts[rebootedIdx].snapshot().pcrBanks, pcrs) {
+		t.Errorf("pcrs of host %d changed when it was rebooted again with the same event", rebootedIdx)
+	}
+}
+
+func TestScenarioAssetTagsAreSaved(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-scenario")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	tagsPath := filepath.Join(dir, "asset_tags.json")
+
+	ctrl := newTestController(t, 2)
+	if ctrl.assetTags, err = loadAssetTagStore(tagsPath); err != nil {
+		t.Fatal("failed to load asset tags:", err.Error())
+	}
+	events := []scenarioEvent{
+		{Action: scenarioProvisionTag, AssetTag: "dGFn", hostIdxs: []int{0, 1}},
+		{Action: scenarioRevokeTag, hostIdxs: []int{1}},
+	}
+	for i, ev := range events {
+		if err = ctrl.applyScenarioEvent(i, ev); err != nil {
+			t.Fatalf("failed to apply %s: %s", ev.Action, err.Error())
+		}
+	}
+
+	reloaded, err := loadAssetTagStore(tagsPath)
+	if err != nil {
+		t.Fatal("failed to reload asset tags:", err.Error())
+	}
+	if tag, ok := reloaded.tag(ctrl.hwUuidMap[0]); !ok || tag != "dGFn" {
+		t.Error("tag provisioned by the scenario was not saved")
+	}
+	if _, ok := reloaded.tag(ctrl.hwUuidMap[1]); ok {
+		t.Error("tag revoked by the scenario is still saved")
+	}
+}
+
+func TestSelectHosts(t *testing.T) {
+
+	rnd := rand.New(rand.NewSource(1))
+	for _, sel := range []string{"", "none", "101%", "9", "10000-10009", "9999,10000"} {
+		if _, err := selectHosts(sel, 10000, 8, rnd); err == nil {
+			t.Errorf("host selection %q should be rejected", sel)
+		}
+	}
+	if idxs, _ := selectHosts("all", 10000, 8, rnd); len(idxs) != 8 {
+		t.Error("all should select every host")
+	}
+	if idxs, _ := selectHosts("10002-10004", 10000, 8, rnd); !reflect.DeepEqual(idxs, []int{2, 3, 4}) {
+		t.Errorf("port range selected hosts %v", idxs)
+	}
+}
@@ -65,8 +65,20 @@ if [ -z "$AIK_CERT_PATH" ] || [ -z  "$AIK_KEY_PATH" ]; then
 
 fi
 
+# keep a copy of the Privacy CA so that the simulator can certify an AIK for every host when PerHostAik is set
+if [ -r "$PRIVACY_CA_CERT_PATH" ] && [ -r "$PRIVACY_CA_KEY_PATH" ]; then
+  cp "$PRIVACY_CA_CERT_PATH" ./configuration/pca-cert
+  cp "$PRIVACY_CA_KEY_PATH" ./configuration/pca-key
+  chmod 600 ./configuration/pca-key
+fi
+
 [ -z "$TA_SIM_IP" ] && read -p "Enter the TA simulator ip (ex: 10.1.2.3):" TA_SIM_IP
 sed -i "s/^\(IP\.1\s*=\s*\).*\$/\1$TA_SIM_IP/" configuration/opensslSAN.conf
+# virtual hosts that are routed by sni or host header are reached by name - the certificate needs to be valid for them
+if [ -n "$VIRTUAL_HOST_DOMAIN" ]; then
+  echo "DNS.2=*.$VIRTUAL_HOST_DOMAIN" >> configuration/opensslSAN.conf
+  sed -i "s/^\(VirtualHostDomain\s*:\s*\).*\$/\1$VIRTUAL_HOST_DOMAIN/" configuration/config.yml
+fi
 sed -i "s/^\(SimulatorIP\s*:\s*\).*\$/\1$TA_SIM_IP/" configuration/config.yml
 
 [ -z "$AAS_IP" ] && read -p "Enter the AAS ip (ex: 10.1.2.3):" AAS_IP
@@ -176,10 +188,13 @@ if [ -z "$BINDING_KEY_CERT_PATH" ]; then
   $TA_SIMULATOR_HOME/ta-sim create-binding-key-cert --pca-cert=$PRIVACY_CA_CERT_PATH --pca-key=$PRIVACY_CA_KEY_PATH
   if [ $? -ne 0 ]; then
     cat "Binding key certificate does not exist" > $TA_SIMULATOR_HOME/configuration/bk.cert
-    echo "ERROR: failed to create binding key certificate. TA simulator will still function - but APIs such as WLS get flavor-key will not work"
-    echo "The ta-sim binary can be used to generate the binding key certificate as follows"
+    echo "ERROR: failed to create binding and signing key certificates. TA simulator will still function - but APIs such as WLS get flavor-key will not work"
+    echo "The ta-sim binary can be used to generate the binding and signing key certificates as follows"
     echo "\t ./ta-sim create-binding-key-cert --pca-cert=/root/privacy-ca-cert.pem --pca-key=/root/privacy-ca.key"
   fi
 else
   cp $BINDING_KEY_CERT_PATH $TA_SIMULATOR_HOME/configuration/bk.cert
+  if [ -n "$SIGNING_KEY_CERT_PATH" ]; then
+    cp $SIGNING_KEY_CERT_PATH $TA_SIMULATOR_HOME/configuration/sk.cert
+  fi
 fi
\ No newline at end of file
@@ -0,0 +1,235 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// the software backend gives every simulated host a TPM 2.0 of its own that is implemented in Go. The template
+// backend builds the quotes from the TPMS_ATTEST of the captured quote - the qualified signer is the one of the
+// captured quote and the clock is offset from the captured clock. The software TPM keeps the state that a TPM
+// keeps instead
+//
+//	TPM2_Startup     resets the pcrs and counts the TPM resets - on the start of the simulator and on every reboot
+//	_TPM_Hash_Start  resets the dynamic pcrs 17 to 22 on the dynamic launch of a tboot profile
+//	TPM2_PCR_Extend  the only way the pcrs change - the events of the measurement profile, drift and manifests
+//	TPM2_Quote       signed by the aik of the host with the qualified name that the TPM gives the aik, and the clock
+//	                 and reset counters of the TPM
+//
+// The pcrs can only reach the values of a captured quote by extending the events that led to them, so the
+// software backend needs a MeasurementProfile
+
+// values of TpmBackend
+const (
+	tpmBackendTemplate = "template"
+	tpmBackendSoftware = "software"
+)
+
+// TPM_ALG_ID, TPMA_OBJECT, TPM_ECC_CURVE and TPM_RH values of the aik of the software TPM. The aik is a restricted
+// signing key like the aik that the Trust Agent creates
+const (
+	tpmAlgEcc = 0x0023
+
+	tpmaObjectRestricted = 0x00010000
+
+	tpmEccNistP256 = 0x0003
+	tpmEccNistP384 = 0x0004
+
+	// the aik is a primary key of the endorsement hierarchy
+	tpmRhEndorsement = 0x4000000B
+)
+
+var tpmEccCurves = map[elliptic.Curve]uint16{
+	elliptic.P256(): tpmEccNistP256,
+	elliptic.P384(): tpmEccNistP384,
+}
+
+// softwareTpm is the TPM of a simulated host with the software backend
+type softwareTpm struct {
+	lock sync.Mutex
+	aik  *hostAik
+	// TPM2B_NAME of the qualified name of the aik - the qualified signer of the quotes
+	qualifiedSigner []byte
+	firmwareVersion uint64
+	hashAlgs        []uint16
+	// pcrs are replaced on every extend and never changed in place, so they can be handed out without a copy
+	pcrs pcrBanks
+	// the clock counts the milliseconds since the TPM was powered on
+	powerOn      time.Time
+	resetCount   uint32
+	restartCount uint32
+	started      bool
+}
+
+// newSoftwareTpm creates a TPM with the pcr banks of hashAlgs that signs its quotes with the aik. The TPM has to be
+// started up before its pcrs can be extended
+func newSoftwareTpm(aik *hostAik, hashAlgs []uint16, firmwareVersion uint64) (*softwareTpm, error) {
+	public, err := marshalAikPublic(aik.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	return &softwareTpm{
+		aik:             aik,
+		qualifiedSigner: tpmQualifiedName(tpmRhEndorsement, tpmName(public)),
+		firmwareVersion: firmwareVersion,
+		hashAlgs:        hashAlgs,
+		powerOn:         time.Now(),
+	}, nil
+}
+
+// startup is TPM2_Startup(TPM_SU_CLEAR) from locality - the pcrs are reset, pcr 0 starts out with the locality and
+// every startup after the first one counts as a TPM reset
+func (tpm *softwareTpm) startup(locality byte) {
+	tpm.lock.Lock()
+	defer tpm.lock.Unlock()
+	if tpm.started {
+		tpm.resetCount++
+	}
+	tpm.started, tpm.restartCount = true, 0
+	tpm.pcrs = newPcrBanks(tpm.hashAlgs...)
+	for _, bank := range tpm.pcrs {
+		bank[0][len(bank[0])-1] = locality
+	}
+}
+
+// measure extends the events into all the banks of the TPM in the way the platform does - EV_NO_ACTION events are
+// only logged, and the HASH_START event of a dynamic launch is preceded by _TPM_Hash_Start
+func (tpm *softwareTpm) measure(events []measurementEvent) error {
+	tpm.lock.Lock()
+	defer tpm.lock.Unlock()
+	if !tpm.started {
+		return errors.New("TPM has not been started up")
+	}
+	pcrs := tpm.pcrs.clone()
+	for _, ev := range events {
+		if ev.typeId == evNoAction {
+			continue
+		}
+		if ev.typeId == evTxtHashStart {
+			for _, bank := range pcrs {
+				for pcr := 17; pcr <= 22; pcr++ {
+					bank[pcr] = make([]byte, len(bank[pcr]))
+				}
+			}
+		}
+		for _, hashAlg := range tpm.hashAlgs {
+			if err := pcrs.extend(hashAlg, ev.pcr, ev.digest(hashAlg)); err != nil {
+				return err
+			}
+		}
+	}
+	tpm.pcrs = pcrs
+	return nil
+}
+
+// pcrRead returns the values of all the pcrs of the TPM
+func (tpm *softwareTpm) pcrRead() pcrBanks {
+	tpm.lock.Lock()
+	defer tpm.lock.Unlock()
+	return tpm.pcrs
+}
+
+// quote is TPM2_Quote over the selected pcrs with qualifyingData, signed by the aik
+func (tpm *softwareTpm) quote(selection []pcrBankSelection, qualifyingData []byte) ([]byte, error) {
+	tpm.lock.Lock()
+	defer tpm.lock.Unlock()
+	if !tpm.started {
+		return nil, errors.New("TPM has not been started up")
+	}
+	tmpl := quoteTemplate{
+		qualifiedSigner: tpm.qualifiedSigner,
+		clockInfo: tpmsClockInfo{
+			Clock:        uint64(time.Since(tpm.powerOn) / time.Millisecond),
+			ResetCount:   tpm.resetCount,
+			RestartCount: tpm.restartCount,
+			Safe:         1,
+		},
+		firmwareVersion: tpm.firmwareVersion,
+	}
+	return buildQuote(tmpl, selection, tpm.pcrs, qualifyingData, tpm.aik.key)
+}
+
+// marshalAikPublic returns the TPMT_PUBLIC of the aik as the TPM creates it - a restricted signing key that signs
+// with the scheme of quoteSigningScheme
+func marshalAikPublic(pub crypto.PublicKey) ([]byte, error) {
+	attributes := uint32(tpmaObjectFixedTpm | tpmaObjectFixedParent | tpmaObjectSensitiveDataOrigin |
+		tpmaObjectUserWithAuth | tpmaObjectRestricted | tpmaObjectSign)
+	public := bytes.NewBuffer([]byte{})
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgRsa))
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgSha256))
+		binary.Write(public, binary.BigEndian, attributes)
+		// no authPolicy and no symmetric algorithm, since the key is not a storage key
+		binary.Write(public, binary.BigEndian, uint16(0))
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgNull))
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgRsassa))
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgSha256))
+		binary.Write(public, binary.BigEndian, uint16(key.N.BitLen()))
+		// an exponent of 0 is the default exponent
+		exponent := uint32(key.E)
+		if key.E == 65537 {
+			exponent = 0
+		}
+		binary.Write(public, binary.BigEndian, exponent)
+		size := (key.N.BitLen() + 7) / 8
+		binary.Write(public, binary.BigEndian, uint16(size))
+		public.Write(key.N.FillBytes(make([]byte, size)))
+	case *ecdsa.PublicKey:
+		curve, ok := tpmEccCurves[key.Curve]
+		if !ok {
+			return nil, errors.New("aik is not on the P256 or P384 curve")
+		}
+		hashAlg := uint16(tpmAlgSha256)
+		if curve == tpmEccNistP384 {
+			hashAlg = tpmAlgSha384
+		}
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgEcc))
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgSha256))
+		binary.Write(public, binary.BigEndian, attributes)
+		binary.Write(public, binary.BigEndian, uint16(0))
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgNull))
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgEcdsa))
+		binary.Write(public, binary.BigEndian, hashAlg)
+		binary.Write(public, binary.BigEndian, curve)
+		// no key derivation function
+		binary.Write(public, binary.BigEndian, uint16(tpmAlgNull))
+		size := (key.Curve.Params().BitSize + 7) / 8
+		for _, coordinate := range []*big.Int{key.X, key.Y} {
+			binary.Write(public, binary.BigEndian, uint16(size))
+			public.Write(coordinate.FillBytes(make([]byte, size)))
+		}
+	default:
+		return nil, errors.New("aik is neither an rsa nor an ecc key")
+	}
+	return public.Bytes(), nil
+}
+
+// tpmName returns the TPM2B_NAME of an object - the name algorithm followed by the digest of its TPMT_PUBLIC
+func tpmName(public []byte) []byte {
+	digest := sha256.Sum256(public)
+	return append([]byte{0x00, tpmAlgSha256}, digest[:]...)
+}
+
+// tpmQualifiedName returns the qualified name of a primary key with the name in the hierarchy - the name algorithm
+// followed by the digest of the handle of the hierarchy and the name
+func tpmQualifiedName(hierarchy uint32, name []byte) []byte {
+	hash := sha256.New()
+	binary.Write(hash, binary.BigEndian, hierarchy)
+	hash.Write(name)
+	return append([]byte{0x00, tpmAlgSha256}, hash.Sum(nil)...)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	hcUtil "github.com/intel-secl/intel-secl/v4/pkg/lib/host-connector/util"
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+// softwareTpmQuote requests a quote from the host and verifies it like HVS does
+func softwareTpmQuote(t *testing.T, ctrl *controller, hostIdx int) *verifiedQuote {
+	nonce := []byte("01234567890123456789")
+	quote, err := ctrl.getQuoteSignedWithNonce(hostIdx, &tamodel.TpmQuoteRequest{Nonce: nonce, Pcrs: capturePcrList})
+	if err != nil {
+		t.Fatal("failed to get quote:", err.Error())
+	}
+	verificationNonce, err := hcUtil.GetVerificationNonce(nonce, *quote)
+	if err != nil {
+		t.Fatal("failed to get verification nonce:", err.Error())
+	}
+	verificationNonceBytes, _ := base64.StdEncoding.DecodeString(verificationNonce)
+	quoteBytes, _ := base64.StdEncoding.DecodeString(quote.Quote)
+	aik := ctrl.hosts[hostIdx].aik
+	if certifiesHostKeys(aik) {
+		// the host connector of HVS only verifies quotes of rsa aiks
+		if _, _, err = hcUtil.VerifyQuoteAndGetPCRManifest(quote.EventLog, verificationNonceBytes, quoteBytes, aik.cert); err != nil {
+			t.Fatal("quote of the software TPM does not verify with the host connector:", err.Error())
+		}
+	}
+	verified, err := verifyQuote(quoteBytes, aik.cert.PublicKey, verificationNonceBytes)
+	if err != nil {
+		t.Fatal("quote of the software TPM does not verify:", err.Error())
+	}
+	return verified
+}
+
+func TestSoftwareTpm(t *testing.T) {
+
+	ctrl := newTestController(t, 1)
+	host := ctrl.hosts[0]
+	host.profile.eventLog = tbootEventLog()
+	hashAlgs := host.profile.pcrBanks.hashAlgs()
+	tpm, err := newSoftwareTpm(host.aik, hashAlgs, host.profile.quoteTemplate.firmwareVersion)
+	if err != nil {
+		t.Fatal("failed to create software TPM:", err.Error())
+	}
+	if err = host.powerOnTpm(tpm); err != nil {
+		t.Fatal("failed to power on software TPM:", err.Error())
+	}
+
+	// the TPM boots to the pcrs that the event log of the measurement profile replays to. The dynamic launch
+	// resets all of the pcrs 17 to 22, the replay only those with events
+	replayed, err := replayEventLog(tbootEventLog(), hashAlgs)
+	if err != nil {
+		t.Fatal("failed to replay event log:", err.Error())
+	}
+	expected := host.snapshot().pcrBanks
+	for hashAlg, bank := range expected {
+		for pcr, value := range bank {
+			if pcr < 19 && !bytes.Equal(value, replayed[hashAlg][pcr]) {
+				t.Errorf("pcr %d of the software TPM does not match the event log", pcr)
+			} else if pcr >= 19 && pcr <= 22 && !bytes.Equal(value, make([]byte, len(value))) {
+				t.Errorf("pcr %d of the software TPM was not reset by the dynamic launch", pcr)
+			}
+		}
+	}
+	verified := softwareTpmQuote(t, ctrl, 0)
+	if !bytes.Equal(verified.qualifiedSigner, tpm.qualifiedSigner) || verified.clockInfo.ResetCount != 0 ||
+		verified.clockInfo.Safe != 1 || verified.firmwareVersion != host.profile.quoteTemplate.firmwareVersion {
+		t.Errorf("quote does not have the state of the TPM: %+v", verified.quoteTemplate)
+	}
+
+	// the pcrs can be extended, and a reboot is a TPM reset - the pcrs are measured again and the clock keeps running
+	if err = host.measure(driftEvents([]int{0}, ctrl.hwUuidMap[0])); err != nil {
+		t.Fatal("failed to extend pcrs:", err.Error())
+	}
+	if reflect.DeepEqual(host.snapshot().pcrBanks, expected) {
+		t.Error("pcrs of the software TPM were not extended")
+	}
+	softwareTpmQuote(t, ctrl, 0)
+	if err = host.resetPcrs(); err != nil {
+		t.Fatal("failed to reset pcrs:", err.Error())
+	}
+	if !reflect.DeepEqual(host.snapshot().pcrBanks, expected) {
+		t.Error("pcrs of the software TPM were not reset")
+	}
+	rebooted := softwareTpmQuote(t, ctrl, 0)
+	if rebooted.clockInfo.ResetCount != 1 || rebooted.clockInfo.Clock < verified.clockInfo.Clock {
+		t.Errorf("clock of the TPM was not kept over a reset: %+v", rebooted.clockInfo)
+	}
+}
+
+func TestSoftwareTpmEccAik(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ta-sim-tpm")
+	if err != nil {
+		t.Fatal("failed to create temp dir:", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ctrl := newTestController(t, 1)
+	pcaCertPath, pcaKeyPath := createTestPrivacyCa(t, dir)
+	for _, curve := range []string{aikKeyTypeEccP256, aikKeyTypeEccP384} {
+		aiks, err := loadNCreateHostAiks(filepath.Join(dir, curve), ctrl.hwUuidMap, []string{curve}, pcaCertPath, pcaKeyPath)
+		if err != nil {
+			t.Fatal("failed to create ecc aik:", err.Error())
+		}
+		host := ctrl.hosts[0]
+		host.aik = aiks[0]
+		host.profile.eventLog = tbootEventLog()
+		tpm, err := newSoftwareTpm(host.aik, host.profile.pcrBanks.hashAlgs(), 0)
+		if err != nil {
+			t.Fatal("failed to create software TPM:", err.Error())
+		}
+		if err = host.powerOnTpm(tpm); err != nil {
+			t.Fatal("failed to power on software TPM:", err.Error())
+		}
+		if verified := softwareTpmQuote(t, ctrl, 0); !bytes.Equal(verified.qualifiedSigner, tpm.qualifiedSigner) {
+			t.Errorf("quote of the %s aik is not signed by the qualified name of the aik", curve)
+		}
+	}
+}
@@ -6,7 +6,14 @@ then
     ./ta-sim start &>> logs/tagent-sim.log &
 elif [ "$1" = "stop" ]
 then
-    ps axf | grep ta-sim | grep -v grep | awk '{print "kill -9 " $1}' | sh
+    # the simulator completes in-flight requests and closes its connections on SIGTERM
+    pids=`pgrep -x ta-sim`
+    [ -n "$pids" ] && kill $pids
+    for i in `seq 35`; do
+        pgrep -x ta-sim > /dev/null || exit 0
+        sleep 1
+    done
+    pkill -9 -x ta-sim
 elif [ "$1" = "restart" ]
 then
     ulimit -n 50000
@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// delete-all-hosts and delete-all-flavors undo create-all-hosts and create-all-flavors. The hosts and flavors are
+// found by the hardware uuids in the hw uuid map: hosts by the name that create-all-hosts registered them with,
+// HOST_UNIQUE flavors by their hardware uuid and PLATFORM and OS flavors by the host name that the simulated
+// host reported to HVS when the flavors were created
+
+// teardownSummary counts the outcome of deleting the resources of the simulated hosts
+type teardownSummary struct {
+	lock     sync.Mutex
+	deleted  int
+	notFound int
+	failed   int
+}
+
+func (summary *teardownSummary) add(deleted, notFound, failed int) {
+	summary.lock.Lock()
+	defer summary.lock.Unlock()
+	summary.deleted += deleted
+	summary.notFound += notFound
+	summary.failed += failed
+}
+
+// deleteResources deletes the resources with the given ids
+func deleteResources(api hvsApi, resource string, ids []string, summary *teardownSummary) {
+	for _, id := range ids {
+		deleted, err := api.delete(resource, id)
+		switch {
+		case err != nil:
+			log.Error(err)
+			summary.add(0, 0, 1)
+		case !deleted:
+			summary.add(0, 1, 0)
+		default:
+			summary.add(1, 0, 0)
+		}
+	}
+}
+
+// deleteHost deletes the host that create-all-hosts registered for the hardware uuid
+func deleteHost(api hvsApi, hwUuid string, summary *teardownSummary) {
+	var hosts hvs.HostCollection
+	if err := api.search("hosts", url.Values{"nameEqualTo": {hvsHostNamePrefix + hwUuid}}, &hosts); err != nil {
+		log.Error("could not find host ", hvsHostNamePrefix+hwUuid, " error: ", err)
+		summary.add(0, 0, 1)
+		return
+	}
+	if len(hosts.Hosts) == 0 {
+		summary.add(0, 1, 0)
+		return
+	}
+	ids := make([]string, 0, len(hosts.Hosts))
+	for _, host := range hosts.Hosts {
+		ids = append(ids, host.Id.String())
+	}
+	deleteResources(api, "hosts", ids, summary)
+}
+
+// deleteHostFlavors deletes the flavors that create-all-flavors created from the simulated host
+func deleteHostFlavors(api hvsApi, hostName, hwUuid string, summary *teardownSummary) {
+	ids := make([]string, 0)
+	found := make(map[string]bool)
+	for _, query := range []url.Values{
+		{"key": {hvs.HardwareUUID}, "value": {hwUuid}},
+		{"key": {hvs.Source}, "value": {hostName}},
+	} {
+		var flavors hvs.SignedFlavorCollection
+		if err := api.search("flavors", query, &flavors); err != nil {
+			log.Error("could not find flavors of host ", hostName, " error: ", err)
+			summary.add(0, 0, 1)
+			return
+		}
+		for _, flavor := range flavors.SignedFlavors {
+			if id := flavor.Flavor.Meta.ID.String(); !found[id] {
+				found[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	deleteResources(api, "flavors", ids, summary)
+}
+
+// simulatedHostNames returns the host names that the simulated hosts report to HVS
+func simulatedHostNames(ac *AppConfig, hwUuids []string) ([]string, error) {
+	profiles, err := loadHostProfiles(ac)
+	if err != nil {
+		return nil, err
+	}
+	profileNames, err := loadNSaveHostProfileAssignment(ac.hwUuidMapPath, ac.PortStart, ac.Servers, ac.HostProfiles)
+	if err != nil {
+		return nil, err
+	}
+	hostNames := make([]string, len(hwUuids))
+	for i := range hostNames {
+		for _, profile := range profiles {
+			if profile.name == profileNames[i] {
+				hostNames[i] = simulatedHostInfo(profile.hostInfo, ac.PortStart+i, ac.DistinctFlavors, hwUuids[i]).HostName
+			}
+		}
+	}
+	return hostNames, nil
+}
+
+// teardown calls deleteResourcesOfHost for each simulated host in batches of RequestVolume
+func teardown(api hvsApi, ac *AppConfig, resources string, deleteResourcesOfHost func(api hvsApi, idx int, summary *teardownSummary)) error {
+	summary := new(teardownSummary)
+	runBatched(ac, ac.Servers, func(idx int) error {
+		deleteResourcesOfHost(api, idx, summary)
+		return nil
+	})
+	log.Infof("Delete %s completed: %d deleted, %d not found, %d failed", resources, summary.deleted, summary.notFound, summary.failed)
+	if summary.failed > 0 {
+		return errors.Errorf("%d %s could not be deleted", summary.failed, resources)
+	}
+	return nil
+}
+
+func deleteHosts(ac *AppConfig) error {
+	hwUuids, err := loadNSaveHwUuidFile(ac.hwUuidMapPath, ac.PortStart, ac.Servers)
+	if err != nil {
+		return err
+	}
+	api, err := newHvsApi(ac)
+	if err != nil {
+		return err
+	}
+	return teardown(api, ac, "hosts", func(api hvsApi, idx int, summary *teardownSummary) {
+		deleteHost(api, hwUuids[idx], summary)
+	})
+}
+
+func deleteFlavors(ac *AppConfig) error {
+	hwUuids, err := loadNSaveHwUuidFile(ac.hwUuidMapPath, ac.PortStart, ac.Servers)
+	if err != nil {
+		return err
+	}
+	hostNames, err := simulatedHostNames(ac, hwUuids)
+	if err != nil {
+		return err
+	}
+	api, err := newHvsApi(ac)
+	if err != nil {
+		return err
+	}
+	return teardown(api, ac, "flavors", func(api hvsApi, idx int, summary *teardownSummary) {
+		deleteHostFlavors(api, hostNames[idx], hwUuids[idx], summary)
+	})
+}
@@ -0,0 +1,63 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/intel-secl/intel-secl/v4/pkg/model/hvs"
+)
+
+func TestTeardown(t *testing.T) {
+
+	mock := newMockServices(t)
+	hwUuids := []string{uuid.New().String(), uuid.New().String(), uuid.New().String()}
+	// the third host was never registered
+	hostIds := []uuid.UUID{uuid.New(), uuid.New()}
+	mock.hosts[hvsHostNamePrefix+hwUuids[0]] = hostIds[0]
+	mock.hosts[hvsHostNamePrefix+hwUuids[1]] = hostIds[1]
+	// the platform flavor was created from the first host and is found by its host name and hardware uuid
+	platformFlavor, hostUniqueFlavor := uuid.New(), uuid.New()
+	mock.flavors[hvs.HardwareUUID+"="+hwUuids[0]] = []uuid.UUID{hostUniqueFlavor, platformFlavor}
+	mock.flavors[hvs.Source+"=host-10000"] = []uuid.UUID{platformFlavor}
+
+	ac := &AppConfig{PortStart: 10000, Servers: len(hwUuids), RequestVolume: 2}
+	err := teardown(mock.api(), ac, "hosts", func(api hvsApi, idx int, summary *teardownSummary) {
+		deleteHost(api, hwUuids[idx], summary)
+	})
+	if err != nil {
+		t.Fatal("failed to delete hosts:", err.Error())
+	}
+	for _, id := range hostIds {
+		if !mock.deleted[id.String()] {
+			t.Errorf("host %s was not deleted", id)
+		}
+	}
+
+	summary := new(teardownSummary)
+	deleteHostFlavors(mock.api(), "host-10000", hwUuids[0], summary)
+	if summary.deleted != 2 || summary.notFound != 0 || summary.failed != 0 {
+		t.Errorf("flavors of the host were not deleted once: %+v", summary)
+	}
+	if len(mock.recorded("DELETE", "flavors/"+platformFlavor.String())) != 1 {
+		t.Error("flavor that was found twice was not deleted once")
+	}
+
+	// deletions that fail are counted and fail the command
+	mock.status = func(req *mockRequest) int {
+		if req.Method == "DELETE" {
+			return 500
+		}
+		return 0
+	}
+	mock.hosts[hvsHostNamePrefix+hwUuids[2]] = uuid.New()
+	err = teardown(mock.api(), ac, "hosts", func(api hvsApi, idx int, summary *teardownSummary) {
+		deleteHost(api, hwUuids[idx], summary)
+	})
+	if err == nil {
+		t.Error("failed deletions did not fail the teardown")
+	}
+}
@@ -0,0 +1,460 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// this file builds TPM2_Quote output in the same format the Trust Agent returns in the quote field of the
+// TpmQuoteResponse. Refer VerifyQuoteAndGetPCRManifest in the host-connector library for the parsing side.
+//
+//	UINT16          size of the TPMS_ATTEST
+//	TPMS_ATTEST     quote info that is signed by the AIK
+//	TPMT_SIGNATURE  signature algorithm, hash algorithm, size of signature and the signature - or for ECDSA
+//	                the r and s of the signature, each preceded by their size
+//	BYTE[]          values of the selected pcrs - bank by bank in the order of the pcr selection
+
+const (
+	tpmGeneratedValue = 0xff544347
+	tpmStAttestQuote  = 0x8018
+	tpmAlgRsassa      = 0x0014
+	tpmAlgEcdsa       = 0x0018
+	pcrCount          = 24
+)
+
+// TPM_ALG_ID values of the pcr banks that can show up in a quote
+const (
+	tpmAlgSha1   = 0x0004
+	tpmAlgSha256 = 0x000B
+	tpmAlgSha384 = 0x000C
+	tpmAlgSha512 = 0x000D
+)
+
+var pcrBankHash = map[uint16]crypto.Hash{
+	tpmAlgSha1:   crypto.SHA1,
+	tpmAlgSha256: crypto.SHA256,
+	tpmAlgSha384: crypto.SHA384,
+	tpmAlgSha512: crypto.SHA512,
+}
+
+// pcrBankNames maps the pcr bank names used in quote requests to the TPM_ALG_ID of the bank.
+// These are the banks that the Trust Agent accepts in a quote request
+var pcrBankNames = map[string]uint16{
+	"SHA1":   tpmAlgSha1,
+	"SHA256": tpmAlgSha256,
+	"SHA384": tpmAlgSha384,
+}
+
+// tpmsClockInfo is the TPMS_CLOCKINFO structure of the quote
+type tpmsClockInfo struct {
+	Clock        uint64
+	ResetCount   uint32
+	RestartCount uint32
+	Safe         byte
+}
+
+// quoteTemplate holds the fields of the TPMS_ATTEST that do not depend on the pcrs or the nonce
+type quoteTemplate struct {
+	qualifiedSigner []byte
+	clockInfo       tpmsClockInfo
+	firmwareVersion uint64
+}
+
+// pcrBankSelection is one TPMS_PCR_SELECTION entry from the TPML_PCR_SELECTION of the quote
+type pcrBankSelection struct {
+	hashAlg     uint16
+	pcrSelected []byte
+}
+
+func (sel pcrBankSelection) isSelected(pcr int) bool {
+	return pcr/8 < len(sel.pcrSelected) && sel.pcrSelected[pcr/8]&(1<<uint(pcr%8)) != 0
+}
+
+// newPcrBankSelection selects the given pcrs from the bank that uses hashAlg
+func newPcrBankSelection(hashAlg uint16, pcrs []int) pcrBankSelection {
+	sel := pcrBankSelection{hashAlg: hashAlg, pcrSelected: make([]byte, pcrCount/8)}
+	for _, pcr := range pcrs {
+		if pcr >= 0 && pcr < pcrCount {
+			sel.pcrSelected[pcr/8] |= 1 << uint(pcr%8)
+		}
+	}
+	return sel
+}
+
+// allPcrs returns the index of every pcr in a bank
+func allPcrs() []int {
+	pcrs := make([]int, pcrCount)
+	for i := range pcrs {
+		pcrs[i] = i
+	}
+	return pcrs
+}
+
+// pcrSelectionForRequest creates the pcr selection for the pcrs and pcr banks of a quote request. Like the
+// Trust Agent, all pcrs are quoted when no pcrs are requested and the SHA1 and SHA256 banks are quoted when
+// no banks are requested. Banks that are not active on the simulated TPM are rejected
+func pcrSelectionForRequest(pcrs []int, bankNames []string, activeBanks pcrBanks) ([]pcrBankSelection, []string, error) {
+	if len(pcrs) == 0 {
+		pcrs = allPcrs()
+	}
+	for _, pcr := range pcrs {
+		if pcr < 0 || pcr >= pcrCount {
+			return nil, nil, errors.Errorf("Invalid PCR index %d in quote request", pcr)
+		}
+	}
+	if len(bankNames) == 0 {
+		bankNames = []string{"SHA1", "SHA256"}
+	}
+
+	selection := make([]pcrBankSelection, 0, len(bankNames))
+	selectedBanks := make([]string, 0, len(bankNames))
+	for _, bankName := range bankNames {
+		hashAlg, ok := pcrBankNames[strings.ToUpper(bankName)]
+		if !ok {
+			return nil, nil, errors.Errorf("Invalid PCR bank %q in quote request", bankName)
+		}
+		if _, ok = activeBanks[hashAlg]; !ok {
+			return nil, nil, errors.Errorf("PCR bank %q is not active on the TPM", bankName)
+		}
+		selection = append(selection, newPcrBankSelection(hashAlg, pcrs))
+		selectedBanks = append(selectedBanks, strings.ToUpper(bankName))
+	}
+	return selection, selectedBanks, nil
+}
+
+// pcrBanks holds the values of all the pcrs of a simulated TPM keyed by the TPM_ALG_ID of the bank
+type pcrBanks map[uint16][][]byte
+
+// newPcrBanks creates banks in the state of a TPM right after a reset. pcrs 17 to 22 are only reset by a
+// dynamic launch and start out as all 0xff
+func newPcrBanks(hashAlgs ...uint16) pcrBanks {
+	banks := make(pcrBanks)
+	for _, hashAlg := range hashAlgs {
+		size := pcrBankHash[hashAlg].Size()
+		bank := make([][]byte, pcrCount)
+		for pcr := range bank {
+			bank[pcr] = make([]byte, size)
+			if pcr >= 17 && pcr <= 22 {
+				for i := range bank[pcr] {
+					bank[pcr][i] = 0xff
+				}
+			}
+		}
+		banks[hashAlg] = bank
+	}
+	return banks
+}
+
+// clone makes a deep copy of the pcr banks so that the copy can be extended without changing the original
+func (banks pcrBanks) clone() pcrBanks {
+	cloned := make(pcrBanks, len(banks))
+	for hashAlg, bank := range banks {
+		cloned[hashAlg] = make([][]byte, len(bank))
+		for pcr := range bank {
+			cloned[hashAlg][pcr] = append([]byte{}, bank[pcr]...)
+		}
+	}
+	return cloned
+}
+
+// addBank activates another bank on the simulated TPM. The values of the new bank are derived from the
+// values of an existing bank so that pcrs that were extended in the existing bank are extended in the new one
+func (banks pcrBanks) addBank(hashAlg uint16) {
+	if _, ok := banks[hashAlg]; ok {
+		return
+	}
+	var source [][]byte
+	for _, alg := range []uint16{tpmAlgSha256, tpmAlgSha384, tpmAlgSha1, tpmAlgSha512} {
+		if bank, ok := banks[alg]; ok {
+			source = bank
+			break
+		}
+	}
+	banks[hashAlg] = newPcrBanks(hashAlg)[hashAlg]
+	reset := newPcrBanks(tpmAlgSha1)[tpmAlgSha1]
+	for pcr := range source {
+		if bytes.Equal(source[pcr], bytes.Repeat(reset[pcr][:1], len(source[pcr]))) {
+			continue
+		}
+		measurement := pcrBankHash[hashAlg].New()
+		measurement.Write(source[pcr])
+		banks.extend(hashAlg, pcr, measurement.Sum(nil))
+	}
+}
+
+// extend performs a TPM2_PCR_Extend of the measurement into the pcr of the bank that uses hashAlg
+func (banks pcrBanks) extend(hashAlg uint16, pcr int, measurement []byte) error {
+	bank, ok := banks[hashAlg]
+	if !ok {
+		return errors.Errorf("pcr bank with algorithm id 0x%04x does not exist", hashAlg)
+	}
+	if pcr < 0 || pcr >= len(bank) {
+		return errors.Errorf("invalid pcr index %d", pcr)
+	}
+	h := pcrBankHash[hashAlg].New()
+	h.Write(bank[pcr])
+	h.Write(measurement)
+	bank[pcr] = h.Sum(nil)
+	return nil
+}
+
+// selectedPcrValues concatenates the values of the selected pcrs in the order that they appear in the quote
+func (banks pcrBanks) selectedPcrValues(selection []pcrBankSelection) ([]byte, error) {
+	var values []byte
+	for _, sel := range selection {
+		bank, ok := banks[sel.hashAlg]
+		if !ok {
+			return nil, errors.Errorf("pcr bank with algorithm id 0x%04x is not available", sel.hashAlg)
+		}
+		for pcr := 0; pcr < 8*len(sel.pcrSelected) && pcr < len(bank); pcr++ {
+			if sel.isSelected(pcr) {
+				values = append(values, bank[pcr]...)
+			}
+		}
+	}
+	return values, nil
+}
+
+// marshalTpmsAttest creates the TPMS_ATTEST of a quote over the selected pcrs with extraData as the qualifying data
+func marshalTpmsAttest(tmpl quoteTemplate, selection []pcrBankSelection, pcrDigest, extraData []byte) []byte {
+	attest := bytes.NewBuffer([]byte{})
+	binary.Write(attest, binary.BigEndian, uint32(tpmGeneratedValue))
+	binary.Write(attest, binary.BigEndian, uint16(tpmStAttestQuote))
+	binary.Write(attest, binary.BigEndian, uint16(len(tmpl.qualifiedSigner)))
+	attest.Write(tmpl.qualifiedSigner)
+	binary.Write(attest, binary.BigEndian, uint16(len(extraData)))
+	attest.Write(extraData)
+	binary.Write(attest, binary.BigEndian, tmpl.clockInfo)
+	binary.Write(attest, binary.BigEndian, tmpl.firmwareVersion)
+
+	// TPMS_QUOTE_INFO - TPML_PCR_SELECTION followed by the TPM2B_DIGEST of the selected pcrs
+	binary.Write(attest, binary.BigEndian, uint32(len(selection)))
+	for _, sel := range selection {
+		binary.Write(attest, binary.BigEndian, sel.hashAlg)
+		attest.WriteByte(byte(len(sel.pcrSelected)))
+		attest.Write(sel.pcrSelected)
+	}
+	binary.Write(attest, binary.BigEndian, uint16(len(pcrDigest)))
+	attest.Write(pcrDigest)
+	return attest.Bytes()
+}
+
+// quoteNonce returns the extra data of the quote for the nonce of a quote request. Like the Trust Agent, the
+// nonce is hashed with SHA1 and the base64 encoded asset tag of the host is folded into it when a tag is provisioned
+func quoteNonce(nonce []byte, assetTag string) ([]byte, error) {
+	hash := sha1.New()
+	hash.Write(nonce)
+	extraData := hash.Sum(nil)
+	if assetTag == "" {
+		return extraData, nil
+	}
+
+	tag, err := base64.StdEncoding.DecodeString(assetTag)
+	if err != nil {
+		return nil, errors.Wrap(err, "asset tag is not base64 encoded")
+	}
+	hash = sha1.New()
+	hash.Write(extraData)
+	hash.Write(tag)
+	return hash.Sum(nil), nil
+}
+
+// quoteSigningScheme returns the signature algorithm and hash algorithm that the aik signs quotes with. RSA aiks
+// use RSASSA with sha256 and ECC aiks use ECDSA with the hash that matches the size of the curve
+func quoteSigningScheme(aikKey crypto.Signer) (uint16, uint16, error) {
+	switch pub := aikKey.Public().(type) {
+	case *rsa.PublicKey:
+		return tpmAlgRsassa, tpmAlgSha256, nil
+	case *ecdsa.PublicKey:
+		if pub.Curve == elliptic.P384() {
+			return tpmAlgEcdsa, tpmAlgSha384, nil
+		}
+		return tpmAlgEcdsa, tpmAlgSha256, nil
+	}
+	return 0, 0, errors.New("aik is neither an rsa nor an ecc key")
+}
+
+// marshalTpmtSignature signs the digest with the aik and returns the TPMT_SIGNATURE of the signing scheme
+func marshalTpmtSignature(aikKey crypto.Signer, sigAlg, hashAlg uint16, digest []byte) ([]byte, error) {
+	sig := bytes.NewBuffer([]byte{})
+	binary.Write(sig, binary.BigEndian, sigAlg)
+	binary.Write(sig, binary.BigEndian, hashAlg)
+
+	switch key := aikKey.(type) {
+	case *rsa.PrivateKey:
+		signature, err := rsa.SignPKCS1v15(rand.Reader, key, pcrBankHash[hashAlg], digest)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not sign the quote")
+		}
+		binary.Write(sig, binary.BigEndian, uint16(len(signature)))
+		sig.Write(signature)
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not sign the quote")
+		}
+		// the TPM returns r and s with the size of the curve
+		size := (key.Curve.Params().BitSize + 7) / 8
+		for _, n := range []*big.Int{r, s} {
+			binary.Write(sig, binary.BigEndian, uint16(size))
+			sig.Write(n.FillBytes(make([]byte, size)))
+		}
+	default:
+		return nil, errors.New("aik is neither an rsa nor an ecc key")
+	}
+	return sig.Bytes(), nil
+}
+
+// buildQuote creates a quote over the selected pcrs with extraData as the qualifying data, signed with the aik
+func buildQuote(tmpl quoteTemplate, selection []pcrBankSelection, banks pcrBanks, extraData []byte, aikKey crypto.Signer) ([]byte, error) {
+
+	pcrValues, err := banks.selectedPcrValues(selection)
+	if err != nil {
+		return nil, err
+	}
+	sigAlg, hashAlg, err := quoteSigningScheme(aikKey)
+	if err != nil {
+		return nil, err
+	}
+	// the digest of the selected pcrs uses the hash of the signing scheme
+	pcrDigest := pcrBankHash[hashAlg].New()
+	pcrDigest.Write(pcrValues)
+	attest := marshalTpmsAttest(tmpl, selection, pcrDigest.Sum(nil), extraData)
+
+	signHash := pcrBankHash[hashAlg].New()
+	signHash.Write(attest)
+	signature, err := marshalTpmtSignature(aikKey, sigAlg, hashAlg, signHash.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	quote := bytes.NewBuffer(make([]byte, 0, 2+len(attest)+len(signature)+len(pcrValues)))
+	binary.Write(quote, binary.BigEndian, uint16(len(attest)))
+	quote.Write(attest)
+	quote.Write(signature)
+
+	quote.Write(pcrValues)
+	return quote.Bytes(), nil
+}
+
+// parseQuote reads a quote returned by a Trust Agent. The template, pcr selection and pcr values can be used
+// to seed the simulated hosts so that they look like the host the quote was captured from
+func parseQuote(quote []byte) (quoteTemplate, []pcrBankSelection, pcrBanks, error) {
+	var tmpl quoteTemplate
+
+	r := bytes.NewReader(quote)
+	var attestSize uint16
+	var magic uint32
+	var attestType uint16
+	if err := binary.Read(r, binary.BigEndian, &attestSize); err != nil {
+		return tmpl, nil, nil, errors.Wrap(err, "could not read size of quote info")
+	}
+	if int(attestSize)+2 > len(quote) {
+		return tmpl, nil, nil, errors.New("quote is shorter than the size of the quote info")
+	}
+	binary.Read(r, binary.BigEndian, &magic)
+	binary.Read(r, binary.BigEndian, &attestType)
+	if magic != tpmGeneratedValue || attestType != tpmStAttestQuote {
+		return tmpl, nil, nil, errors.New("quote info is not a TPM generated quote")
+	}
+
+	var err error
+	if tmpl.qualifiedSigner, err = readTpm2b(r); err != nil {
+		return tmpl, nil, nil, errors.Wrap(err, "could not read qualified signer from quote")
+	}
+	if _, err = readTpm2b(r); err != nil {
+		return tmpl, nil, nil, errors.Wrap(err, "could not read extra data from quote")
+	}
+	if err = binary.Read(r, binary.BigEndian, &tmpl.clockInfo); err != nil {
+		return tmpl, nil, nil, errors.Wrap(err, "could not read clock info from quote")
+	}
+	if err = binary.Read(r, binary.BigEndian, &tmpl.firmwareVersion); err != nil {
+		return tmpl, nil, nil, errors.Wrap(err, "could not read firmware version from quote")
+	}
+
+	var count uint32
+	if err = binary.Read(r, binary.BigEndian, &count); err != nil {
+		return tmpl, nil, nil, errors.Wrap(err, "could not read pcr selection from quote")
+	}
+	selection := make([]pcrBankSelection, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var sel pcrBankSelection
+		var size byte
+		binary.Read(r, binary.BigEndian, &sel.hashAlg)
+		if size, err = r.ReadByte(); err != nil {
+			return tmpl, nil, nil, errors.Wrap(err, "could not read pcr selection from quote")
+		}
+		sel.pcrSelected = make([]byte, size)
+		if _, err = r.Read(sel.pcrSelected); err != nil {
+			return tmpl, nil, nil, errors.Wrap(err, "could not read pcr selection from quote")
+		}
+		if _, ok := pcrBankHash[sel.hashAlg]; !ok {
+			return tmpl, nil, nil, errors.Errorf("unsupported pcr bank with algorithm id 0x%04x in quote", sel.hashAlg)
+		}
+		selection = append(selection, sel)
+	}
+
+	// skip the pcr digest and the signature to get to the pcr values
+	var sigAlg, sigHashAlg uint16
+	if _, err = readTpm2b(r); err != nil {
+		return tmpl, nil, nil, errors.Wrap(err, "could not read pcr digest from quote")
+	}
+	binary.Read(r, binary.BigEndian, &sigAlg)
+	binary.Read(r, binary.BigEndian, &sigHashAlg)
+	if _, err = readTpm2b(r); err != nil {
+		return tmpl, nil, nil, errors.Wrap(err, "could not read signature from quote")
+	}
+	if sigAlg == tpmAlgEcdsa {
+		// the ECDSA signature is made of r and s
+		if _, err = readTpm2b(r); err != nil {
+			return tmpl, nil, nil, errors.Wrap(err, "could not read signature from quote")
+		}
+	}
+
+	banks := newPcrBanks()
+	for _, sel := range selection {
+		size := pcrBankHash[sel.hashAlg].Size()
+		if _, ok := banks[sel.hashAlg]; !ok {
+			banks[sel.hashAlg] = newPcrBanks(sel.hashAlg)[sel.hashAlg]
+		}
+		for pcr := 0; pcr < 8*len(sel.pcrSelected) && pcr < pcrCount; pcr++ {
+			if !sel.isSelected(pcr) {
+				continue
+			}
+			value := make([]byte, size)
+			if n, _ := r.Read(value); n != size {
+				return tmpl, nil, nil, errors.New("quote does not contain all the selected pcr values")
+			}
+			banks[sel.hashAlg][pcr] = value
+		}
+	}
+	return tmpl, selection, banks, nil
+}
+
+func readTpm2b(r *bytes.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, size)
+	if n, _ := r.Read(buf); n != int(size) {
+		return nil, errors.New("unexpected end of quote")
+	}
+	return buf, nil
+}
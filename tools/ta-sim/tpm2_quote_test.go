@@ -0,0 +1,187 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"io/ioutil"
+	"math/big"
+	"testing"
+
+	"github.com/intel-secl/intel-secl/v4/pkg/lib/common/crypt"
+	tamodel "github.com/intel-secl/intel-secl/v4/pkg/model/ta"
+)
+
+func loadTestQuote(t *testing.T) []byte {
+	quoteXml, err := ioutil.ReadFile("test/repository/quote.xml")
+	if err != nil {
+		t.Fatal("failed to read quote:", err.Error())
+	}
+	var quoteResponse tamodel.TpmQuoteResponse
+	if err = xml.Unmarshal(quoteXml, &quoteResponse); err != nil {
+		t.Fatal("failed to unmarshal quote:", err.Error())
+	}
+	quote, err := base64.StdEncoding.DecodeString(quoteResponse.Quote)
+	if err != nil {
+		t.Fatal("failed to decode quote:", err.Error())
+	}
+	return quote
+}
+
+func loadTestAikKey(t *testing.T) *rsa.PrivateKey {
+	key, err := crypt.GetPrivateKeyFromPKCS8File("test/configuration/aik.key.pem")
+	if err != nil {
+		t.Fatal("failed to load aik key:", err.Error())
+	}
+	return key.(*rsa.PrivateKey)
+}
+
+func TestBuildQuoteMatchesCapturedQuote(t *testing.T) {
+
+	captured := loadTestQuote(t)
+	tmpl, selection, banks, err := parseQuote(captured)
+	if err != nil {
+		t.Fatal("failed to parse quote:", err.Error())
+	}
+
+	// extra data of the captured quote starts after the magic, type and the qualified signer
+	extraDataIdx := 2 + 4 + 2 + 2 + len(tmpl.qualifiedSigner)
+	extraDataSize := int(binary.BigEndian.Uint16(captured[extraDataIdx : extraDataIdx+2]))
+	extraData := captured[extraDataIdx+2 : extraDataIdx+2+extraDataSize]
+
+	aikKey := loadTestAikKey(t)
+	quote, err := buildQuote(tmpl, selection, banks, extraData, aikKey)
+	if err != nil {
+		t.Fatal("failed to build quote:", err.Error())
+	}
+	if len(quote) != len(captured) {
+		t.Fatalf("built quote has %d bytes, captured quote has %d bytes", len(quote), len(captured))
+	}
+
+	attestSize := int(binary.BigEndian.Uint16(quote[0:2]))
+	if !bytes.Equal(quote[:2+attestSize], captured[:2+attestSize]) {
+		t.Error("quote info of the built quote does not match the captured quote")
+	}
+	// signature header, signature and pcr values follow the quote info
+	sigSize := int(binary.BigEndian.Uint16(quote[2+attestSize+4 : 2+attestSize+6]))
+	if !bytes.Equal(quote[2+attestSize+6+sigSize:], captured[2+attestSize+6+sigSize:]) {
+		t.Error("pcr values of the built quote do not match the captured quote")
+	}
+
+	signHash := sha256.Sum256(quote[2 : 2+attestSize])
+	if err = rsa.VerifyPKCS1v15(&aikKey.PublicKey, crypto.SHA256, signHash[:], quote[2+attestSize+6:2+attestSize+6+sigSize]); err != nil {
+		t.Error("signature of the built quote does not verify with the aik:", err.Error())
+	}
+}
+
+func TestBuildQuoteFromPcrTable(t *testing.T) {
+
+	banks := newPcrBanks(tpmAlgSha256, tpmAlgSha384)
+	if err := banks.extend(tpmAlgSha384, 0, bytes.Repeat([]byte{0x01}, 48)); err != nil {
+		t.Fatal("failed to extend pcr:", err.Error())
+	}
+	selection := []pcrBankSelection{newPcrBankSelection(tpmAlgSha384, []int{0, 1, 17})}
+	tmpl := quoteTemplate{qualifiedSigner: []byte{0x00, 0x0b}, firmwareVersion: 0x0102030405060708}
+
+	quote, err := buildQuote(tmpl, selection, banks, []byte("nonce"), loadTestAikKey(t))
+	if err != nil {
+		t.Fatal("failed to build quote:", err.Error())
+	}
+	parsedTmpl, parsedSelection, parsedBanks, err := parseQuote(quote)
+	if err != nil {
+		t.Fatal("failed to parse built quote:", err.Error())
+	}
+	if parsedTmpl.firmwareVersion != tmpl.firmwareVersion || !bytes.Equal(parsedTmpl.qualifiedSigner, tmpl.qualifiedSigner) {
+		t.Error("quote template was not preserved")
+	}
+	if len(parsedSelection) != 1 || parsedSelection[0].hashAlg != tpmAlgSha384 || !bytes.Equal(parsedSelection[0].pcrSelected, selection[0].pcrSelected) {
+		t.Error("pcr selection was not preserved")
+	}
+	for _, pcr := range []int{0, 1, 17} {
+		if !bytes.Equal(parsedBanks[tpmAlgSha384][pcr], banks[tpmAlgSha384][pcr]) {
+			t.Errorf("value of pcr %d was not preserved", pcr)
+		}
+	}
+}
+
+func TestBuildEcdsaQuote(t *testing.T) {
+
+	banks := newPcrBanks(tpmAlgSha256)
+	selection := []pcrBankSelection{newPcrBankSelection(tpmAlgSha256, []int{0, 17})}
+	tmpl := quoteTemplate{qualifiedSigner: []byte{0x00, 0x0b}}
+
+	for keyType, hashAlg := range map[string]uint16{aikKeyTypeEccP256: tpmAlgSha256, aikKeyTypeEccP384: tpmAlgSha384} {
+		key, err := generateAikKey(keyType)
+		if err != nil {
+			t.Fatal("failed to generate ecc aik:", err.Error())
+		}
+		quote, err := buildQuote(tmpl, selection, banks, []byte("nonce"), key)
+		if err != nil {
+			t.Fatal("failed to build quote:", err.Error())
+		}
+		if _, _, parsedBanks, err := parseQuote(quote); err != nil || !bytes.Equal(parsedBanks[tpmAlgSha256][17], banks[tpmAlgSha256][17]) {
+			t.Errorf("failed to parse %s quote", keyType)
+		}
+
+		// TPMT_SIGNATURE of an ECDSA signature - the algorithms followed by r and s
+		r := bytes.NewReader(quote)
+		attest, _ := readTpm2b(r)
+		var sigAlg, sigHashAlg uint16
+		binary.Read(r, binary.BigEndian, &sigAlg)
+		binary.Read(r, binary.BigEndian, &sigHashAlg)
+		sigR, _ := readTpm2b(r)
+		sigS, err := readTpm2b(r)
+		if err != nil || sigAlg != tpmAlgEcdsa || sigHashAlg != hashAlg {
+			t.Fatalf("%s quote does not have an ECDSA signature", keyType)
+		}
+		signHash := pcrBankHash[hashAlg].New()
+		signHash.Write(attest)
+		if !ecdsa.Verify(key.Public().(*ecdsa.PublicKey), signHash.Sum(nil), new(big.Int).SetBytes(sigR), new(big.Int).SetBytes(sigS)) {
+			t.Errorf("signature of the %s quote does not verify with the aik", keyType)
+		}
+	}
+}
+
+func TestPcrSelectionForRequest(t *testing.T) {
+
+	banks := newPcrBanks(tpmAlgSha1, tpmAlgSha256)
+
+	selection, selectedBanks, err := pcrSelectionForRequest(nil, nil, banks)
+	if err != nil {
+		t.Fatal("failed to create default pcr selection:", err.Error())
+	}
+	if len(selection) != 2 || selection[0].hashAlg != tpmAlgSha1 || selection[1].hashAlg != tpmAlgSha256 {
+		t.Error("default pcr selection should select the SHA1 and SHA256 banks")
+	}
+	if len(selectedBanks) != 2 || !bytes.Equal(selection[0].pcrSelected, []byte{0xff, 0xff, 0xff}) {
+		t.Error("default pcr selection should select all pcrs")
+	}
+
+	if _, _, err = pcrSelectionForRequest([]int{0}, []string{"SHA384"}, banks); err == nil {
+		t.Error("quote request for an inactive pcr bank should fail")
+	}
+	if _, _, err = pcrSelectionForRequest([]int{0}, []string{"MD5"}, banks); err == nil {
+		t.Error("quote request for an invalid pcr bank should fail")
+	}
+	if _, _, err = pcrSelectionForRequest([]int{24}, nil, banks); err == nil {
+		t.Error("quote request for an invalid pcr should fail")
+	}
+
+	banks.addBank(tpmAlgSha384)
+	selection, selectedBanks, err = pcrSelectionForRequest([]int{0, 17}, []string{"sha384"}, banks)
+	if err != nil {
+		t.Fatal("failed to create SHA384 pcr selection:", err.Error())
+	}
+	if len(selectedBanks) != 1 || selectedBanks[0] != "SHA384" || !bytes.Equal(selection[0].pcrSelected, []byte{0x01, 0x00, 0x02}) {
+		t.Error("SHA384 pcr selection does not match the request")
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// in virtual host mode all the simulated hosts are served from a single listener instead of a listener per port.
+// The hosts keep their port numbers as identity - the admin api, scenarios and the hw uuid map still number
+// them from PortStart - and requests are routed to them by
+//
+//	sni    the server name of the tls handshake - ta-sim-{port}.{VirtualHostDomain}
+//	host   the host header of the request       - ta-sim-{port}.{VirtualHostDomain}
+//	path   a prefix of the request path          - /hosts/{port}/v2/...
+//
+// sni and host need a dns entry for every host name (or a wildcard one) that points to the simulator, and a tls
+// certificate that is valid for *.{VirtualHostDomain}
+const (
+	virtualHostModeSni  = "sni"
+	virtualHostModeHost = "host"
+	virtualHostModePath = "path"
+)
+
+const (
+	virtualHostNamePrefix = "ta-sim-"
+	virtualHostPathPrefix = "/hosts/"
+)
+
+// virtualPortKey is the key of the port of the virtual host in the context of a request
+type virtualPortKey struct{}
+
+// virtualHostName returns the host name of the virtual host with the given port
+func virtualHostName(port int, domain string) string {
+	return fmt.Sprintf("%s%d.%s", virtualHostNamePrefix, port, domain)
+}
+
+// parseVirtualHostName returns the port of the virtual host with the given host name
+func parseVirtualHostName(name, domain string) (int, bool) {
+	name = strings.ToLower(name)
+	if h, _, err := net.SplitHostPort(name); err == nil {
+		name = h
+	}
+	if !strings.HasPrefix(name, virtualHostNamePrefix) || !strings.HasSuffix(name, "."+strings.ToLower(domain)) {
+		return 0, false
+	}
+	port, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(name, virtualHostNamePrefix), "."+strings.ToLower(domain)))
+	return port, err == nil
+}
+
+// virtualHostRouter finds the virtual host that a request is for and passes the request on with the port of the
+// virtual host in its context. Requests for hosts that do not exist are rejected
+type virtualHostRouter struct {
+	mode      string
+	domain    string
+	portStart int
+	servers   int
+	handler   http.Handler
+}
+
+func (router virtualHostRouter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	port, ok := 0, false
+	switch router.mode {
+	case virtualHostModeSni:
+		if r.TLS != nil {
+			port, ok = parseVirtualHostName(r.TLS.ServerName, router.domain)
+		}
+	case virtualHostModeHost:
+		port, ok = parseVirtualHostName(r.Host, router.domain)
+	case virtualHostModePath:
+		if strings.HasPrefix(r.URL.Path, virtualHostPathPrefix) {
+			// the prefix is removed so that the request is handled like a request to a Trust Agent
+			pathParts := strings.SplitN(strings.TrimPrefix(r.URL.Path, virtualHostPathPrefix), "/", 2)
+			var err error
+			port, err = strconv.Atoi(pathParts[0])
+			ok = err == nil
+			r = r.Clone(r.Context())
+			r.URL.Path, r.URL.RawPath = "/", ""
+			if len(pathParts) == 2 {
+				r.URL.Path += pathParts[1]
+			}
+		}
+	}
+	if !ok || port < router.portStart || port >= router.portStart+router.servers {
+		http.Error(w, "no simulated host for request", http.StatusNotFound)
+		return
+	}
+	router.handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), virtualPortKey{}, port)))
+}
+
+// newVirtualHostServer creates the server that serves all the simulated hosts from a single listener on
+// VirtualHostPort
+func newVirtualHostServer(ac *AppConfig, mux http.Handler) (*http.Server, error) {
+	switch ac.VirtualHostMode {
+	case virtualHostModeSni, virtualHostModeHost, virtualHostModePath:
+	default:
+		return nil, errors.Errorf("invalid virtual host mode %q, should be one of sni, host or path", ac.VirtualHostMode)
+	}
+	server := &http.Server{
+		Addr: fmt.Sprintf(":%d", ac.VirtualHostPort),
+		Handler: virtualHostRouter{
+			mode:      ac.VirtualHostMode,
+			domain:    ac.VirtualHostDomain,
+			portStart: ac.PortStart,
+			servers:   ac.Servers,
+			handler:   mux,
+		},
+	}
+	log.Infof("Serving %d virtual hosts by %s on port %d", ac.Servers, ac.VirtualHostMode, ac.VirtualHostPort)
+	return server, nil
+}
+
+// connectionString returns the connection string that HVS uses to reach the simulated host on port
+func (ac *AppConfig) connectionString(port int, hwUuid string) string {
+	if ac.TaSimServiceMode == communicationModeOutbound {
+		return fmt.Sprintf("intel:nats://%s", hwUuid)
+	}
+	switch ac.VirtualHostMode {
+	case virtualHostModeSni, virtualHostModeHost:
+		return fmt.Sprintf("https://%s:%d", virtualHostName(port, ac.VirtualHostDomain), ac.VirtualHostPort)
+	case virtualHostModePath:
+		return fmt.Sprintf("https://%s:%d%s%d", ac.SimulatorIP, ac.VirtualHostPort, virtualHostPathPrefix, port)
+	}
+	return fmt.Sprintf("https://%s:%d", ac.SimulatorIP, port)
+}
@@ -0,0 +1,74 @@
+/*
+ * Copyright (C) 2020  Intel Corporation
+ * SPDX-License-Identifier: BSD-3-Clause
+ */
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVirtualHostRouter(t *testing.T) {
+
+	var routedPort int
+	var routedPath string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v2/host", func(w http.ResponseWriter, r *http.Request) {
+		routedPort, routedPath = hostPort(r), r.URL.Path
+	})
+
+	requests := map[string]func(port int) *http.Request{
+		virtualHostModeSni: func(port int) *http.Request {
+			req := httptest.NewRequest("GET", "https://10.1.2.3:10000/v2/host", nil)
+			req.TLS = &tls.ConnectionState{ServerName: virtualHostName(port, "ta-sim.local")}
+			return req
+		},
+		virtualHostModeHost: func(port int) *http.Request {
+			return httptest.NewRequest("GET", fmt.Sprintf("https://%s:10000/v2/host", virtualHostName(port, "ta-sim.local")), nil)
+		},
+		virtualHostModePath: func(port int) *http.Request {
+			return httptest.NewRequest("GET", fmt.Sprintf("https://10.1.2.3:10000/hosts/%d/v2/host", port), nil)
+		},
+	}
+	for mode, request := range requests {
+		router := virtualHostRouter{mode: mode, domain: "ta-sim.local", portStart: 10000, servers: 100, handler: mux}
+
+		routedPort, routedPath = 0, ""
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, request(10042))
+		if rec.Code != http.StatusOK || routedPort != 10042 || routedPath != "/v2/host" {
+			t.Errorf("%s: request was routed to port %d and path %q with status %d", mode, routedPort, routedPath, rec.Code)
+		}
+
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, request(10100))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: request for a host that does not exist returned %d", mode, rec.Code)
+		}
+	}
+}
+
+func TestConnectionString(t *testing.T) {
+
+	ac := &AppConfig{SimulatorIP: "10.1.2.3", VirtualHostPort: 9000, VirtualHostDomain: "ta-sim.local", TaSimServiceMode: communicationModeHttp}
+	expected := map[string]string{
+		"":                  "https://10.1.2.3:10001",
+		virtualHostModeSni:  "https://ta-sim-10001.ta-sim.local:9000",
+		virtualHostModeHost: "https://ta-sim-10001.ta-sim.local:9000",
+		virtualHostModePath: "https://10.1.2.3:9000/hosts/10001",
+	}
+	for mode, cs := range expected {
+		ac.VirtualHostMode = mode
+		if connectionString := ac.connectionString(10001, "hw-uuid"); connectionString != cs {
+			t.Errorf("connection string in mode %q is %s instead of %s", mode, connectionString, cs)
+		}
+	}
+	ac.TaSimServiceMode = communicationModeOutbound
+	if connectionString := ac.connectionString(10001, "hw-uuid"); connectionString != "intel:nats://hw-uuid" {
+		t.Errorf("connection string in outbound mode is %s", connectionString)
+	}
+}